@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"loki/pkg/downloader"
+	"loki/pkg/parser"
+	"math"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -13,6 +21,32 @@ var (
 	url    string
 	output string
 	name   string
+
+	variantPolicy string
+	resolution    string
+	maxBandwidth  uint
+	codecs        string
+	languages     string
+	duration      time.Duration
+	lowLatency    bool
+	keyHex        string
+	keyFile       string
+	ivHex         string
+	discontinuity string
+	startTime     string
+	endTime       string
+	seekFrom      string
+	seekTo        string
+	exactTrim     bool
+	skipAds       bool
+	lenient       bool
+	mirrorMode    string
+	ladder        bool
+	partial       string
+	retries       int
+	onFailure     string
+	stream        bool
+	streamBuffer  int
 )
 
 const (
@@ -26,6 +60,31 @@ func init() {
 	flag.StringVar(&url, "u", "", "URL to fetch")
 	flag.StringVar(&output, "o", "", "Output path")
 	flag.StringVar(&name, "n", "output", "File name")
+	flag.StringVar(&variantPolicy, "variant", "", "Variant policy: highest, lowest, resolution or first (default highest)")
+	flag.StringVar(&resolution, "resolution", "", "Target resolution for the variant, e.g. 1280x720")
+	flag.UintVar(&maxBandwidth, "max-bandwidth", 0, "Reject variants above this BANDWIDTH")
+	flag.StringVar(&codecs, "codecs", "", "Preferred codecs in order, e.g. avc1,hvc1")
+	flag.StringVar(&languages, "lang", "", "Audio and subtitle languages to fetch, e.g. en,fr (default: the DEFAULT rendition)")
+	flag.DurationVar(&duration, "duration", 0, "Stop recording a live playlist after this long, e.g. 90m (default: until EXT-X-ENDLIST)")
+	flag.BoolVar(&lowLatency, "ll", false, "Record Low-Latency HLS part by part with blocking playlist reloads")
+	flag.StringVar(&keyHex, "key", "", "Decryption key in hex, used instead of the EXT-X-KEY URI")
+	flag.StringVar(&keyFile, "key-file", "", "File holding the decryption key, raw, hex or base64")
+	flag.StringVar(&ivHex, "iv", "", "IV in hex, overrides the EXT-X-KEY IV")
+	flag.StringVar(&startTime, "start", "", "Only fetch segments after this EXT-X-PROGRAM-DATE-TIME, RFC 3339, e.g. 2024-05-01T10:05:00Z")
+	flag.StringVar(&endTime, "end", "", "Only fetch segments before this EXT-X-PROGRAM-DATE-TIME, RFC 3339")
+	flag.StringVar(&seekFrom, "ss", "", "Start offset in the playlist, hh:mm:ss[.ms], mm:ss or seconds")
+	flag.StringVar(&seekTo, "to", "", "End offset in the playlist, hh:mm:ss[.ms], mm:ss or seconds")
+	flag.BoolVar(&exactTrim, "exact", false, "Trim MPEG-TS output to the exact '-ss' and '-to' timestamps instead of whole segments")
+	flag.BoolVar(&skipAds, "skip-ads", false, "Drop segments inside EXT-X-DATERANGE, EXT-X-CUE-OUT or SCTE-35 ad breaks and write a JSON report of them")
+	flag.BoolVar(&lenient, "lenient", false, "Skip playlist lines that cannot be parsed and print them as warnings instead of failing")
+	flag.StringVar(&mirrorMode, "mirror", "", "Save the HLS package with local URIs instead of merging: encrypted, decrypted, all or all-decrypted")
+	flag.BoolVar(&ladder, "ladder", false, "Download every variant and rendition of the master playlist, with a master playlist tying the outputs together")
+	flag.StringVar(&partial, "partial", string(downloader.PartialPrefix), "Merge on the first Ctrl-C: prefix up to the first missing segment, all completed segments with gaps, or none")
+	flag.IntVar(&retries, "retries", downloader.DefaultRetries, "Fetch attempts per segment before '-on-failure' applies")
+	flag.StringVar(&onFailure, "on-failure", string(downloader.FailureFail), "When a segment is out of retries: fail the download, skip the segment or fill its place with the previous one")
+	flag.BoolVar(&stream, "stream", false, "Append segments to the output as they download instead of storing them and merging afterwards, no resume")
+	flag.IntVar(&streamBuffer, "stream-buffer", 64, "Megabytes of early segments '-stream' holds in memory before spilling them to disk")
+	flag.StringVar(&discontinuity, "discontinuity", "", "Merge across EXT-X-DISCONTINUITY: rewrite timestamps, split into files or concat (default rewrite)")
 }
 
 func main() {
@@ -42,13 +101,73 @@ func main() {
 		os.Exit(1)
 	}
 
+	startAt, endAt, err := wallClockRange()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	from, to, err := clipRange()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	keyProvider, iv, err := keyOverrides()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Ctrl-C and SIGTERM stop the download and merge what was fetched, the segments are kept to resume from
+	ctx := interruptContext()
+
 	dl := downloader.New()
-	if err := dl.Start(&downloader.Task{
+	if err := dl.Start(ctx, &downloader.Task{
 		M3U8URL:        url,
 		OutputFilePath: output,
 		OutputFileName: name,
 		Concurrency:    concurrency,
+		Variant: parser.VariantSelector{
+			Policy:       parser.VariantPolicy(variantPolicy),
+			Resolution:   resolution,
+			MaxBandwidth: uint32(maxBandwidth),
+			Codecs:       splitList(codecs),
+		},
+		Languages:     splitList(languages),
+		MaxDuration:   duration,
+		LowLatency:    lowLatency,
+		KeyProvider:   keyProvider,
+		IV:            iv,
+		Discontinuity: downloader.DiscontinuityMode(discontinuity),
+		Start:         startAt,
+		End:           endAt,
+		From:          from,
+		To:            to,
+		ExactTrim:     exactTrim,
+		SkipAds:       skipAds,
+		Lenient:       lenient,
+		Mirror:        mirrorMode != "",
+		MirrorAll:     strings.HasPrefix(mirrorMode, "all"),
+		MirrorDecrypt: strings.HasSuffix(mirrorMode, "decrypted"),
+		Ladder:        ladder,
+		Partial:       partialMode(),
+		Retries:       retries,
+		OnFailure:     downloader.FailurePolicy(onFailure),
+		Stream:        stream,
+		StreamBuffer:  streamBuffer << 20,
 	}); err != nil {
+		var canceled *downloader.CanceledError
+		if errors.As(err, &canceled) {
+			fmt.Fprintln(os.Stderr, "\nInterrupted:", err)
+			if canceled.WorkFolder != "" {
+				fmt.Fprintf(os.Stderr, "Segments are kept in %s, run the same command again to resume\n", canceled.WorkFolder)
+			}
+			os.Exit(130)
+		}
 		fmt.Fprintln(os.Stderr, "Error:", err)
 		os.Exit(1)
 	}
@@ -61,5 +180,177 @@ func validate() error {
 		return fmt.Errorf("parameter '-u' (M3U8 URL) is required")
 	}
 
+	switch parser.VariantPolicy(variantPolicy) {
+	case "", parser.VariantPolicyHighest, parser.VariantPolicyLowest, parser.VariantPolicyResolution, parser.VariantPolicyFirst:
+	default:
+		return fmt.Errorf("parameter '-variant' must be highest, lowest, resolution or first")
+	}
+
+	if parser.VariantPolicy(variantPolicy) == parser.VariantPolicyResolution && resolution == "" {
+		return fmt.Errorf("parameter '-resolution' is required by '-variant=resolution'")
+	}
+
+	switch downloader.DiscontinuityMode(discontinuity) {
+	case "", downloader.DiscontinuityRewrite, downloader.DiscontinuitySplit, downloader.DiscontinuityConcat:
+	default:
+		return fmt.Errorf("parameter '-discontinuity' must be rewrite, split or concat")
+	}
+
+	switch mirrorMode {
+	case "", "encrypted", "decrypted", "all", "all-decrypted":
+	default:
+		return fmt.Errorf("parameter '-mirror' must be encrypted, decrypted, all or all-decrypted")
+	}
+
+	if ladder && mirrorMode != "" {
+		return fmt.Errorf("parameters '-ladder' and '-mirror' are mutually exclusive")
+	}
+
+	switch partial {
+	case "none", string(downloader.PartialPrefix), string(downloader.PartialAll):
+	default:
+		return fmt.Errorf("parameter '-partial' must be prefix, all or none")
+	}
+
+	switch downloader.FailurePolicy(onFailure) {
+	case downloader.FailureFail, downloader.FailureSkip, downloader.FailureFill:
+	default:
+		return fmt.Errorf("parameter '-on-failure' must be fail, skip or fill")
+	}
+
+	if stream && mirrorMode != "" {
+		return fmt.Errorf("parameters '-stream' and '-mirror' are mutually exclusive")
+	}
+
+	if stream && downloader.DiscontinuityMode(discontinuity) == downloader.DiscontinuitySplit {
+		return fmt.Errorf("parameter '-stream' writes a single file, it cannot be used with '-discontinuity=split'")
+	}
+
+	if streamBuffer < 1 {
+		return fmt.Errorf("parameter '-stream-buffer' must be at least 1")
+	}
+
+	if retries < 1 {
+		return fmt.Errorf("parameter '-retries' must be at least 1")
+	}
+
+	if keyHex != "" && keyFile != "" {
+		return fmt.Errorf("parameters '-key' and '-key-file' are mutually exclusive")
+	}
+
 	return nil
 }
+
+// interruptContext returns a context canceled by the first Ctrl-C or SIGTERM, the download then merges
+// what it has. A second one exits right away.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Fprintln(os.Stderr, "\nStopping, press Ctrl-C again to abort without merging")
+		cancel()
+		<-signals
+		fmt.Fprintln(os.Stderr, "Aborted")
+		os.Exit(130)
+	}()
+	return ctx
+}
+
+// partialMode returns what to merge on interruption, none merges nothing
+func partialMode() downloader.PartialMode {
+	if partial == "none" {
+		return ""
+	}
+	return downloader.PartialMode(partial)
+}
+
+// wallClockRange parses '-start' and '-end', unset bounds stay zero
+func wallClockRange() (start, end time.Time, err error) {
+	if startTime != "" {
+		if start, err = time.Parse(time.RFC3339, startTime); err != nil {
+			return start, end, fmt.Errorf("parameter '-start': %v", err)
+		}
+	}
+	if endTime != "" {
+		if end, err = time.Parse(time.RFC3339, endTime); err != nil {
+			return start, end, fmt.Errorf("parameter '-end': %v", err)
+		}
+	}
+	if !start.IsZero() && !end.IsZero() && !end.After(start) {
+		return start, end, fmt.Errorf("parameter '-end' must be after '-start'")
+	}
+	return start, end, nil
+}
+
+// clipRange parses '-ss' and '-to', unset offsets stay zero
+func clipRange() (from, to time.Duration, err error) {
+	if seekFrom != "" {
+		if from, err = parseOffset(seekFrom); err != nil {
+			return from, to, fmt.Errorf("parameter '-ss': %v", err)
+		}
+	}
+	if seekTo != "" {
+		if to, err = parseOffset(seekTo); err != nil {
+			return from, to, fmt.Errorf("parameter '-to': %v", err)
+		}
+		if to <= from {
+			return from, to, fmt.Errorf("parameter '-to' must be after '-ss'")
+		}
+	}
+	return from, to, nil
+}
+
+// parseOffset parses a playlist offset written as hh:mm:ss[.ms], mm:ss[.ms] or seconds
+func parseOffset(s string) (time.Duration, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) > 3 {
+		return 0, fmt.Errorf("invalid offset %q", s)
+	}
+
+	var total float64
+	for i, field := range fields {
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil || v < 0 || (i > 0 && v >= 60) || (i < len(fields)-1 && v != math.Trunc(v)) {
+			return 0, fmt.Errorf("invalid offset %q", s)
+		}
+		total = total*60 + v
+	}
+	return time.Duration(total * float64(time.Second)), nil
+}
+
+// keyOverrides builds the key provider and IV from '-key', '-key-file' and '-iv'
+func keyOverrides() (parser.KeyProvider, []byte, error) {
+	var provider parser.KeyProvider
+	switch {
+	case keyHex != "":
+		static, err := parser.NewHexKeyProvider(keyHex)
+		if err != nil {
+			return nil, nil, err
+		}
+		provider = static
+	case keyFile != "":
+		provider = &parser.FileKeyProvider{Path: keyFile}
+	}
+
+	var iv []byte
+	if ivHex != "" {
+		var err error
+		if iv, err = parser.ParseIV(ivHex); err != nil {
+			return nil, nil, err
+		}
+	}
+	return provider, iv, nil
+}
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
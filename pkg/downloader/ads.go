@@ -0,0 +1,116 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"loki/pkg/parser"
+)
+
+// adReport lists what was removed from one output when skipping ads
+type adReport struct {
+	Output          string     `json:"output"`
+	RemovedSegments int        `json:"removed_segments"`
+	RemovedDuration float64    `json:"removed_duration"`
+	Breaks          []*adEntry `json:"breaks"`
+}
+
+// adEntry is an ad break as it was removed from the output
+type adEntry struct {
+	ID              string     `json:"id,omitempty"`
+	Source          string     `json:"source"`
+	StartDate       *time.Time `json:"start_date,omitempty"`
+	PlannedDuration float64    `json:"planned_duration,omitempty"`
+	EventID         *uint32    `json:"scte35_event_id,omitempty"`
+	FirstSequence   uint64     `json:"first_sequence"`
+	LastSequence    uint64     `json:"last_sequence"`
+	RemovedDuration float64    `json:"removed_duration"`
+	Segments        []string   `json:"segments"`
+
+	brk *parser.AdBreak
+}
+
+// skipAds drops the segments inside ad breaks when Task.SkipAds is set and records them for the report.
+// The first segment kept after a break is marked so its timestamps are realigned while merging.
+func (d *Downloader) skipAds(task *Task, segs []*parser.Segment) []*parser.Segment {
+	if !task.SkipAds {
+		return segs
+	}
+	if d.ads == nil {
+		d.ads = &adReport{Breaks: []*adEntry{}}
+		d.cuts = make(map[*parser.Segment]bool)
+	}
+
+	var kept []*parser.Segment
+	for _, seg := range segs {
+		if seg.AdBreak == nil {
+			if d.skipping {
+				d.cuts[seg] = true
+				d.skipping = false
+			}
+			kept = append(kept, seg)
+			continue
+		}
+		d.ads.add(seg)
+		d.skipping = true
+	}
+	return kept
+}
+
+// add records a removed segment, consecutive segments of the same break share an entry
+func (r *adReport) add(seg *parser.Segment) {
+	brk := seg.AdBreak
+	var last *adEntry
+	if n := len(r.Breaks); n > 0 {
+		last = r.Breaks[n-1]
+	}
+	// Reloaded playlists parse the same break again, match it by ID and position
+	if last == nil || (last.brk != brk && (last.ID != brk.ID || seg.Sequence > last.LastSequence+1)) {
+		last = &adEntry{
+			ID:              brk.ID,
+			Source:          brk.Source,
+			PlannedDuration: brk.Duration,
+			FirstSequence:   seg.Sequence,
+			brk:             brk,
+		}
+		if !brk.StartDate.IsZero() {
+			last.StartDate = &brk.StartDate
+		}
+		if brk.Out != nil {
+			last.EventID = &brk.Out.EventID
+		}
+		r.Breaks = append(r.Breaks, last)
+	}
+	last.brk = brk
+	last.LastSequence = seg.Sequence
+	last.RemovedDuration += float64(seg.Duration)
+	last.Segments = append(last.Segments, seg.URI)
+	r.RemovedSegments++
+	r.RemovedDuration += float64(seg.Duration)
+}
+
+// writeAdReport writes the ad report as JSON next to the output
+func (d *Downloader) writeAdReport() error {
+	if d.ads == nil {
+		d.ads = &adReport{Breaks: []*adEntry{}}
+	}
+	d.ads.Output = d.outputFileName
+
+	data, err := json.MarshalIndent(d.ads, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode ad report: %w", err)
+	}
+	name := strings.TrimSuffix(d.outputFileName, filepath.Ext(d.outputFileName)) + adReportSuffix
+	path := filepath.Join(d.outputFilePath, name)
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("write ad report %s: %w", path, err)
+	}
+
+	fmt.Printf("[ads] removed %d segments (%.1fs) in %d breaks, report: %s\n",
+		d.ads.RemovedSegments, d.ads.RemovedDuration, len(d.ads.Breaks), path)
+	return nil
+}
@@ -0,0 +1,151 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// adsServer serves the playlists in order at /v.m3u8, the last one again on later reloads, and counts
+// the segment requests
+func adsServer(t *testing.T, reloads ...string) (*Task, func(path string) int) {
+	t.Helper()
+	var (
+		lock     sync.Mutex
+		served   int
+		requests = make(map[string]int)
+	)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		fmt.Fprint(w, reloads[min(served, len(reloads)-1)])
+		served++
+	}, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests[r.URL.Path]++
+		lock.Unlock()
+		segmentHandler(w, r)
+	})
+	task := testTask(t, server)
+	task.SkipAds = true
+	return task, func(path string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests[path]
+	}
+}
+
+// readAdReport decodes the ad report written next to the output of task
+func readAdReport(t *testing.T, task *Task) *adReport {
+	t.Helper()
+	var report adReport
+	if err := json.Unmarshal(readFile(t, filepath.Join(task.OutputFilePath, "out.ads.json")), &report); err != nil {
+		t.Fatalf("Expected a JSON ad report, got %v", err)
+	}
+	return &report
+}
+
+func TestSkipAdsRemovesBreaks(t *testing.T) {
+	// Arrange
+	dated := func(seq int) string {
+		return programStart.Add(time.Duration(seq) * 4 * time.Second).Format(time.RFC3339)
+	}
+	playlist := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXT-X-PROGRAM-DATE-TIME:" + dated(0),
+		"#EXTINF:4,", "s0.ts",
+		"#EXT-X-CUE-OUT:8",
+		"#EXTINF:4,", "s1.ts",
+		"#EXTINF:4,", "s2.ts",
+		"#EXT-X-CUE-IN",
+		"#EXTINF:4,", "s3.ts",
+		fmt.Sprintf(`#EXT-X-DATERANGE:ID="ad2",START-DATE="%s",DURATION=8,`, dated(4)) +
+			"SCTE35-OUT=0xFC302000000000000000FFF00F05000000017FFFFE002932E000010000000000000000",
+		"#EXTINF:4,", "s4.ts",
+		"#EXTINF:4,", "s5.ts",
+		"#EXTINF:4,", "s6.ts",
+		"#EXTINF:4,", "s7.ts",
+		"#EXT-X-ENDLIST",
+	}, "\n")
+	task, requests := adsServer(t, playlist)
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// The segments after each break are realigned to follow the ones before it
+	if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, []float64{0, 4, 8, 12}) {
+		t.Errorf("Expected segments 0, 3, 6 and 7 back to back, got %v", got)
+	}
+	for _, seq := range []int{1, 2, 4, 5} {
+		if n := requests(fmt.Sprintf("/s%d.ts", seq)); n != 0 {
+			t.Errorf("Expected ad segment %d not to be fetched, got %d requests", seq, n)
+		}
+	}
+
+	report := readAdReport(t, task)
+	if report.Output != "out.ts" || report.RemovedSegments != 4 || report.RemovedDuration != 16 {
+		t.Errorf("Expected 4 segments (16s) removed from out.ts, got %d (%vs) from %s",
+			report.RemovedSegments, report.RemovedDuration, report.Output)
+	}
+	if len(report.Breaks) != 2 {
+		t.Fatalf("Expected 2 breaks, got %d", len(report.Breaks))
+	}
+	cue, dr := report.Breaks[0], report.Breaks[1]
+	if cue.Source != "EXT-X-CUE-OUT" || cue.ID != "" || cue.PlannedDuration != 8 || cue.StartDate != nil ||
+		cue.FirstSequence != 1 || cue.LastSequence != 2 || !slices.Equal(cue.Segments, []string{"s1.ts", "s2.ts"}) {
+		t.Errorf("Unexpected cue break %+v", cue)
+	}
+	if dr.Source != "EXT-X-DATERANGE" || dr.ID != "ad2" || dr.PlannedDuration != 8 || dr.RemovedDuration != 8 ||
+		dr.StartDate == nil || !dr.StartDate.Equal(programStart.Add(16*time.Second)) ||
+		dr.EventID == nil || *dr.EventID != 1 ||
+		dr.FirstSequence != 4 || dr.LastSequence != 5 || !slices.Equal(dr.Segments, []string{"s4.ts", "s5.ts"}) {
+		t.Errorf("Unexpected date range break %+v", dr)
+	}
+}
+
+func TestSkipAdsMergesBreakAcrossReloads(t *testing.T) {
+	// Arrange
+	task, _ := adsServer(t,
+		"#EXTM3U\n#EXT-X-TARGETDURATION:0.05\n#EXT-X-MEDIA-SEQUENCE:0\n"+
+			"#EXTINF:4,\ns0.ts\n#EXT-X-CUE-OUT:8\n#EXTINF:4,\ns1.ts\n",
+		// The reload starts inside the break it already reported
+		"#EXTM3U\n#EXT-X-TARGETDURATION:0.05\n#EXT-X-MEDIA-SEQUENCE:1\n"+
+			"#EXT-X-CUE-OUT-CONT:ElapsedTime=0,Duration=8\n#EXTINF:4,\ns1.ts\n#EXTINF:4,\ns2.ts\n"+
+			"#EXT-X-CUE-IN\n#EXTINF:4,\ns3.ts\n#EXT-X-ENDLIST\n",
+	)
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, []float64{0, 4}) {
+		t.Errorf("Expected segments 0 and 3 back to back, got %v", got)
+	}
+	report := readAdReport(t, task)
+	if len(report.Breaks) != 1 {
+		t.Fatalf("Expected the break seen twice to be reported once, got %d breaks", len(report.Breaks))
+	}
+	brk := report.Breaks[0]
+	if brk.FirstSequence != 1 || brk.LastSequence != 2 || brk.RemovedDuration != 8 ||
+		!slices.Equal(brk.Segments, []string{"s1.ts", "s2.ts"}) {
+		t.Errorf("Expected media sequence 1-2 (8s) in the break, got %+v", brk)
+	}
+	if report.RemovedSegments != 2 {
+		t.Errorf("Expected 2 removed segments, got %d", report.RemovedSegments)
+	}
+}
@@ -0,0 +1,81 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"loki/pkg/tools"
+)
+
+// groupRanges merges adjacent EXT-X-BYTERANGE segments of the same resource so they are fetched
+// with one request, and returns the index of the first segment of every request
+func (d *Downloader) groupRanges(indexes []int) []int {
+	if d.groups == nil {
+		d.groups = make(map[int][]int)
+	}
+
+	leaders := make([]int, 0, len(indexes))
+	for i := 0; i < len(indexes); {
+		first := d.segments[indexes[i]]
+		group := []int{indexes[i]}
+		size := first.Length
+		for j := i + 1; j < len(indexes) && first.Length > 0; j++ {
+			prev, cur := d.segments[indexes[j-1]], d.segments[indexes[j]]
+			if cur.Length == 0 || cur.Offset != prev.Offset+prev.Length || size+cur.Length > maxRangeRequest ||
+				d.resolveTSURL(indexes[j]) != d.resolveTSURL(indexes[i]) {
+				break
+			}
+			group = append(group, indexes[j])
+			size += cur.Length
+		}
+		leaders = append(leaders, indexes[i])
+		d.groups[indexes[i]] = group
+		i += len(group)
+	}
+	return leaders
+}
+
+// fetchGroup downloads a group of segments and returns the data of each one
+func fetchGroup(ctx context.Context, segs []segment) ([][]byte, error) {
+	first := segs[0]
+	tsURL := first.url()
+
+	var total uint64
+	for _, seg := range segs {
+		total += seg.Length
+	}
+
+	var (
+		body io.ReadCloser
+		err  error
+	)
+	if first.Length > 0 {
+		body, err = tools.GetRange(ctx, tsURL, first.Offset, total)
+	} else {
+		body, err = tools.Get(ctx, tsURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("read bytes from %s: %w", tsURL, err)
+	}
+	if first.Length == 0 {
+		return [][]byte{data}, nil
+	}
+	if uint64(len(data)) != total {
+		return nil, fmt.Errorf("byte range %d@%d of %s: got %d bytes", total, first.Offset, tsURL, len(data))
+	}
+
+	datas := make([][]byte, 0, len(segs))
+	for _, seg := range segs {
+		n := seg.Length
+		datas = append(datas, data[:n:n])
+		data = data[n:]
+	}
+	return datas, nil
+}
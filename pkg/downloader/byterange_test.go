@@ -0,0 +1,138 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"loki/pkg/parser"
+)
+
+func TestGroupRanges(t *testing.T) {
+	base, _ := url.Parse("http://example.com/v.m3u8")
+	result := &parser.Result{URL: base}
+	ranged := func(uri string, offset, length uint64) *segment {
+		return &segment{Segment: &parser.Segment{URI: uri, Offset: offset, Length: length}, result: result}
+	}
+	tests := []struct {
+		name     string
+		segments []*segment
+		indexes  []int
+		leaders  []int
+		groups   map[int][]int
+	}{
+		{
+			"adjacent ranges",
+			[]*segment{ranged("a.ts", 0, 10), ranged("a.ts", 10, 10), ranged("a.ts", 20, 5)},
+			[]int{0, 1, 2}, []int{0}, map[int][]int{0: {0, 1, 2}},
+		},
+		{
+			"gap between ranges",
+			[]*segment{ranged("a.ts", 0, 10), ranged("a.ts", 15, 10)},
+			[]int{0, 1}, []int{0, 1}, map[int][]int{0: {0}, 1: {1}},
+		},
+		{
+			"other resource",
+			[]*segment{ranged("a.ts", 0, 10), ranged("b.ts", 10, 10)},
+			[]int{0, 1}, []int{0, 1}, map[int][]int{0: {0}, 1: {1}},
+		},
+		{
+			"whole files",
+			[]*segment{ranged("a.ts", 0, 0), ranged("a.ts", 0, 0)},
+			[]int{0, 1}, []int{0, 1}, map[int][]int{0: {0}, 1: {1}},
+		},
+		{
+			"request size limit",
+			[]*segment{ranged("a.ts", 0, maxRangeRequest-10), ranged("a.ts", maxRangeRequest-10, 20), ranged("a.ts", maxRangeRequest+10, 5)},
+			[]int{0, 1, 2}, []int{0, 1}, map[int][]int{0: {0}, 1: {1, 2}},
+		},
+		{
+			"downloaded segment in between",
+			[]*segment{ranged("a.ts", 0, 10), ranged("a.ts", 10, 10), ranged("a.ts", 20, 10)},
+			[]int{0, 2}, []int{0, 2}, map[int][]int{0: {0}, 2: {2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Arrange
+			d := &Downloader{segments: tt.segments}
+
+			// Act
+			leaders := d.groupRanges(tt.indexes)
+
+			// Assert
+			if !slices.Equal(leaders, tt.leaders) {
+				t.Errorf("Expected leaders %v, got %v", tt.leaders, leaders)
+			}
+			for leader, group := range tt.groups {
+				if !slices.Equal(d.groups[leader], group) {
+					t.Errorf("Expected group %v for segment %d, got %v", group, leader, d.groups[leader])
+				}
+			}
+		})
+	}
+}
+
+func TestByteRangesShareRequests(t *testing.T) {
+	resource := make([]byte, 100) // the ranges start after other data of the resource
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-TARGETDURATION:4\n")
+	for seq := 0; seq < 3; seq++ {
+		packet := tsSegment(float64(seq) * 4)
+		fmt.Fprintf(&playlist, "#EXTINF:4,\n#EXT-X-BYTERANGE:%d@%d\nall.ts\n", len(packet), len(resource))
+		resource = append(resource, packet...)
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+
+	tests := []struct {
+		name         string
+		ignoresRange bool
+	}{
+		{"partial content", false},
+		{"whole resource for a range request", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Arrange
+			var (
+				lock   sync.Mutex
+				ranges []string
+			)
+			server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, playlist.String())
+			}, func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				lock.Unlock()
+				if tt.ignoresRange {
+					w.Write(resource)
+					return
+				}
+				http.ServeContent(w, r, "all.ts", time.Time{}, bytes.NewReader(resource))
+			})
+			task := testTask(t, server)
+
+			// Act
+			err := New().Start(context.Background(), task)
+
+			// Assert
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			want := []string{fmt.Sprintf("bytes=100-%d", len(resource)-1)}
+			if !slices.Equal(ranges, want) {
+				t.Errorf("Expected one request for the adjacent ranges %q, got %q", want, ranges)
+			}
+			if got := readOutput(t, task); !bytes.Equal(got, resource[100:]) {
+				t.Errorf("Expected the %d bytes of the three ranges, got %d bytes", len(resource)-100, len(got))
+			}
+		})
+	}
+}
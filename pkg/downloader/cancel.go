@@ -0,0 +1,42 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Error implements error
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("download canceled: %v", e.Cause)
+}
+
+// Unwrap returns the context error, so errors.Is(err, context.Canceled) holds
+func (e *CanceledError) Unwrap() error {
+	return e.Cause
+}
+
+// canceled returns the error reported when ctx is done during the download, the work folder
+// is only named when a state file lets the download resume from it
+func (d *Downloader) canceled(ctx context.Context) error {
+	e := &CanceledError{Cause: ctx.Err()}
+	if d.state != nil {
+		e.WorkFolder = d.tsFolder
+	}
+	return e
+}
+
+// sleep waits for the duration or until ctx is done, whichever comes first
+func sleep(ctx context.Context, wait time.Duration) error {
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
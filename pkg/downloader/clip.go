@@ -0,0 +1,115 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"loki/pkg/media"
+	"loki/pkg/parser"
+)
+
+// clip is what is cut from the first and last segment when trimming to exact timestamps
+type clip struct {
+	first int     // index of the first segment
+	last  int     // index of the last segment
+	head  float64 // seconds dropped from the start of the first segment, up to its last keyframe before
+	tail  float64 // seconds kept from the start of the last segment, 0 keeps it whole
+}
+
+// hasClip reports whether the task is limited to a time range of the playlist
+func (t *Task) hasClip() bool {
+	return t.From > 0 || t.To > 0
+}
+
+// clipSegments keeps the segments that overlap [Task.From, Task.To), measured with the EXTINF
+// durations from the start of the playlist. It returns the time range the kept segments cover
+// and how far into the first and last segment the requested range begins and ends.
+func (t *Task) clipSegments(segs []*parser.Segment) (kept []*parser.Segment, start, end, head, tail time.Duration) {
+	var offset time.Duration
+	for _, seg := range segs {
+		segStart, segEnd := offset, offset+segmentDuration(seg)
+		offset = segEnd
+		if segEnd <= t.From || (t.To > 0 && segStart >= t.To) {
+			continue
+		}
+		if len(kept) == 0 {
+			start, head = segStart, t.From-segStart
+		}
+		kept = append(kept, seg)
+		end = segEnd
+		if t.To > 0 && t.To < segEnd {
+			tail = t.To - segStart
+		}
+	}
+	return kept, start, end, max(head, 0), tail
+}
+
+// selectSegments queues the segments of a VOD playlist that fall in the requested time range
+func (d *Downloader) selectSegments(task *Task, result *parser.Result) ([]int, error) {
+	segs := result.M3U8.Segments
+	var c *clip
+	if task.hasClip() {
+		kept, start, end, head, tail := task.clipSegments(segs)
+		to := "end"
+		if task.To > 0 {
+			to = formatOffset(task.To)
+		}
+		fmt.Printf("[range] requested %s-%s, segments cover %s-%s\n",
+			formatOffset(task.From), to, formatOffset(start), formatOffset(end))
+		segs = kept
+
+		if task.ExactTrim && len(segs) > 0 && segs[0].Map != nil {
+			log.Printf("[warning] exact trimming only supports MPEG-TS, keeping whole segments")
+		} else if task.ExactTrim && len(segs) > 0 {
+			c = &clip{head: head.Seconds(), tail: tail.Seconds()}
+			if tail > 0 {
+				end = task.To
+			}
+			fmt.Printf("[range] trimming to %s-%s\n", formatOffset(start+head), formatOffset(end))
+		}
+	}
+
+	segs = d.skipAds(task, task.window(segs))
+	if len(segs) == 0 {
+		return nil, errors.New("no segment in the requested range")
+	}
+
+	indexes := d.appendSegments(result, segs)
+	if c != nil {
+		c.first, c.last = indexes[0], indexes[len(indexes)-1]
+		d.trim = c
+	}
+	return indexes, nil
+}
+
+// apply trims the first and last segment of the clip to the exact timestamps, others are unchanged
+func (c *clip) apply(segIndex int, data []byte) ([]byte, error) {
+	if segIndex != c.first && segIndex != c.last {
+		return data, nil
+	}
+	first, ok := media.FirstTimestampTS(data)
+	if !ok {
+		return data, errors.New("no timestamp found")
+	}
+	from, to := math.Inf(-1), math.Inf(1)
+	if segIndex == c.first && c.head > 0 {
+		from = first + c.head
+	}
+	if segIndex == c.last && c.tail > 0 {
+		to = first + c.tail
+	}
+	trimmed, err := media.TrimTS(data, from, to)
+	if err != nil {
+		return data, err
+	}
+	return trimmed, nil
+}
+
+// formatOffset formats a playlist offset as hh:mm:ss.mmm
+func formatOffset(d time.Duration) string {
+	d = d.Round(time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, d.Milliseconds()%1000)
+}
@@ -0,0 +1,48 @@
+package downloader
+
+import (
+	"testing"
+	"time"
+
+	"loki/pkg/parser"
+)
+
+func TestClipSegments(t *testing.T) {
+	segs := make([]*parser.Segment, 5)
+	for i := range segs {
+		segs[i] = &parser.Segment{Duration: 4}
+	}
+	tests := []struct {
+		name       string
+		from, to   time.Duration
+		kept       int
+		start, end time.Duration
+		head, tail time.Duration
+	}{
+		{"whole playlist", 0, 0, 5, 0, 20 * time.Second, 0, 0},
+		{"inside segments", 5 * time.Second, 10 * time.Second, 2, 4 * time.Second, 12 * time.Second, time.Second, 2 * time.Second},
+		{"on segment boundaries", 4 * time.Second, 12 * time.Second, 2, 4 * time.Second, 12 * time.Second, 0, 0},
+		{"open end", 17 * time.Second, 0, 1, 16 * time.Second, 20 * time.Second, time.Second, 0},
+		{"past the end", 20 * time.Second, 0, 0, 0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Arrange
+			task := &Task{From: tt.from, To: tt.to}
+
+			// Act
+			kept, start, end, head, tail := task.clipSegments(segs)
+
+			// Assert
+			if len(kept) != tt.kept {
+				t.Fatalf("Expected %d segments, got %d", tt.kept, len(kept))
+			}
+			if start != tt.start || end != tt.end {
+				t.Errorf("Expected range %v-%v, got %v-%v", tt.start, tt.end, start, end)
+			}
+			if head != tt.head || tail != tt.tail {
+				t.Errorf("Expected head %v and tail %v, got %v and %v", tt.head, tt.tail, head, tail)
+			}
+		})
+	}
+}
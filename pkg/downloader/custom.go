@@ -1,8 +1,71 @@
 package downloader
 
+import "time"
+
+const (
+	// DiscontinuityRewrite shifts timestamps after each discontinuity so the output timeline is continuous
+	DiscontinuityRewrite DiscontinuityMode = "rewrite"
+	// DiscontinuitySplit writes one output file per discontinuity range
+	DiscontinuitySplit DiscontinuityMode = "split"
+	// DiscontinuityConcat joins segments byte for byte
+	DiscontinuityConcat DiscontinuityMode = "concat"
+)
+
+const (
+	// FailureFail stops the task when a segment is out of retries
+	FailureFail FailurePolicy = "fail"
+	// FailureSkip leaves the segment out of the output
+	FailureSkip FailurePolicy = "skip"
+	// FailureFill repeats the previous segment in its place so the output keeps its length
+	FailureFill FailurePolicy = "fill"
+)
+
+const (
+	// PartialPrefix merges the segments completed before the first missing one
+	PartialPrefix PartialMode = "prefix"
+	// PartialAll merges every completed segment, the missing ones stay as holes in the timeline
+	PartialAll PartialMode = "all"
+)
+
+// DefaultRetries is the number of fetch attempts per segment when Task.Retries is 0
+const DefaultRetries = 5
+
 const (
 	tsExt            = ".ts"
+	vttExt           = ".vtt"
 	tsFolderName     = "ts"
 	tsTempFileSuffix = "_tmp"
+	initFilePattern  = "init_%d.mp4"
 	progressWidth    = 40
+	progressStep     = 10       // percent between progress lines of a ladder download
+	maxRangeRequest  = 16 << 20 // adjacent byte ranges are merged into requests up to this size
+	adReportSuffix   = ".ads.json"
+	stateFileName    = "state.jsonl"
+
+	mirrorMasterName     = "master.m3u8"
+	mirrorPlaylistName   = "index.m3u8"
+	mirrorSegmentPattern = "segment_%d%s"
+	mirrorKeyPattern     = "key_%d.key"
+	extGap               = "#EXT-X-GAP"
+
+	ladderPlaylistExt = ".m3u8"
+
+	maxReloadFailures     = 5
+	maxHostFailures       = 3   // failed attempts on one playlist before a segment moves to a backup
+	maxDurationDrift      = 0.5 // seconds a backup segment duration may differ from the original
+	defaultReloadInterval = 2 * time.Second
+
+	retryBaseDelay = 500 * time.Millisecond // wait before the second attempt, doubled after each failure
+	retryMaxDelay  = 30 * time.Second
+
+	defaultStreamBuffer = 64 << 20
 )
+
+// packedAudioExts are the extensions of packed audio segments, raw frames behind an ID3 tag rather than MPEG-TS
+var packedAudioExts = map[string]bool{
+	".aac":  true,
+	".mp3":  true,
+	".ac3":  true,
+	".ec3":  true,
+	".eac3": true,
+}
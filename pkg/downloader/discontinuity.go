@@ -0,0 +1,84 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"loki/pkg/media"
+)
+
+// timeline keeps the output timestamps continuous across discontinuities while merging
+type timeline struct {
+	started    bool
+	start      float64 // first timestamp of the output in seconds
+	elapsed    float64 // EXTINF duration merged since start
+	discSeq    uint64  // discontinuity sequence number the offset was computed for
+	offset     float64 // shift in seconds applied to the current range
+	hole       bool    // segments were left out since the last one aligned
+	timescales map[uint32]uint32
+}
+
+// align shifts the timestamps of data in place. At every discontinuity, after removed ad breaks and
+// after segments left out, the offset is computed so the new range starts where the playlist durations
+// say the previous one ended.
+func (t *timeline) align(seg *segment, data []byte) error {
+	defer func() { t.elapsed += float64(seg.Duration) }()
+
+	hole := t.hole
+	t.hole = false
+	if !t.started || seg.DiscontinuitySequence != t.discSeq || seg.cut || hole {
+		first, ok := t.firstTimestamp(seg, data)
+		if !ok {
+			return errors.New("no timestamp found")
+		}
+		if !t.started {
+			t.started, t.start, t.elapsed, t.offset = true, first, 0, 0
+		} else {
+			t.offset = t.start + t.elapsed - first
+		}
+		t.discSeq = seg.DiscontinuitySequence
+	}
+
+	if t.offset == 0 {
+		return nil
+	}
+	if seg.Map != nil {
+		return media.ShiftFragment(data, t.timescales, t.offset)
+	}
+	return media.ShiftTS(data, t.offset)
+}
+
+// firstTimestamp returns the earliest timestamp of a TS segment or fMP4 fragment in seconds
+func (t *timeline) firstTimestamp(seg *segment, data []byte) (float64, bool) {
+	if seg.Map != nil {
+		return media.FirstTimestampFragment(data, t.timescales)
+	}
+	return media.FirstTimestampTS(data)
+}
+
+// discontinuityRanges returns the [from, to) segment indexes of every discontinuity range
+func (d *Downloader) discontinuityRanges() [][2]int {
+	var ranges [][2]int
+	from := 0
+	for idx := 1; idx < d.segLen; idx++ {
+		if d.segments[idx].DiscontinuitySequence != d.segments[idx-1].DiscontinuitySequence {
+			ranges = append(ranges, [2]int{from, idx})
+			from = idx
+		}
+	}
+	if d.segLen > 0 {
+		ranges = append(ranges, [2]int{from, d.segLen})
+	}
+	return ranges
+}
+
+// splitFileName numbers the output file of a discontinuity range, the first range keeps the name
+func splitFileName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), i, ext)
+}
@@ -0,0 +1,83 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// discontinuityPlaylist lists segments 0-1, 5-6 and 9 separated by discontinuities, the timestamps of
+// each range start where segmentHandler puts them instead of following the previous range
+const discontinuityPlaylist = "#EXTM3U\n#EXT-X-TARGETDURATION:4\n" +
+	"#EXTINF:4,\ns0.ts\n#EXTINF:4,\ns1.ts\n#EXT-X-DISCONTINUITY\n" +
+	"#EXTINF:4,\ns5.ts\n#EXTINF:4,\ns6.ts\n#EXT-X-DISCONTINUITY\n" +
+	"#EXTINF:4,\ns9.ts\n#EXT-X-ENDLIST\n"
+
+func TestDiscontinuityModes(t *testing.T) {
+	tests := []struct {
+		mode  DiscontinuityMode
+		files map[string][]float64
+	}{
+		{DiscontinuityRewrite, map[string][]float64{"out.ts": {0, 4, 8, 12, 16}}},
+		{DiscontinuityConcat, map[string][]float64{"out.ts": {0, 4, 20, 24, 36}}},
+		{DiscontinuitySplit, map[string][]float64{"out.ts": {0, 4}, "out_1.ts": {20, 24}, "out_2.ts": {36}}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			// Arrange
+			server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, discontinuityPlaylist)
+			}, segmentHandler)
+			task := testTask(t, server)
+			task.Discontinuity = tt.mode
+
+			// Act
+			err := New().Start(context.Background(), task)
+
+			// Assert
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			for name, want := range tt.files {
+				got := segmentTimes(t, readFile(t, filepath.Join(task.OutputFilePath, name)))
+				if !equalTimes(got, want) {
+					t.Errorf("Expected %s to start segments at %v, got %v", name, want, got)
+				}
+			}
+			entries, err := os.ReadDir(task.OutputFilePath)
+			if err != nil {
+				t.Fatalf("Expected the output folder, got %v", err)
+			}
+			for _, entry := range entries {
+				if _, ok := tt.files[entry.Name()]; !ok && filepath.Ext(entry.Name()) == ".ts" {
+					t.Errorf("Expected only %d output files, got %s", len(tt.files), entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestSplitFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		i    int
+		want string
+	}{
+		{"out.ts", 0, "out.ts"},
+		{"out.ts", 2, "out_2.ts"},
+		{"out.v1.mp4", 1, "out.v1_1.mp4"},
+		{"out", 3, "out_3"},
+	}
+	for _, tt := range tests {
+		// Act
+		got := splitFileName(tt.name, tt.i)
+
+		// Assert
+		if got != tt.want {
+			t.Errorf("Expected %s for range %d of %s, got %s", tt.want, tt.i, tt.name, got)
+		}
+	}
+}
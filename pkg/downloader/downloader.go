@@ -2,23 +2,32 @@ package downloader
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"loki/pkg/media"
 	"loki/pkg/parser"
 	"loki/pkg/tools"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
 // Start starts a new download task
-func (d *Downloader) Start(task *Task) error {
-	parserResult, err := parser.Parse(task.M3U8URL)
+func (d *Downloader) Start(ctx context.Context, task *Task) error {
+	parserResult, err := parser.Parse(ctx, task.M3U8URL, task.parserOptions())
+	if ctx.Err() != nil {
+		return d.canceled(ctx)
+	}
 	if err != nil {
 		return err
 	}
+	printVariant(parserResult)
+	printWarnings(parserResult)
 
 	// Determine if the output is a file or a directory
 	outputFilePath, outputFileName, tsFolder, err := d.setupOutputPaths(task)
@@ -26,142 +35,415 @@ func (d *Downloader) Start(task *Task) error {
 		return err
 	}
 
-	d.outputFilePath = outputFilePath
-	d.outputFileName = outputFileName
+	if task.Mirror {
+		return mirror(ctx, task, parserResult, outputFilePath, outputFileName, tsFolder)
+	}
+	if task.Ladder {
+		return ladder(ctx, task, parserResult, outputFilePath, outputFileName, tsFolder)
+	}
 
-	d.tsFolder = tsFolder
-	d.segLen = len(parserResult.M3U8.Segments)
-	d.result = parserResult
+	// Live renditions have to be recorded at the same time as the variant
+	if isLive(parserResult.M3U8) && len(parserResult.Renditions) > 0 {
+		var wg sync.WaitGroup
+		errs := make([]error, len(parserResult.Renditions)+1)
+		for i, rendition := range parserResult.Renditions {
+			wg.Add(1)
+			go func(i int, rendition *parser.Rendition) {
+				defer wg.Done()
+				errs[i+1] = runRendition(ctx, task, rendition, outputFilePath, outputFileName, tsFolder)
+			}(i, rendition)
+		}
+		errs[0] = d.run(ctx, task, parserResult, outputFilePath, outputFileName, tsFolder)
+		wg.Wait()
+		return errors.Join(errs...)
+	}
 
-	if err := d.downloadSegments(task); err != nil {
+	if err := d.run(ctx, task, parserResult, outputFilePath, outputFileName, tsFolder); err != nil {
 		return err
 	}
 
-	// divider for downloading and merging
-	fmt.Print("\n")
+	for _, rendition := range parserResult.Renditions {
+		if err := runRendition(ctx, task, rendition, outputFilePath, outputFileName, tsFolder); err != nil {
+			return err
+		}
+	}
 
-	return d.merge()
+	return nil
 }
 
-func (d *Downloader) downloadSegments(task *Task) error {
-	var wg sync.WaitGroup
-	limitChan := make(chan struct{}, task.Concurrency) // Adjust the buffer size as needed
+// parserOptions returns the options every playlist of the task is parsed with
+func (t *Task) parserOptions() *parser.Options {
+	if t.opts == nil {
+		provider := t.KeyProvider
+		if provider == nil {
+			provider = parser.NewKeyProvider(nil)
+		} else {
+			provider = parser.NewCachedKeyProvider(provider)
+		}
+		t.opts = &parser.Options{
+			Variant:     t.Variant,
+			Languages:   t.Languages,
+			KeyProvider: provider,
+			IV:          t.IV,
+			Lenient:     t.Lenient,
+		}
+	}
+	return t.opts
+}
 
-	d.queue = tools.StartQueue(d.segLen)
+// runRendition downloads an EXT-X-MEDIA rendition next to the main output
+func runRendition(ctx context.Context, task *Task, rendition *parser.Rendition, outputFilePath, outputFileName, tsFolder string) error {
+	name := renditionFileName(outputFileName, rendition)
+	folder := tsFolder + "_" + strings.TrimSuffix(name, filepath.Ext(name))
 
-	for {
-		tsIdx, end, err := d.next()
-		if err != nil {
-			if end {
-				break
+	fmt.Printf("[rendition] %s %q\n", rendition.Media.Type, rendition.Media.Name)
+	sub := New()
+	sub.media = rendition.Media
+	if err := sub.run(ctx, task, rendition.Result, outputFilePath, name, folder); err != nil {
+		return fmt.Errorf("%s rendition %q: %w", rendition.Media.Type, rendition.Media.Name, err)
+	}
+	return nil
+}
+
+// run downloads and merges the segments of a single media playlist
+func (d *Downloader) run(ctx context.Context, task *Task, result *parser.Result, outputFilePath, outputFileName, tsFolder string) error {
+	d.outputFilePath = outputFilePath
+	d.outputFileName = outputFileName
+
+	d.tsFolder = tsFolder
+	d.result = result
+	d.discontinuity = task.Discontinuity
+
+	if err := task.checkProgramDateTime(result.M3U8); err != nil {
+		return err
+	}
+
+	if isLive(result.M3U8) && task.hasClip() {
+		return errors.New("time offsets only apply to VOD playlists, use start and end times for live streams")
+	}
+
+	if task.Stream && task.Discontinuity == DiscontinuitySplit {
+		return errors.New("streaming writes a single file, it cannot split at discontinuities")
+	}
+
+	if isLive(result.M3U8) {
+		if err := prepareFolder(tsFolder); err != nil {
+			return err
+		}
+		if task.Stream {
+			if err := d.openStream(task); err != nil {
+				return err
 			}
-			// log.Printf("Error fetching next segment: %s", err)
-			continue
 		}
+	}
 
-		wg.Add(1)
-		go func(idx int) {
-			defer wg.Done()
-			if err := d.process(idx); err != nil {
-				log.Printf("[failed] %s", err)
-				if err := d.back(idx); err != nil {
-					log.Printf("Error sending segment back to queue: %s", err)
-				}
-			}
-			<-limitChan
-		}(tsIdx)
-		limitChan <- struct{}{}
+	var err error
+	switch {
+	case isLive(result.M3U8) && task.LowLatency:
+		err = d.recordLowLatency(ctx, task)
+	case isLive(result.M3U8):
+		err = d.record(ctx, task)
+	default:
+		err = d.downloadVOD(ctx, task, result)
+	}
+	if d.stream != nil {
+		return d.endStream(task, err)
+	}
+	var canceled *CanceledError
+	if errors.As(err, &canceled) && task.Partial != "" {
+		return d.mergePartial(task.Partial, canceled)
+	}
+	if err != nil {
+		return err
 	}
 
-	wg.Wait()
+	// divider for downloading and merging
+	fmt.Print("\n")
 
+	if err := d.merge(); err != nil {
+		return err
+	}
+	if task.SkipAds {
+		return d.writeAdReport()
+	}
 	return nil
 }
 
-func (d *Downloader) process(segIndex int) error {
-	tsFilename := tools.ResolveTSFilename(segIndex)
-	tsURL := d.resolveTSURL(segIndex)
-
-	body, err := tools.Get(tsURL)
+// downloadVOD downloads the selected segments of a VOD playlist
+func (d *Downloader) downloadVOD(ctx context.Context, task *Task, result *parser.Result) error {
+	indexes, err := d.selectSegments(task, result)
 	if err != nil {
-		return fmt.Errorf("request %d failed: %w", segIndex, err)
+		return err
+	}
+	if task.Stream {
+		// Nothing is kept to resume from, the output is written while the segments arrive
+		if err := prepareFolder(d.tsFolder); err != nil {
+			return err
+		}
+		if err := d.openStream(task); err != nil {
+			return err
+		}
+		return d.downloadSegments(ctx, task, indexes)
+	}
+	// Segments a previous run of the task completed are not downloaded again
+	if err := d.resume(task); err != nil {
+		return err
 	}
-	defer body.Close()
+	defer d.state.close()
+	return d.downloadSegments(ctx, task, indexes)
+}
 
-	fPath := filepath.Join(d.tsFolder, tsFilename)
-	if _, err := os.Stat(fPath); err == nil {
-		// If the file exists, skip processing
-		// log.Printf("File already exists, skipping download: %s", fPath)
-		return nil
+// appendSegments adds segments listed in result to the download list and returns their indexes
+func (d *Downloader) appendSegments(result *parser.Result, segs []*parser.Segment) []int {
+	indexes := make([]int, 0, len(segs))
+	for _, seg := range segs {
+		indexes = append(indexes, len(d.segments))
+		d.segments = append(d.segments, &segment{Segment: seg, result: result, cut: d.cuts[seg]})
 	}
+	d.segLen = len(d.segments)
+	return indexes
+}
 
-	fTemp := fPath + tsTempFileSuffix
-	f, err := os.Create(fTemp)
-	if err != nil {
-		return fmt.Errorf("create file %s: %w", tsFilename, err)
+// downloadSegments fetches the segments at indexes with a pool of Task.Concurrency workers. The loop
+// below owns the queue, the segment list and every decision taken on a result. Workers get a copy of
+// the segments of each job and only fetch and store them, so the loop can move segments to a backup
+// playlist while they run. On cancellation the segments being fetched are still written.
+func (d *Downloader) downloadSegments(ctx context.Context, task *Task, indexes []int) error {
+	d.opts = task.parserOptions()
+	d.onFailure = task.OnFailure
+	if d.backups == nil {
+		d.backups = slices.Clone(d.result.Backups)
+	}
+	if err := d.fetchInitSections(ctx, indexes); err != nil {
+		return err
 	}
-	defer f.Close()
 
-	bytes, err := io.ReadAll(body)
-	if err != nil {
-		return fmt.Errorf("read bytes from %s: %w", tsURL, err)
+	queue := d.groupRanges(d.state.pending(indexes))
+	if len(queue) == 0 {
+		return nil
 	}
 
-	// Additional processing (e.g., decryption, trimming) can be refactored into separate functions.
-	bytes, err = d.decrytpData(bytes, segIndex)
-	if err != nil {
-		return err
+	workers := min(max(task.Concurrency, 1), len(queue))
+	jobs := make(chan fetchJob)
+	results := make(chan fetchResult, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.work(ctx, d.limit, jobs, results)
+		}()
 	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+
+	// Segments waiting for their backoff come back through due and live backups parsed again through
+	// reloads, stop ends the waits still running
+	due := make(chan []int)
+	reloads := make(chan *backupReload)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	var (
+		next     *fetchJob
+		inFlight int
+		waiting  int
+	)
+	schedule := func(requeue []int, wait time.Duration, reload *backupReload) {
+		switch {
+		case reload != nil:
+			waiting++
+			go func(opts *parser.Options) {
+				reload.reload(ctx, opts)
+				select {
+				case reloads <- reload:
+				case <-stop:
+				}
+			}(d.opts)
+		case wait > 0:
+			waiting++
+			time.AfterFunc(wait, func() {
+				select {
+				case due <- requeue:
+				case <-stop:
+				}
+			})
+		default:
+			queue = append(queue, requeue...)
+		}
+	}
+	for {
+		stopping := ctx.Err() != nil || d.fatal != nil
+		if next == nil && len(queue) > 0 && !stopping {
+			idx := queue[0]
+			queue = append(queue[1:], d.prefer(idx)...)
+			next = d.job(idx)
+		}
+		if inFlight == 0 && (stopping || next == nil && waiting == 0) {
+			break
+		}
 
-	if _, err := f.Write(bytes); err != nil {
-		return fmt.Errorf("write to %s: %w", fTemp, err)
+		var (
+			send chan<- fetchJob
+			job  fetchJob
+			done <-chan struct{}
+		)
+		if next != nil && !stopping {
+			send, job = jobs, *next
+		}
+		if !stopping {
+			done = ctx.Done()
+		}
+
+		select {
+		case send <- job:
+			next = nil
+			inFlight++
+		case r := <-results:
+			inFlight--
+			schedule(d.settle(ctx, task, r))
+		case b := <-reloads:
+			waiting--
+			schedule(d.reloaded(task, b))
+		case idx := <-due:
+			waiting--
+			queue = append(queue, idx...)
+		case <-done:
+		}
 	}
-	defer f.Close()
 
-	if err = os.Rename(fTemp, fPath); err != nil {
-		return fmt.Errorf("rename file %s to %s: %w", fTemp, fPath, err)
+	if ctx.Err() != nil {
+		return d.canceled(ctx)
 	}
+	return d.fatal
+}
 
-	// +1 flag until finish
-	atomic.AddInt32(&d.finish, 1)
+// work fetches and stores the jobs it receives until jobs is closed. With limit set every fetch
+// also holds a slot of it, shared with the other playlists of a ladder download.
+func (d *Downloader) work(ctx context.Context, limit chan struct{}, jobs <-chan fetchJob, results chan<- fetchResult) {
+	for job := range jobs {
+		datas, err := d.process(ctx, limit, job)
+		results <- fetchResult{fetchJob: job, datas: datas, err: err}
+	}
+}
 
-	// fmt.Printf("[loading %6.2f%%] %d %s\n", float32(d.finish)/float32(d.segLen)*100, segIndex, tsFilename)
+// settle counts the segments of a finished job, or decides what happens to a failed one. The indexes
+// returned go back on the queue, after wait when it is not zero or once reload is done.
+func (d *Downloader) settle(ctx context.Context, task *Task, r fetchResult) (requeue []int, wait time.Duration, reload *backupReload) {
+	if r.err == nil {
+		d.finish += len(r.group)
+		d.drawProgress("downloading", float32(d.finish)/float32(d.segLen))
+		for i, data := range r.datas {
+			if err := d.streamSegment(r.group[i], data); err != nil && d.fatal == nil {
+				d.fatal = err
+			}
+		}
+		return nil, 0, nil
+	}
+	// Requests aborted by the cancellation are not failures of the segment, it stays pending
+	if ctx.Err() != nil {
+		return nil, 0, nil
+	}
+	log.Printf("[failed] %s", r.err)
+	requeue, wait, reload = d.retry(task, r.index, r.err)
+	if d.stream != nil {
+		// A segment given up may be the one the output waits for
+		d.flushStream()
+	}
+	return requeue, wait, reload
+}
 
-	// Drawing progress bar
-	tools.DrawProgressBar("downloading", float32(d.finish)/float32(d.segLen), progressWidth, "complete")
+// job returns the job fetching segIndex and the byte ranges fetched with it, with copies of their
+// segments as they are now
+func (d *Downloader) job(segIndex int) *fetchJob {
+	group := d.group(segIndex)
+	segs := make([]segment, len(group))
+	for i, idx := range group {
+		segs[i] = *d.segments[idx]
+	}
+	return &fetchJob{index: segIndex, group: group, segs: segs, stream: d.stream != nil}
+}
 
-	return nil
+// group returns the segment indexes fetched together with segIndex, segIndex first
+func (d *Downloader) group(segIndex int) []int {
+	if group := d.groups[segIndex]; group != nil {
+		return group
+	}
+	return []int{segIndex}
 }
 
-func (d *Downloader) next() (segIndex int, end bool, err error) {
-	d.lock.Lock()
-	defer d.lock.Unlock()
+// process fetches a job and stores its segments. A streaming download gets their decoded data
+// back instead.
+func (d *Downloader) process(ctx context.Context, limit chan struct{}, job fetchJob) ([][]byte, error) {
+	if limit != nil {
+		select {
+		case limit <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-limit }()
+	}
+
+	datas, err := fetchGroup(ctx, job.segs)
+	if err != nil {
+		return nil, fmt.Errorf("request %d failed: %w", job.index, err)
+	}
 
-	if len(d.queue) == 0 {
-		err = fmt.Errorf("queue empty")
-		if d.finish == int32(d.segLen) {
-			end = true
-			return
+	for i, idx := range job.group {
+		if job.stream {
+			if datas[i], err = d.decode(&job.segs[i], datas[i]); err != nil {
+				return nil, err
+			}
+		} else if err := d.save(idx, &job.segs[i], datas[i]); err != nil {
+			return nil, err
 		}
-		// Some segment indexes are still running.
-		end = false
-		return
 	}
+	if !job.stream {
+		return nil, nil
+	}
+	return datas, nil
+}
 
-	segIndex = d.queue[0]
-	d.queue = d.queue[1:]
-	return
+// decode decrypts the data of a segment unless it is stored as downloaded
+func (d *Downloader) decode(seg *segment, bytes []byte) ([]byte, error) {
+	if d.keepEncrypted {
+		return bytes, nil
+	}
+	return d.decrytpData(bytes, seg)
 }
 
-func (d *Downloader) back(segIndex int) error {
-	d.lock.Lock()
-	defer d.lock.Unlock()
+// save decrypts the data of seg and stores it in the TS folder under segIndex
+func (d *Downloader) save(segIndex int, seg *segment, bytes []byte) error {
+	tsFilename := tools.ResolveTSFilename(segIndex)
 
-	if segIndex < 0 || segIndex >= d.segLen {
-		return fmt.Errorf("invalid segment index: %d", segIndex)
+	fPath := filepath.Join(d.tsFolder, tsFilename)
+	if _, err := os.Stat(fPath); err == nil {
+		// If the file exists, skip processing
+		// log.Printf("File already exists, skipping download: %s", fPath)
+		return nil
+	}
+
+	bytes, err := d.decode(seg, bytes)
+	if err != nil {
+		return err
+	}
+
+	// Written aside and renamed so an interrupted write never leaves a truncated segment behind
+	fTemp := fPath + tsTempFileSuffix
+	if err := os.WriteFile(fTemp, bytes, 0o644); err != nil {
+		os.Remove(fTemp)
+		return fmt.Errorf("write to %s: %w", fTemp, err)
+	}
+	if err = os.Rename(fTemp, fPath); err != nil {
+		os.Remove(fTemp)
+		return fmt.Errorf("rename file %s to %s: %w", fTemp, fPath, err)
+	}
+	if err := d.state.record(segIndex, seg.Sequence, bytes); err != nil {
+		log.Printf("[warning] %s", err)
 	}
 
-	d.queue = append(d.queue, segIndex)
 	return nil
 }
 
@@ -170,87 +452,241 @@ func (d *Downloader) merge() error {
 	for idx := 0; idx < d.segLen; idx++ {
 		tsFilename := tools.ResolveTSFilename(idx)
 		fPath := filepath.Join(d.tsFolder, tsFilename)
-		if _, err := os.Stat(fPath); os.IsNotExist(err) {
+		if _, err := os.Stat(fPath); os.IsNotExist(err) && !d.failed[idx] {
 			missingCount++
 		}
 	}
 
-	if missingCount > 0 {
+	if missingCount > 0 && !d.partial {
 		log.Printf("[warning] %d files missing", missingCount)
 	}
 
-	// Create a file to merge all segments into
-	mFilePath := filepath.Join(d.outputFilePath, d.outputFileName)
-	mFile, err := os.Create(mFilePath)
-	if err != nil || mFile == nil {
-		return fmt.Errorf("create main TS file failed: %w", err)
-	}
-	defer mFile.Close()
-
-	writer := bufio.NewWriter(mFile)
-	defer writer.Flush()
-
 	mergedCount := 0
-	for segIndex := 0; segIndex < d.segLen; segIndex++ {
-		tsFilename := tools.ResolveTSFilename(segIndex)
-		segmentPath := filepath.Join(d.tsFolder, tsFilename)
-		bytes, err := os.ReadFile(segmentPath)
+	var outputs []string
+	if ranges := d.discontinuityRanges(); d.discontinuity == DiscontinuitySplit && len(ranges) > 1 {
+		// One output file per discontinuity range
+		for i, r := range ranges {
+			mFilePath := filepath.Join(d.outputFilePath, splitFileName(d.outputFileName, i))
+			merged, err := d.mergeRange(mFilePath, r[0], r[1], mergedCount, d.partial)
+			if err != nil {
+				return err
+			}
+			mergedCount += merged
+			outputs = append(outputs, mFilePath)
+		}
+	} else {
+		mFilePath := filepath.Join(d.outputFilePath, d.outputFileName)
+		rewrite := d.discontinuity != DiscontinuityConcat && (len(ranges) > 1 || len(d.cuts) > 0 || d.partial)
+		merged, err := d.mergeRange(mFilePath, 0, d.segLen, 0, rewrite)
 		if err != nil {
-			log.Printf("Failed to read file %s: %s", tsFilename, err)
-			continue
+			return err
 		}
+		mergedCount = merged
+		outputs = append(outputs, mFilePath)
+	}
 
-		if _, err = writer.Write(bytes); err != nil {
-			log.Printf("Failed to write to main TS file: %s", err)
-			continue
+	// Remove temporary TS folder, a partial VOD download keeps it to resume from
+	if !d.partial || d.state == nil {
+		if err := os.RemoveAll(d.tsFolder); err != nil {
+			fmt.Printf("[warning] Failed to remove temporary folder %s: %s\n", d.tsFolder, err.Error())
 		}
-		mergedCount++
-		tools.DrawProgressBar("merging", float32(mergedCount)/float32(d.segLen), progressWidth, "complete")
 	}
 
-	// Remove temporary TS folder
-	if err = os.RemoveAll(d.tsFolder); err != nil {
-		fmt.Printf("[warning] Failed to remove temporary folder %s: %s\n", d.tsFolder, err.Error())
+	if failed := d.segLen - mergedCount - len(d.failed); failed > 0 && !d.partial {
+		fmt.Printf("[warning] %d files merge failed\n", failed)
 	}
 
-	if mergedCount != d.segLen {
-		fmt.Printf("[warning] %d files merge failed\n", d.segLen-mergedCount)
+	d.outputs = outputs
+	fmt.Print("\n")
+	for _, o := range outputs {
+		fmt.Printf("[output] %s\n", o)
 	}
 
-	fmt.Printf("\n[output] %s\n", mFilePath)
-
 	return nil
 }
 
-func (d *Downloader) decrytpData(data []byte, segIndex int) ([]byte, error) {
-	// Decrypt the data if necessary
-	sf := d.result.M3U8.Segments[segIndex]
-	if sf == nil {
-		return nil, fmt.Errorf("invalid segment index: %d", segIndex)
-	}
-	key, ok := d.result.Keys[sf.KeyIndex]
-	if ok && key != "" {
-		var err error
-		data, err = tools.AES128Decrypt(data, []byte(key), []byte(d.result.M3U8.Keys[sf.KeyIndex].IV))
+// mergeRange writes the segments [from, to) into one file and returns how many were merged.
+// done is the number of segments merged before, for the progress bar. With rewrite the timestamps
+// after each discontinuity are shifted so the timeline stays continuous.
+func (d *Downloader) mergeRange(mFilePath string, from, to, done int, rewrite bool) (int, error) {
+	m, err := newMergeWriter(mFilePath, rewrite)
+	if err != nil {
+		return 0, err
+	}
+	for segIndex := from; segIndex < to; segIndex++ {
+		bytes, err := os.ReadFile(filepath.Join(d.tsFolder, tools.ResolveTSFilename(segIndex)))
+		if d.appendSegment(m, segIndex, bytes, err) {
+			d.drawProgress("merging", float32(done+m.merged)/float32(d.segLen))
+		}
+	}
+	return m.merged, m.close()
+}
+
+// newMergeWriter creates the output file at path
+func newMergeWriter(path string, rewrite bool) (*mergeWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create main TS file failed: %w", err)
+	}
+	return &mergeWriter{file: f, writer: bufio.NewWriter(f), rewrite: rewrite}, nil
+}
+
+// close flushes and closes the output file
+func (m *mergeWriter) close() error {
+	if err := m.writer.Flush(); err != nil {
+		m.file.Close()
+		return fmt.Errorf("write %s: %w", m.file.Name(), err)
+	}
+	return m.file.Close()
+}
+
+// appendSegment writes a segment to m, with its initialization section in front when it changes.
+// bytes and err are what reading the stored segment returned. It reports whether the segment was written.
+func (d *Downloader) appendSegment(m *mergeWriter, segIndex int, bytes []byte, err error) bool {
+	// Put the initialization section in front of the first fragment that uses it
+	seg := d.segments[segIndex]
+	if seg.Map != nil && seg.mapKey() != m.lastInit {
+		init, err := os.ReadFile(d.initFiles[seg.mapKey()])
 		if err != nil {
-			return nil, fmt.Errorf("decrypt: %s, %s", d.resolveTSURL(segIndex), err.Error())
+			log.Printf("Failed to read init section %s: %s", seg.Map.URI, err)
+		} else if _, err = m.writer.Write(init); err != nil {
+			log.Printf("Failed to write init section to main file: %s", err)
 		}
+		if (m.rewrite || d.onFailure == FailureFill) && err == nil {
+			if m.tl.timescales, err = media.Timescales(init); err != nil {
+				log.Printf("Failed to read timescales of init section %s: %s", seg.Map.URI, err)
+			}
+		}
+		m.lastInit = seg.mapKey()
 	}
 
-	// Check for and handle MPEG-TS Sync Byte
-	syncByte := uint8(0x47) // MPEG-TS Sync Byte is 0x47
-	for i, b := range data {
-		if b == syncByte {
-			return data[i:], nil // Return the data starting from the Sync Byte
+	tsFilename := tools.ResolveTSFilename(segIndex)
+	filled := false
+	if err != nil && d.failed[segIndex] && d.onFailure == FailureFill && m.last != nil && !d.isSubtitles() {
+		bytes, err = fill(m.last, m.lastDuration, seg.Map != nil, m.tl.timescales)
+		filled = err == nil
+	}
+	if err != nil && (d.failed[segIndex] || d.partial && os.IsNotExist(err)) {
+		// Keep the hole in the timeline, the segment after it is realigned like one after a cut
+		m.tl.elapsed += float64(seg.Duration)
+		m.tl.hole = true
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to read file %s: %s", tsFilename, err)
+		return false
+	}
+
+	// WebVTT segments each carry a header, only the first one is kept
+	if d.isSubtitles() && m.merged > 0 {
+		bytes = tools.StripWebVTTHeader(bytes)
+	}
+
+	if d.trim != nil && seg.Map == nil && !d.isSubtitles() && !filled {
+		if bytes, err = d.trim.apply(segIndex, bytes); err != nil {
+			log.Printf("Failed to trim %s: %s", tsFilename, err)
 		}
 	}
 
-	return data, nil // Return the original data if no Sync Byte is found
+	if d.onFailure == FailureFill {
+		// Timestamps as stored, the filler is shifted from them before it is aligned
+		m.last, m.lastDuration = slices.Clone(bytes), seg.Duration
+	}
+
+	if m.rewrite && !d.isSubtitles() {
+		if err := m.tl.align(seg, bytes); err != nil {
+			log.Printf("Failed to rewrite timestamps of %s: %s", tsFilename, err)
+		}
+	}
+
+	if _, err = m.writer.Write(bytes); err != nil {
+		log.Printf("Failed to write to main TS file: %s", err)
+		return false
+	}
+	m.merged++
+	return true
+}
+
+func (d *Downloader) decrytpData(data []byte, sf *segment) ([]byte, error) {
+	// Decrypt the data if necessary
+	data, err := decryptAES128(data, sf.result, sf.KeyIndex, sf.Sequence)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s, %s", errDecrypt, sf.url(), err.Error())
+	}
+
+	// Subtitle segments are text, fMP4 fragments and packed audio have no sync byte, only MPEG-TS is trimmed
+	if !d.isSubtitles() && sf.Map == nil && !packedAudioExts[tools.URLExt(sf.URI)] {
+		// Check for and handle MPEG-TS Sync Byte
+		data = tools.TrimToSyncByte(data)
+	}
+
+	key, ok := sf.result.Keys[sf.KeyIndex]
+	if !ok || key.Method != parser.CryptMethodSampleAES {
+		return data, nil
+	}
+	if sf.Map != nil {
+		err = media.DecryptFragment(data, d.protected[sf.mapKey()], key.Key, key.IVFor(sf.Sequence))
+	} else {
+		data, err = media.DecryptSampleAESTS(data, key.Key, key.IVFor(sf.Sequence))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w SAMPLE-AES: %s, %s", errDecrypt, sf.url(), err.Error())
+	}
+	return data, nil
+}
+
+// decryptAES128 decrypts data with the key at keyIndex of result, data is returned as is when there is no key.
+// sequence is the media sequence number the IV derives from when the EXT-X-KEY has no IV attribute.
+func decryptAES128(data []byte, result *parser.Result, keyIndex int, sequence uint64) ([]byte, error) {
+	key, ok := result.Keys[keyIndex]
+	if !ok || key.Method != parser.CryptMethodAES {
+		return data, nil
+	}
+	return tools.AES128Decrypt(data, key.Key, key.IVFor(sequence))
+}
+
+// printVariant shows which variant was followed and why the others were not
+func printVariant(result *parser.Result) {
+	if result.Variant == nil {
+		return
+	}
+	fmt.Printf("[variant] %s\n", result.Variant)
+	for _, r := range result.Rejected {
+		fmt.Printf("[rejected] %s: %s\n", r.Variant, r.Reason)
+	}
+	if len(result.Pathways) > 0 {
+		fmt.Printf("[steering] pathways %s\n", strings.Join(result.Pathways, ", "))
+	}
+	for _, b := range result.Backups {
+		fmt.Printf("[backup] %s\n", b.URL)
+	}
+}
+
+// printWarnings lists the playlist lines skipped by lenient parsing
+func printWarnings(result *parser.Result) {
+	playlists := []*parser.Result{result}
+	for _, r := range result.Renditions {
+		playlists = append(playlists, r.Result)
+	}
+	if result.Master != nil {
+		for _, w := range result.Master.Warnings {
+			log.Printf("[warning] master playlist %s", w)
+		}
+	}
+	for _, r := range playlists {
+		for _, w := range r.M3U8.Warnings {
+			log.Printf("[warning] %s %s", r.URL, w)
+		}
+	}
 }
 
 func (d *Downloader) resolveTSURL(segIndex int) string {
-	seg := d.result.M3U8.Segments[segIndex]
-	return tools.ResolveURL(d.result.URL, seg.URI)
+	return d.segments[segIndex].url()
+}
+
+// url returns the absolute URL of the segment
+func (s *segment) url() string {
+	return tools.ResolveURL(s.result.URL, s.URI)
 }
 
 func (d *Downloader) setupOutputPaths(task *Task) (outputFilePath, outputFileName, tsFolder string, err error) {
@@ -277,15 +713,71 @@ func (d *Downloader) setupOutputPaths(task *Task) (outputFilePath, outputFileNam
 
 	tsFolder = filepath.Join(outputFilePath, tsFolderName)
 
+	// Left in place so an interrupted download can resume, see Downloader.resume
+	if err := os.MkdirAll(tsFolder, os.ModePerm); err != nil {
+		return "", "", "", fmt.Errorf("create storage folder failed: %s", err.Error())
+	}
+
+	return outputFilePath, outputFileName, tsFolder, nil
+}
+
+// prepareFolder recreates an empty folder for segment files
+func prepareFolder(folder string) error {
 	// Remove temporary TS folder if existed
-	if err = os.RemoveAll(tsFolder); err != nil {
-		fmt.Printf("[warning] Failed to remove temporary folder %s: %s\n", tsFolder, err.Error())
+	if err := os.RemoveAll(folder); err != nil {
+		fmt.Printf("[warning] Failed to remove temporary folder %s: %s\n", folder, err.Error())
 	}
 
 	// Create output TS folder
-	if err := os.MkdirAll(tsFolder, os.ModePerm); err != nil {
-		return "", "", "", fmt.Errorf("create storage folder failed: %s", err.Error())
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		return fmt.Errorf("create storage folder failed: %s", err.Error())
 	}
 
-	return outputFilePath, outputFileName, tsFolder, nil
+	return nil
+}
+
+// isSubtitles reports whether the downloader is fetching a subtitle rendition
+func (d *Downloader) isSubtitles() bool {
+	return d.media != nil && d.media.Type == parser.MediaTypeSubtitles
+}
+
+// renditionFileName derives the output name of a rendition from the main output name,
+// e.g. movie.mp4 becomes movie.audio.en.ts
+func renditionFileName(outputFileName string, rendition *parser.Rendition) string {
+	base := strings.TrimSuffix(outputFileName, filepath.Ext(outputFileName))
+	label := rendition.Media.Language
+	if label == "" {
+		label = rendition.Media.Name
+	}
+	label = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ' ' {
+			return '_'
+		}
+		return r
+	}, label)
+
+	ext := renditionExt(rendition.Media, rendition.Result)
+	return fmt.Sprintf("%s.%s.%s%s", base, strings.ToLower(string(rendition.Media.Type)), label, ext)
+}
+
+// renditionExt picks the output extension of a rendition from its segment URIs
+func renditionExt(m *parser.Media, result *parser.Result) string {
+	if m.Type == parser.MediaTypeSubtitles {
+		return vttExt
+	}
+	if segs := result.M3U8.Segments; len(segs) > 0 {
+		if e := tools.URLExt(segs[0].URI); e != "" {
+			return e
+		}
+	}
+	return tsExt
+}
+
+// drawProgress draws the progress bar, or a progress line when several playlists download at once
+func (d *Downloader) drawProgress(stage string, fraction float32) {
+	if d.progress != nil {
+		d.progress.draw(stage, fraction)
+		return
+	}
+	tools.DrawProgressBar(stage, fraction, progressWidth, "complete")
 }
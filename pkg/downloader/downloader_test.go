@@ -0,0 +1,182 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"loki/pkg/media"
+	"loki/pkg/parser"
+)
+
+// tsSegment returns a one packet MPEG-TS segment whose PES starts at pts seconds
+func tsSegment(pts float64) []byte {
+	ticks := uint64(pts * 90000)
+	packet := []byte{0x47, 0x41, 0x00, 0x10, 0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5,
+		0x21 | byte(ticks>>29)&0x0e, byte(ticks >> 22), byte(ticks>>14) | 1, byte(ticks >> 7), byte(ticks<<1) | 1}
+	for len(packet) < 188 {
+		packet = append(packet, 0xff)
+	}
+	return packet
+}
+
+// segmentTimes returns the first timestamp of every packet of an output made of tsSegment data
+func segmentTimes(t *testing.T, out []byte) []float64 {
+	t.Helper()
+	var times []float64
+	for i := 0; i+188 <= len(out); i += 188 {
+		ts, ok := media.FirstTimestampTS(out[i : i+188])
+		if !ok {
+			t.Fatalf("Expected a timestamp in packet %d", i/188)
+		}
+		times = append(times, ts)
+	}
+	return times
+}
+
+// mediaPlaylist returns a playlist of 4 second segments s<first>.ts to s<last>.ts
+func mediaPlaylist(first, last int, endList bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-TARGETDURATION:0.05\n#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	for seq := first; seq <= last; seq++ {
+		fmt.Fprintf(&b, "#EXTINF:4,\ns%d.ts\n", seq)
+	}
+	if endList {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String()
+}
+
+// segmentHandler serves s<n>.ts as a segment starting at n*4 seconds
+func segmentHandler(w http.ResponseWriter, r *http.Request) {
+	var seq int
+	if _, err := fmt.Sscanf(filepath.Base(r.URL.Path), "s%d.ts", &seq); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(tsSegment(float64(seq) * 4))
+}
+
+// newTestServer serves the playlist returned by playlist at /v.m3u8 and segments everywhere else
+func newTestServer(t *testing.T, playlist http.HandlerFunc, segments http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v.m3u8", playlist)
+	mux.HandleFunc("/", segments)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testTask returns a task downloading /v.m3u8 of server into a temporary folder
+func testTask(t *testing.T, server *httptest.Server) *Task {
+	t.Helper()
+	return &Task{
+		M3U8URL:        server.URL + "/v.m3u8",
+		OutputFilePath: t.TempDir(),
+		OutputFileName: "out.ts",
+		Concurrency:    4,
+	}
+}
+
+// readOutput returns the merged output of task
+func readOutput(t *testing.T, task *Task) []byte {
+	t.Helper()
+	return readFile(t, filepath.Join(task.OutputFilePath, task.OutputFileName))
+}
+
+// readFile returns the content of a file the test expects to exist
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected %s, got %v", path, err)
+	}
+	return data
+}
+
+// equalTimes reports whether two lists of timestamps match to the millisecond
+func equalTimes(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if d := a[i] - b[i]; d > 0.001 || d < -0.001 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTestPlaylist parses playlist text the way Start does, served from a test server
+func parseTestPlaylist(t *testing.T, playlist string) *parser.M3U8 {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, playlist)
+	}))
+	defer server.Close()
+	result, err := parser.Parse(context.Background(), server.URL+"/v.m3u8", &parser.Options{})
+	if err != nil {
+		t.Fatalf("Expected the playlist to parse, got %v", err)
+	}
+	return result.M3U8
+}
+
+// TestDownloadSegmentsConcurrently is meant for go test -race: workers fetch while the loop retries
+// one segment and moves another to the backup playlist
+func TestDownloadSegmentsConcurrently(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream %v", stream), func(t *testing.T) {
+			// Arrange
+			var (
+				lock   sync.Mutex
+				failed bool
+			)
+			server, requests := failoverServer(t, func(string) string {
+				return mediaPlaylist(0, 11, true)
+			}, func(path string) int {
+				lock.Lock()
+				defer lock.Unlock()
+				switch {
+				case path == "/a/s3.ts" && !failed:
+					failed = true
+					return http.StatusServiceUnavailable
+				case path == "/a/s5.ts":
+					return http.StatusNotFound
+				}
+				return 0
+			})
+			task := testTask(t, server)
+			task.M3U8URL = server.URL + "/master.m3u8"
+			task.Stream = stream
+
+			// Act
+			err := New().Start(context.Background(), task)
+
+			// Assert
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			want := make([]float64, 12)
+			for i := range want {
+				want[i] = float64(i * 4)
+			}
+			if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, want) {
+				t.Errorf("Expected segments 0-11 in order, got %v", got)
+			}
+			// The retry may go to the backup once segment 5 moved there
+			if n := requests("/a/s3.ts") + requests("/b/s3.ts"); n != 2 {
+				t.Errorf("Expected segment 3 to be fetched twice, got %d", n)
+			}
+			if requests("/b/s5.ts") != 1 {
+				t.Errorf("Expected segment 5 from the backup, got %d requests", requests("/b/s5.ts"))
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"loki/pkg/parser"
+	"loki/pkg/tools"
+)
+
+// failover moves a segment that keeps failing to the next backup playlist listing it, the segments
+// fetched after it follow. A 403 or 404 moves it right away, other errors after maxHostFailures attempts.
+// It returns the indexes that moved, to fetch again, or a live backup to reload before deciding.
+func (d *Downloader) failover(segIndex int, err error) ([]int, *backupReload) {
+	if len(d.backups) == 0 {
+		return nil, nil
+	}
+	if d.attempts[segIndex] < maxHostFailures && !isMissing(err) {
+		return nil, nil
+	}
+	return d.moveSource(segIndex, d.segments[segIndex].source+1, 0, err)
+}
+
+// moveSource moves a segment to the first backup playlist from the first-th on that lists it. A live
+// backup is only parsed when the playlist is reloaded and may be behind, unless it is the reloaded-th
+// one it is returned to reload first. err is the failure the segment moves for.
+func (d *Downloader) moveSource(segIndex, first, reloaded int, err error) ([]int, *backupReload) {
+	for to := first; to <= len(d.backups); to++ {
+		if moved := d.switchSource(segIndex, to); moved != nil {
+			log.Printf("[failover] segment %d moved to %s", d.segments[segIndex].Sequence, d.backups[to-1].URL)
+			d.preferred = max(d.preferred, to)
+			return moved, nil
+		}
+		if to != reloaded && isLive(d.backups[to-1].M3U8) && d.opts != nil {
+			return nil, &backupReload{n: to, url: d.backups[to-1].URL.String(), index: segIndex, cause: err}
+		}
+	}
+	return nil, nil
+}
+
+// reload parses a live backup playlist again, it runs outside of the download loop
+func (b *backupReload) reload(ctx context.Context, opts *parser.Options) {
+	b.result, b.err = parser.Parse(ctx, b.url, opts)
+}
+
+// reloaded takes a live backup playlist that was parsed again and tries the failover of the segment
+// waiting for it once more. It returns what retry does.
+func (d *Downloader) reloaded(task *Task, b *backupReload) ([]int, time.Duration, *backupReload) {
+	if b.err != nil {
+		log.Printf("[warning] reload backup playlist %s failed: %s", b.url, b.err)
+	} else {
+		d.backups[b.n-1] = b.result
+	}
+	if moved, reload := d.moveSource(b.index, b.n, b.n, b.cause); moved != nil || reload != nil {
+		return moved, 0, reload
+	}
+	requeue, wait := d.retryLater(task, b.index, b.cause)
+	if d.stream != nil {
+		d.flushStream()
+	}
+	return requeue, wait, nil
+}
+
+// prefer moves a segment about to be fetched to the backup playlist earlier segments failed over to.
+// It returns the other segments of its group, fetched on their own afterwards.
+func (d *Downloader) prefer(segIndex int) []int {
+	seg := d.segments[segIndex]
+	if seg.source >= d.preferred || d.preferred > len(d.backups) {
+		return nil
+	}
+	var others []int
+	for _, idx := range d.switchSource(segIndex, d.preferred) {
+		if idx != segIndex {
+			others = append(others, idx)
+		}
+	}
+	return others
+}
+
+// switchSource points a segment, and the byte ranges fetched with it, at the same media sequence
+// number in the n-th backup playlist and returns their indexes, nil when the backup does not list them.
+// The segments of the group are fetched one by one afterwards since the backup may lay out its byte
+// ranges differently.
+func (d *Downloader) switchSource(segIndex, n int) []int {
+	group := d.group(segIndex)
+
+	backup := d.backups[n-1]
+	switched := make([]*segment, 0, len(group))
+	for _, idx := range group {
+		seg := d.segments[idx]
+		found := findSegment(backup.M3U8, seg.Segment)
+		if found == nil {
+			return nil
+		}
+
+		copied := *found
+		if seg.Map != nil {
+			// The init section was fetched from the original playlist already, keep its key
+			initMap := *seg.Map
+			initMap.URI = tools.ResolveURL(seg.result.URL, seg.Map.URI)
+			copied.Map = &initMap
+		}
+		switched = append(switched, &segment{Segment: &copied, result: backup, cut: seg.cut, source: n})
+	}
+
+	for i, idx := range group {
+		d.segments[idx] = switched[i]
+		delete(d.attempts, idx)
+		delete(d.groups, idx)
+	}
+	return group
+}
+
+// findSegment returns the segment of m3u8 with the media sequence number and duration of seg
+func findSegment(m3u8 *parser.M3U8, seg *parser.Segment) *parser.Segment {
+	for _, s := range m3u8.Segments {
+		if s.Sequence == seg.Sequence && math.Abs(float64(s.Duration-seg.Duration)) < maxDurationDrift {
+			return s
+		}
+	}
+	return nil
+}
+
+// isMissing reports whether the server refused or does not have the resource, retrying the same URL will not help
+func isMissing(err error) bool {
+	var httpErr *tools.HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	return httpErr.StatusCode == http.StatusForbidden || httpErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,175 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redundantMaster lists the same variant at a/v.m3u8 and b/v.m3u8, b being the backup
+const redundantMaster = "#EXTM3U\n" +
+	"#EXT-X-STREAM-INF:BANDWIDTH=1000000\na/v.m3u8\n" +
+	"#EXT-X-STREAM-INF:BANDWIDTH=1000000\nb/v.m3u8\n"
+
+// failoverServer serves redundantMaster with the playlists returned by playlist. Segment requests are
+// counted by path and answered with the status code returned by status, served when it is 0.
+func failoverServer(t *testing.T, playlist func(path string) string, status func(path string) int) (*httptest.Server, func(path string) int) {
+	t.Helper()
+	var (
+		lock     sync.Mutex
+		requests = make(map[string]int)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests[r.URL.Path]++
+		lock.Unlock()
+		switch {
+		case r.URL.Path == "/master.m3u8":
+			fmt.Fprint(w, redundantMaster)
+		case strings.HasSuffix(r.URL.Path, ".m3u8"):
+			fmt.Fprint(w, playlist(r.URL.Path))
+		default:
+			if code := status(r.URL.Path); code != 0 {
+				http.Error(w, http.StatusText(code), code)
+				return
+			}
+			segmentHandler(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, func(path string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests[path]
+	}
+}
+
+// missing answers requests of path with 404
+func missing(path string) func(string) int {
+	return func(p string) int {
+		if p == path {
+			return http.StatusNotFound
+		}
+		return 0
+	}
+}
+
+func TestFailoverMovesToBackup(t *testing.T) {
+	// Arrange
+	server, requests := failoverServer(t, func(string) string {
+		return mediaPlaylist(0, 3, true)
+	}, missing("/a/s1.ts"))
+	task := testTask(t, server)
+	task.M3U8URL = server.URL + "/master.m3u8"
+	task.Concurrency = 1
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, []float64{0, 4, 8, 12}) {
+		t.Errorf("Expected segments 0-3, got %v", got)
+	}
+	if n := requests("/a/s1.ts"); n != 1 {
+		t.Errorf("Expected a 404 to fail over right away, got %d requests", n)
+	}
+	// Segments taken off the queue after the failover follow the one that moved
+	for _, path := range []string{"/b/s1.ts", "/b/s3.ts"} {
+		if requests(path) != 1 {
+			t.Errorf("Expected %s from the backup, got %d requests", path, requests(path))
+		}
+	}
+}
+
+func TestFailoverReloadsLiveBackup(t *testing.T) {
+	// Arrange
+	var (
+		lock   sync.Mutex
+		loaded int
+	)
+	lastServed := make(chan struct{})
+	server, requests := failoverServer(t, func(path string) string {
+		if path == "/a/v.m3u8" {
+			return mediaPlaylist(0, 5, true)
+		}
+		lock.Lock()
+		loaded++
+		first := loaded == 1
+		lock.Unlock()
+		if first {
+			return mediaPlaylist(2, 5, false) // behind on segment 1
+		}
+		// The other segments keep downloading while the backup reloads
+		select {
+		case <-lastServed:
+		case <-time.After(5 * time.Second):
+			t.Error("Expected segment 5 to download while the backup reloads")
+		}
+		return mediaPlaylist(0, 5, false)
+	}, func(path string) int {
+		if path == "/a/s5.ts" {
+			defer close(lastServed)
+		}
+		return missing("/a/s1.ts")(path)
+	})
+	task := testTask(t, server)
+	task.M3U8URL = server.URL + "/master.m3u8"
+	task.Concurrency = 1
+	d := New()
+
+	// Act
+	err := d.Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, []float64{0, 4, 8, 12, 16, 20}) {
+		t.Errorf("Expected segments 0-5, got %v", got)
+	}
+	if n := requests("/b/v.m3u8"); n != 2 {
+		t.Errorf("Expected the backup to be reloaded once, got %d loads", n)
+	}
+	if n := requests("/b/s1.ts"); n != 1 {
+		t.Errorf("Expected segment 1 from the reloaded backup, got %d requests", n)
+	}
+	if len(d.backups) != 1 || len(d.backups[0].M3U8.Segments) != 6 {
+		t.Errorf("Expected the reloaded backup to be kept, got %v", d.backups)
+	}
+}
+
+func TestFailoverGivesUpWhenNoBackupLists(t *testing.T) {
+	// Arrange
+	server, _ := failoverServer(t, func(path string) string {
+		if path == "/a/v.m3u8" {
+			return mediaPlaylist(0, 3, true)
+		}
+		return mediaPlaylist(2, 3, false) // never lists segment 1
+	}, missing("/a/s1.ts"))
+	task := testTask(t, server)
+	task.M3U8URL = server.URL + "/master.m3u8"
+	task.OnFailure = FailureSkip
+	d := New()
+
+	// Act
+	err := d.Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, []float64{0, 8, 12}) {
+		t.Errorf("Expected segments 0, 2 and 3, got %v", got)
+	}
+	if !d.failed[1] {
+		t.Errorf("Expected segment 1 to be given up, got %v", d.failed)
+	}
+}
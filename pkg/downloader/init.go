@@ -0,0 +1,90 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"loki/pkg/media"
+	"loki/pkg/parser"
+	"loki/pkg/tools"
+)
+
+// fetchInitSections downloads every distinct EXT-X-MAP used by the given segments once
+func (d *Downloader) fetchInitSections(ctx context.Context, indexes []int) error {
+	if d.initFiles == nil {
+		d.initFiles = make(map[string]string)
+		d.protected = make(map[string]media.Protection)
+	}
+	for _, idx := range indexes {
+		seg := d.segments[idx]
+		if seg.Map == nil {
+			continue
+		}
+		key := seg.mapKey()
+		if _, ok := d.initFiles[key]; ok {
+			continue
+		}
+
+		data, err := fetchInitSection(ctx, seg.result, seg.Map)
+		if err != nil {
+			return fmt.Errorf("fetch init section %s: %w", seg.Map.URI, err)
+		}
+		// An encrypted init section must come with an explicit IV, the sequence is only a fallback
+		if !d.keepEncrypted {
+			if data, err = decryptAES128(data, seg.result, seg.Map.KeyIndex, seg.Sequence); err != nil {
+				return fmt.Errorf("decrypt init section %s: %w", seg.Map.URI, err)
+			}
+		}
+
+		// SAMPLE-AES leaves the init section readable but flags the tracks as protected
+		if k, ok := seg.result.Keys[seg.KeyIndex]; ok && k.Method == parser.CryptMethodSampleAES && !d.keepEncrypted {
+			protection, err := media.ClearInit(data)
+			if err != nil {
+				return fmt.Errorf("clear init section %s: %w", seg.Map.URI, err)
+			}
+			d.protected[key] = protection
+		}
+
+		fPath := filepath.Join(d.tsFolder, fmt.Sprintf(initFilePattern, len(d.initFiles)))
+		if err := os.WriteFile(fPath, data, 0o644); err != nil {
+			return fmt.Errorf("write init section %s: %w", fPath, err)
+		}
+		d.initFiles[key] = fPath
+	}
+	return nil
+}
+
+// fetchInitSection requests the init section, only its BYTERANGE when it has one
+func fetchInitSection(ctx context.Context, result *parser.Result, m *parser.Map) ([]byte, error) {
+	initURL := tools.ResolveURL(result.URL, m.URI)
+	var (
+		body io.ReadCloser
+		err  error
+	)
+	if m.Length > 0 {
+		body, err = tools.GetRange(ctx, initURL, m.Offset, m.Length)
+	} else {
+		body, err = tools.Get(ctx, initURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if m.Length > 0 && uint64(len(data)) != m.Length {
+		return nil, fmt.Errorf("byte range %d@%d: got %d bytes", m.Length, m.Offset, len(data))
+	}
+	return data, nil
+}
+
+// mapKey identifies the init section of the segment by resolved URI and byte range
+func (s *segment) mapKey() string {
+	return fmt.Sprintf("%s@%d:%d", tools.ResolveURL(s.result.URL, s.Map.URI), s.Map.Offset, s.Map.Length)
+}
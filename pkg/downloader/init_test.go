@@ -0,0 +1,74 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// fragment returns stand-in fMP4 fragment data with 0x47 bytes a packet apart, which a sync byte
+// search would take for MPEG-TS
+func fragment(n int) []byte {
+	data := make([]byte, 400)
+	copy(data, fmt.Sprintf("moof%d", n))
+	data[10], data[10+188] = 0x47, 0x47
+	return data
+}
+
+func TestInitSectionsPrecedeTheirFragments(t *testing.T) {
+	// Arrange
+	playlist := "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:4\n" +
+		"#EXT-X-MAP:URI=\"init1.mp4\"\n#EXTINF:4,\nf0.m4s\n#EXTINF:4,\nf1.m4s\n" +
+		"#EXT-X-MAP:URI=\"init2.mp4\"\n#EXTINF:4,\nf2.m4s\n#EXTINF:4,\nf3.m4s\n#EXT-X-ENDLIST\n"
+	var (
+		lock     sync.Mutex
+		requests = make(map[string]int)
+	)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, playlist)
+	}, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests[r.URL.Path]++
+		lock.Unlock()
+		if r.URL.Path == "/init1.mp4" || r.URL.Path == "/init2.mp4" {
+			fmt.Fprintf(w, "ftyp-moov-%s", r.URL.Path[1:6])
+			return
+		}
+		var n int
+		if _, err := fmt.Sscanf(r.URL.Path, "/f%d.m4s", &n); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(fragment(n))
+	})
+	task := testTask(t, server)
+	task.OutputFileName = "out.mp4"
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var want []byte
+	want = append(want, "ftyp-moov-init1"...)
+	want = append(want, fragment(0)...)
+	want = append(want, fragment(1)...)
+	want = append(want, "ftyp-moov-init2"...)
+	want = append(want, fragment(2)...)
+	want = append(want, fragment(3)...)
+	if got := readOutput(t, task); !bytes.Equal(got, want) {
+		t.Errorf("Expected each init section before its first fragment and untrimmed fragments, got %q", got)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	for _, path := range []string{"/init1.mp4", "/init2.mp4"} {
+		if requests[path] != 1 {
+			t.Errorf("Expected %s to be fetched once, got %d", path, requests[path])
+		}
+	}
+}
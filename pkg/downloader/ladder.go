@@ -0,0 +1,119 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"loki/pkg/parser"
+)
+
+// ladder downloads every variant and rendition of the master playlist at the same time, with
+// Task.Concurrency shared between them. Each one is merged into its own file next to a media
+// playlist listing it, and a master playlist named after the output file ties them together.
+func ladder(ctx context.Context, task *Task, result *parser.Result, outputFilePath, outputFileName, tsFolder string) error {
+	if result.Master == nil {
+		return errors.New("ladder mode needs a master playlist")
+	}
+
+	base := strings.TrimSuffix(outputFileName, filepath.Ext(outputFileName))
+	master, jobs, err := masterJobs(ctx, task, result, true, func(dir string) string {
+		return base + "." + dir + ladderPlaylistExt
+	})
+	if err != nil {
+		return err
+	}
+
+	limit := make(chan struct{}, max(task.Concurrency, 1))
+	var wg sync.WaitGroup
+	errs := make([]error, len(jobs))
+	for i, job := range jobs {
+		if job.media != nil {
+			fmt.Printf("[ladder] %s: %s %q\n", job.dir, job.media.Type, job.media.Name)
+		} else {
+			fmt.Printf("[ladder] %s: %s\n", job.dir, job.variant)
+		}
+		wg.Add(1)
+		go func(i int, job playlistJob) {
+			defer wg.Done()
+			errs[i] = ladderPlaylist(ctx, task, job, limit, outputFilePath, ladderFileName(outputFileName, job), tsFolder+"_"+job.dir)
+		}(i, job)
+	}
+	wg.Wait()
+
+	if err := os.RemoveAll(tsFolder); err != nil {
+		fmt.Printf("[warning] Failed to remove temporary folder %s: %s\n", tsFolder, err.Error())
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	path := filepath.Join(outputFilePath, base+ladderPlaylistExt)
+	if err := writePlaylist(path, master); err != nil {
+		return err
+	}
+	fmt.Printf("[output] %s\n", path)
+	return nil
+}
+
+// ladderPlaylist downloads and merges one playlist of a ladder download and writes a playlist listing the output.
+// Its segment requests take a slot of limit, which every playlist of the ladder shares.
+func ladderPlaylist(ctx context.Context, task *Task, job playlistJob, limit chan struct{}, outputFilePath, outputFileName, tsFolder string) error {
+	d := New()
+	d.media = job.media
+	d.progress = &progress{label: job.dir}
+	d.limit = limit
+	if err := d.run(ctx, task, job.result, outputFilePath, outputFileName, tsFolder); err != nil {
+		return fmt.Errorf("%s: %w", job.dir, err)
+	}
+
+	name := strings.TrimSuffix(outputFileName, filepath.Ext(outputFileName)) + ladderPlaylistExt
+	return writePlaylist(filepath.Join(outputFilePath, name), d.outputPlaylist())
+}
+
+// ladderFileName derives the output name of a ladder playlist from the main output name,
+// e.g. movie.mp4 becomes movie.variant_0.mp4 or movie.audio_1.aac
+func ladderFileName(outputFileName string, job playlistJob) string {
+	ext := filepath.Ext(outputFileName)
+	if job.media != nil {
+		ext = renditionExt(job.media, job.result)
+	}
+	return strings.TrimSuffix(outputFileName, filepath.Ext(outputFileName)) + "." + job.dir + ext
+}
+
+// outputPlaylist returns a VOD playlist with the merged files as its segments, split
+// outputs are separated by EXT-X-DISCONTINUITY
+func (d *Downloader) outputPlaylist() *parser.M3U8 {
+	m3u8 := &parser.M3U8{PlaylistType: parser.PlaylistTypeVOD, EndList: true}
+	ranges := d.discontinuityRanges()
+	if len(d.outputs) == 1 {
+		ranges = [][2]int{{0, d.segLen}}
+	}
+
+	for i, o := range d.outputs {
+		var duration float32
+		for idx := ranges[i][0]; idx < ranges[i][1]; idx++ {
+			duration += d.segments[idx].Duration
+		}
+		m3u8.Segments = append(m3u8.Segments, &parser.Segment{URI: filepath.Base(o), Duration: duration, Discontinuity: i > 0})
+		m3u8.TargetDuration = max(m3u8.TargetDuration, float64(duration))
+	}
+	return m3u8
+}
+
+// draw prints a line when the stage changes or the progress passes the next step
+func (p *progress) draw(stage string, fraction float32) {
+	step := int(fraction*100) / progressStep
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if stage == p.stage && step <= p.step {
+		return
+	}
+	p.stage, p.step = stage, step
+	fmt.Printf("[%s] %s %6.2f%%\n", p.label, stage, fraction*100)
+}
@@ -0,0 +1,99 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"loki/pkg/parser"
+)
+
+func TestLadderWritesPlaylists(t *testing.T) {
+	// Arrange
+	files := map[string]string{
+		"/master.m3u8": "#EXTM3U\n" +
+			"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"English\",LANGUAGE=\"en\",DEFAULT=YES,URI=\"audio/a.m3u8\"\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=2000000,AUDIO=\"aud\"\nhi/v.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=500000,AUDIO=\"aud\"\nlo/v.m3u8\n",
+	}
+	for _, dir := range []string{"hi", "lo", "audio"} {
+		name := "v.m3u8"
+		if dir == "audio" {
+			name = "a.m3u8"
+		}
+		files["/"+dir+"/"+name] = mediaPlaylist(0, 3, true)
+	}
+	var (
+		lock              sync.Mutex
+		inFlight, maxSeen int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, ok := files[r.URL.Path]; ok {
+			fmt.Fprint(w, body)
+			return
+		}
+		lock.Lock()
+		inFlight++
+		maxSeen = max(maxSeen, inFlight)
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		segmentHandler(w, r)
+		lock.Lock()
+		inFlight--
+		lock.Unlock()
+	}))
+	defer server.Close()
+	task := &Task{
+		M3U8URL:        server.URL + "/master.m3u8",
+		OutputFilePath: t.TempDir(),
+		OutputFileName: "out.ts",
+		Concurrency:    2,
+		Ladder:         true,
+	}
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if maxSeen > task.Concurrency {
+		t.Errorf("Expected at most %d segment requests across the ladder, got %d", task.Concurrency, maxSeen)
+	}
+	output := httptest.NewServer(http.FileServer(http.Dir(task.OutputFilePath)))
+	defer output.Close()
+	master, err := parser.Parse(context.Background(), output.URL+"/out.m3u8", &parser.Options{})
+	if err != nil {
+		t.Fatalf("Expected the ladder master playlist to parse, got %v", err)
+	}
+	uris := []string{master.Master.Media[0].URI}
+	for _, v := range master.Master.MasterPlaylist {
+		uris = append(uris, v.URI)
+	}
+	want := []string{"out.audio_0.m3u8", "out.variant_0.m3u8", "out.variant_1.m3u8"}
+	if strings.Join(uris, " ") != strings.Join(want, " ") {
+		t.Fatalf("Expected master playlist URIs %v, got %v", want, uris)
+	}
+	for _, uri := range uris {
+		result, err := parser.Parse(context.Background(), output.URL+"/"+uri, &parser.Options{})
+		if err != nil {
+			t.Fatalf("Expected %s to parse, got %v", uri, err)
+		}
+		segs := result.M3U8.Segments
+		name := strings.TrimSuffix(uri, ladderPlaylistExt) + ".ts"
+		if len(segs) != 1 || segs[0].URI != name || segs[0].Duration != 16 {
+			t.Errorf("Expected %s to list %s of 16s, got %+v", uri, name, segs)
+			continue
+		}
+		if got := segmentTimes(t, readFile(t, filepath.Join(task.OutputFilePath, name))); !equalTimes(got, []float64{0, 4, 8, 12}) {
+			t.Errorf("Expected %s to hold segments 0-3, got %v", name, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"loki/pkg/parser"
+)
+
+// isLive reports whether the playlist may still get new segments
+func isLive(m3u8 *parser.M3U8) bool {
+	return !m3u8.EndList && m3u8.PlaylistType != parser.PlaylistTypeVOD
+}
+
+// record downloads a live or EVENT playlist, reloading it until EXT-X-ENDLIST appears or Task.MaxDuration is hit
+func (d *Downloader) record(ctx context.Context, task *Task) error {
+	started := time.Now()
+	loadedAt := started
+	failures := 0
+
+	var nextSeq uint64
+	for {
+		m3u8 := d.result.M3U8
+		fresh := d.newSegments(m3u8, nextSeq)
+		if len(fresh) > 0 {
+			nextSeq = fresh[len(fresh)-1].Sequence + 1
+			if segs := d.skipAds(task, task.window(fresh)); len(segs) > 0 {
+				if err := d.downloadSegments(ctx, task, d.appendSegments(d.result, segs)); err != nil {
+					return err
+				}
+			}
+		}
+
+		if m3u8.EndList {
+			fmt.Print("\n[live] EXT-X-ENDLIST reached\n")
+			break
+		}
+		if len(fresh) > 0 && task.pastWindow(fresh[len(fresh)-1]) {
+			fmt.Print("\n[live] end time reached\n")
+			break
+		}
+
+		wait := reloadInterval(m3u8, len(fresh) > 0) - time.Since(loadedAt)
+		if task.MaxDuration > 0 {
+			remaining := task.MaxDuration - time.Since(started)
+			if remaining <= 0 {
+				fmt.Print("\n[live] duration limit reached\n")
+				break
+			}
+			wait = min(wait, remaining)
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return d.canceled(ctx)
+		}
+		if task.MaxDuration > 0 && time.Since(started) >= task.MaxDuration {
+			fmt.Print("\n[live] duration limit reached\n")
+			break
+		}
+
+		loadedAt = time.Now()
+		result, err := parser.Parse(ctx, d.result.URL.String(), task.parserOptions())
+		if ctx.Err() != nil {
+			return d.canceled(ctx)
+		}
+		if err != nil {
+			failures++
+			if failures >= maxReloadFailures {
+				return fmt.Errorf("reload playlist failed %d times: %w", failures, err)
+			}
+			log.Printf("[warning] reload playlist failed: %s", err)
+			continue
+		}
+		failures = 0
+		result.Backups = d.result.Backups
+		d.result = result
+	}
+
+	for _, g := range d.gaps {
+		fmt.Printf("[gap] media sequence %d-%d (%d segments) missing\n", g.from, g.to, g.to-g.from+1)
+	}
+
+	return nil
+}
+
+// newSegments returns the segments of the reloaded playlist that have not been queued yet
+func (d *Downloader) newSegments(m3u8 *parser.M3U8, nextSeq uint64) []*parser.Segment {
+	if len(m3u8.Segments) == 0 {
+		return nil
+	}
+	if d.segLen == 0 {
+		return m3u8.Segments
+	}
+
+	// The window slid past segments that were never listed in a reload we saw
+	if first := m3u8.Segments[0].Sequence; first > nextSeq {
+		g := gap{from: nextSeq, to: first - 1}
+		d.gaps = append(d.gaps, g)
+		log.Printf("[gap] media sequence %d-%d left the playlist before it was fetched", g.from, g.to)
+	}
+
+	var fresh []*parser.Segment
+	for _, seg := range m3u8.Segments {
+		if seg.Sequence >= nextSeq {
+			fresh = append(fresh, seg)
+		}
+	}
+	return fresh
+}
+
+// reloadInterval follows RFC 8216 section 6.3.4: wait the target duration after a change,
+// half of it when the playlist did not change
+func reloadInterval(m3u8 *parser.M3U8, changed bool) time.Duration {
+	interval := time.Duration(m3u8.TargetDuration * float64(time.Second))
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	if !changed {
+		interval /= 2
+	}
+	return interval
+}
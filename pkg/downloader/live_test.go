@@ -0,0 +1,73 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestRecordFollowsReloads(t *testing.T) {
+	// Arrange
+	reloads := []string{
+		mediaPlaylist(0, 2, false),
+		mediaPlaylist(1, 3, false),
+		mediaPlaylist(0, 2, false), // a stale copy going backwards adds nothing
+		mediaPlaylist(6, 8, false), // 4 and 5 left the window unseen
+		mediaPlaylist(7, 9, true),
+	}
+	var (
+		lock   sync.Mutex
+		served int
+	)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if served >= len(reloads) {
+			t.Errorf("Expected no reload after EXT-X-ENDLIST, got reload %d", served)
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, reloads[served])
+		served++
+	}, segmentHandler)
+	task := testTask(t, server)
+	task.Discontinuity = DiscontinuityConcat
+	d := New()
+
+	// Act
+	err := d.Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := []float64{0, 4, 8, 12, 24, 28, 32, 36}
+	if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, want) {
+		t.Errorf("Expected segments at %v, got %v", want, got)
+	}
+	if len(d.gaps) != 1 || d.gaps[0] != (gap{from: 4, to: 5}) {
+		t.Errorf("Expected a gap of media sequence 4-5, got %v", d.gaps)
+	}
+	if served != len(reloads) {
+		t.Errorf("Expected %d playlist loads, got %d", len(reloads), served)
+	}
+}
+
+func TestNewSegmentsSkipsKnownSequences(t *testing.T) {
+	// Arrange
+	d := &Downloader{segLen: 3}
+	reloaded := parseTestPlaylist(t, mediaPlaylist(1, 5, false))
+
+	// Act
+	fresh := d.newSegments(reloaded, 3)
+
+	// Assert
+	if len(fresh) != 3 || fresh[0].Sequence != 3 || fresh[2].Sequence != 5 {
+		t.Errorf("Expected media sequence 3-5, got %v", fresh)
+	}
+	if len(d.gaps) != 0 {
+		t.Errorf("Expected no gap, got %v", d.gaps)
+	}
+}
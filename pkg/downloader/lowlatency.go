@@ -0,0 +1,184 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"loki/pkg/parser"
+)
+
+// partCursor tracks the next partial segment to fetch from a Low-Latency HLS playlist
+type partCursor struct {
+	nextSeq  uint64 // next complete segment to queue
+	partSeq  uint64 // segment whose parts are being collected
+	nextPart int    // index of the next part of partSeq
+}
+
+// recordLowLatency follows a Low-Latency HLS playlist with blocking reloads, downloading
+// partial segments as soon as they are announced so the recording stays close to the live edge
+func (d *Downloader) recordLowLatency(ctx context.Context, task *Task) error {
+	sc := d.result.M3U8.ServerControl
+	if sc == nil || !sc.CanBlockReload || d.result.M3U8.PartTarget == 0 {
+		log.Printf("[warning] playlist does not support blocking reloads, recording without low latency")
+		return d.record(ctx, task)
+	}
+
+	base := *d.result.URL
+	partTarget := time.Duration(d.result.M3U8.PartTarget * float64(time.Second))
+	started := time.Now()
+	cursor := &partCursor{}
+	failures := 0
+	skip := false
+
+	for {
+		m3u8 := d.result.M3U8
+		var (
+			queued []*parser.Segment
+			err    error
+		)
+		if m3u8.Skip != nil && len(m3u8.Segments) > 0 && m3u8.Segments[0].Sequence > cursor.nextSeq {
+			// The delta update skipped segments that were never queued, ask for the full playlist
+			skip = false
+		} else {
+			queued = d.collectParts(m3u8, cursor)
+			if segs := d.skipAds(task, task.window(queued)); len(segs) > 0 {
+				if err = d.downloadSegments(ctx, task, d.appendSegments(d.result, segs)); err != nil {
+					return err
+				}
+			}
+			skip = m3u8.ServerControl != nil && m3u8.ServerControl.CanSkipUntil > 0
+		}
+
+		if m3u8.EndList {
+			fmt.Print("\n[live] EXT-X-ENDLIST reached\n")
+			break
+		}
+		if len(queued) > 0 && task.pastWindow(queued[len(queued)-1]) {
+			fmt.Print("\n[live] end time reached\n")
+			break
+		}
+		if task.MaxDuration > 0 && time.Since(started) >= task.MaxDuration {
+			fmt.Print("\n[live] duration limit reached\n")
+			break
+		}
+		// Do not hammer servers that answer before the requested part exists
+		if len(queued) == 0 {
+			if err := sleep(ctx, partTarget); err != nil {
+				return d.canceled(ctx)
+			}
+		}
+
+		u := base
+		q := u.Query()
+		q.Set("_HLS_msn", strconv.FormatUint(cursor.partSeq, 10))
+		q.Set("_HLS_part", strconv.Itoa(cursor.nextPart))
+		if skip {
+			q.Set("_HLS_skip", "YES")
+		}
+		u.RawQuery = q.Encode()
+
+		result, err := parser.Parse(ctx, u.String(), task.parserOptions())
+		if ctx.Err() != nil {
+			return d.canceled(ctx)
+		}
+		if err != nil {
+			failures++
+			if failures >= maxReloadFailures {
+				return fmt.Errorf("reload playlist failed %d times: %w", failures, err)
+			}
+			log.Printf("[warning] reload playlist failed: %s", err)
+			skip = false
+			continue
+		}
+		failures = 0
+		result.Backups = d.result.Backups
+		d.result = result
+	}
+
+	for _, g := range d.gaps {
+		fmt.Printf("[gap] media sequence %d-%d (%d segments) missing\n", g.from, g.to, g.to-g.from+1)
+	}
+
+	return nil
+}
+
+// collectParts returns what has to be downloaded from the playlist: complete segments that were
+// not followed part by part, the remaining parts of the segment being followed, and new pending parts
+func (d *Downloader) collectParts(m3u8 *parser.M3U8, cursor *partCursor) []*parser.Segment {
+	var queued []*parser.Segment
+	for _, seg := range d.newSegments(m3u8, cursor.nextSeq) {
+		if seg.Sequence == cursor.partSeq && cursor.nextPart > 0 {
+			if len(seg.Parts) < cursor.nextPart {
+				log.Printf("[warning] segment %d lists %d parts, %d were already fetched", seg.Sequence, len(seg.Parts), cursor.nextPart)
+			} else {
+				start := partsEnd(seg.ProgramDateTime, seg.Parts[:cursor.nextPart])
+				queued = append(queued, partSegments(seg.Parts[cursor.nextPart:], seg.Sequence, start)...)
+			}
+		} else {
+			queued = append(queued, seg)
+		}
+		cursor.nextSeq = seg.Sequence + 1
+	}
+
+	if cursor.partSeq < cursor.nextSeq {
+		cursor.partSeq = cursor.nextSeq
+		cursor.nextPart = 0
+	}
+
+	pendingSeq := m3u8.MediaSequence + uint64(len(m3u8.Segments))
+	if m3u8.Skip != nil {
+		pendingSeq += m3u8.Skip.SkippedSegments
+	}
+	if pendingSeq == cursor.partSeq && len(m3u8.PendingParts) > cursor.nextPart {
+		var start time.Time
+		if n := len(m3u8.Segments); n > 0 && !m3u8.Segments[n-1].ProgramDateTime.IsZero() {
+			last := m3u8.Segments[n-1]
+			start = partsEnd(last.ProgramDateTime.Add(segmentDuration(last)), m3u8.PendingParts[:cursor.nextPart])
+		}
+		queued = append(queued, partSegments(m3u8.PendingParts[cursor.nextPart:], pendingSeq, start)...)
+		cursor.nextPart = len(m3u8.PendingParts)
+	}
+
+	return queued
+}
+
+// partSegments turns partial segments into downloadable segments, GAP parts are dropped.
+// start is the EXT-X-PROGRAM-DATE-TIME of the first part, zero when unknown.
+func partSegments(parts []*parser.Part, seq uint64, start time.Time) []*parser.Segment {
+	var segs []*parser.Segment
+	for _, p := range parts {
+		pdt := start
+		start = partsEnd(start, []*parser.Part{p})
+		if p.Gap {
+			continue
+		}
+		segs = append(segs, &parser.Segment{
+			URI:      p.URI,
+			Sequence: seq,
+			KeyIndex: p.KeyIndex,
+			Duration: float32(p.Duration),
+			Length:   p.Length,
+			Offset:   p.Offset,
+			Map:      p.Map,
+
+			DiscontinuitySequence: p.DiscontinuitySequence,
+			ProgramDateTime:       pdt,
+			AdBreak:               p.AdBreak,
+		})
+	}
+	return segs
+}
+
+// partsEnd returns the time after the parts starting at start, zero stays zero
+func partsEnd(start time.Time, parts []*parser.Part) time.Time {
+	if start.IsZero() {
+		return start
+	}
+	for _, p := range parts {
+		start = start.Add(time.Duration(p.Duration * float64(time.Second)))
+	}
+	return start
+}
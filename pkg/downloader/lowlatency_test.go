@@ -0,0 +1,119 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lowLatencyHeader starts every playlist of the Low-Latency HLS test server
+const lowLatencyHeader = "#EXTM3U\n#EXT-X-VERSION:9\n#EXT-X-TARGETDURATION:4\n" +
+	"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=24,PART-HOLD-BACK=0.3\n" +
+	"#EXT-X-PART-INF:PART-TARGET=0.1\n#EXT-X-MEDIA-SEQUENCE:0\n"
+
+func TestRecordLowLatencyFollowsParts(t *testing.T) {
+	// Arrange
+	reloads := map[string]string{
+		// Nothing published yet, the first download happens after a blocking reload
+		"": lowLatencyHeader,
+		"_HLS_msn=0&_HLS_part=0&_HLS_skip=YES": lowLatencyHeader +
+			"#EXTINF:4,\ns0.ts\n#EXT-X-PART:DURATION=2,URI=\"p1.0.ts\"\n",
+		// Delta update: segment 0 is skipped, the part of segment 1 fetched already is listed again
+		"_HLS_msn=1&_HLS_part=1&_HLS_skip=YES": lowLatencyHeader + "#EXT-X-SKIP:SKIPPED-SEGMENTS=1\n" +
+			"#EXT-X-PART:DURATION=2,URI=\"p1.0.ts\"\n#EXT-X-PART:DURATION=2,URI=\"p1.1.ts\"\n#EXTINF:4,\ns1.ts\n" +
+			"#EXTINF:4,\ns2.ts\n#EXT-X-ENDLIST\n",
+	}
+	var (
+		lock     sync.Mutex
+		queries  []string
+		requests = make(map[string]int)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/master.m3u8":
+			fmt.Fprint(w, redundantMaster)
+		case "/a/v.m3u8":
+			queries = append(queries, r.URL.RawQuery)
+			playlist, ok := reloads[r.URL.RawQuery]
+			if !ok {
+				t.Errorf("Expected a blocking reload for the next part, got %q", r.URL.RawQuery)
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, playlist)
+		case "/b/v.m3u8":
+			fmt.Fprint(w, mediaPlaylist(0, 2, true))
+		case "/a/s2.ts":
+			http.NotFound(w, r) // moves to the backup listed before the reloads
+		case "/a/p1.0.ts", "/a/p1.1.ts":
+			var part int
+			fmt.Sscanf(r.URL.Path, "/a/p1.%d.ts", &part)
+			w.Write(tsSegment(float64(4 + part*2)))
+		default:
+			segmentHandler(w, r)
+		}
+	}))
+	defer server.Close()
+	task := testTask(t, server)
+	task.M3U8URL = server.URL + "/master.m3u8"
+	task.LowLatency = true
+	task.Discontinuity = DiscontinuityConcat
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	want := []string{"", "_HLS_msn=0&_HLS_part=0&_HLS_skip=YES", "_HLS_msn=1&_HLS_part=1&_HLS_skip=YES"}
+	if !slices.Equal(queries, want) {
+		t.Errorf("Expected playlist loads %q, got %q", want, queries)
+	}
+	if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, []float64{0, 4, 6, 8}) {
+		t.Errorf("Expected segment 0, both parts of segment 1 and segment 2, got %v", got)
+	}
+	for path, n := range map[string]int{"/a/p1.0.ts": 1, "/a/p1.1.ts": 1, "/a/s1.ts": 0, "/b/s2.ts": 1} {
+		if requests[path] != n {
+			t.Errorf("Expected %d requests of %s, got %d", n, path, requests[path])
+		}
+	}
+}
+
+func TestCollectPartsTracksPendingParts(t *testing.T) {
+	// Arrange
+	d := &Downloader{}
+	cursor := &partCursor{}
+	first := parseTestPlaylist(t, lowLatencyHeader+
+		"#EXTINF:4,\ns0.ts\n#EXT-X-PART:DURATION=2,URI=\"p1.0.ts\"\n")
+	second := parseTestPlaylist(t, lowLatencyHeader+
+		"#EXTINF:4,\ns0.ts\n#EXT-X-PART:DURATION=2,URI=\"p1.0.ts\"\n#EXT-X-PART:DURATION=2,URI=\"p1.1.ts\"\n"+
+		"#EXTINF:4,\ns1.ts\n#EXT-X-PART:DURATION=2,URI=\"p2.0.ts\"\n")
+
+	// Act
+	queued := d.collectParts(first, cursor)
+	d.segLen = len(queued)
+	queued = append(queued, d.collectParts(second, cursor)...)
+
+	// Assert
+	var uris []string
+	for _, seg := range queued {
+		uris = append(uris, fmt.Sprintf("%d:%s", seg.Sequence, seg.URI))
+	}
+	if want := "0:s0.ts 1:p1.0.ts 1:p1.1.ts 2:p2.0.ts"; strings.Join(uris, " ") != want {
+		t.Errorf("Expected %s, got %s", want, strings.Join(uris, " "))
+	}
+	if cursor.nextSeq != 2 || cursor.partSeq != 2 || cursor.nextPart != 1 {
+		t.Errorf("Expected the cursor on part 1 of segment 2, got %+v", cursor)
+	}
+}
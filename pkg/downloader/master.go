@@ -0,0 +1,89 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"loki/pkg/parser"
+	"loki/pkg/tools"
+)
+
+// playlistJob is a media playlist of a master playlist and the name its output goes under
+type playlistJob struct {
+	result  *parser.Result
+	dir     string
+	variant *parser.MasterPlaylist // set for variants of a master playlist
+	media   *parser.Media          // set for EXT-X-MEDIA renditions
+}
+
+// masterJobs lists the media playlists of the master playlist and returns the master playlist
+// rewritten so each of them points at uri(dir). Only the chosen variant and renditions are kept
+// unless all is set, redundant copies of a variant are left out.
+func masterJobs(ctx context.Context, task *Task, result *parser.Result, all bool, uri func(dir string) string) (*parser.M3U8, []playlistJob, error) {
+	base, err := url.Parse(task.M3U8URL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid URL: %v", err)
+	}
+
+	master := *result.Master
+	master.MasterPlaylist = nil
+	master.Media = nil
+	master.ContentSteering = nil
+	var jobs []playlistJob
+
+	primaries, copies := parser.GroupRedundant(result.Master.MasterPlaylist, result.Pathways)
+	for _, mp := range primaries {
+		if slices.Contains(copies[mp], result.Variant) {
+			mp = result.Variant
+		}
+		if !all && mp != result.Variant {
+			continue
+		}
+		variant := result
+		if mp != result.Variant {
+			if variant, err = parser.Parse(ctx, tools.ResolveURL(base, mp.URI), task.parserOptions()); ctx.Err() != nil {
+				return nil, nil, &CanceledError{Cause: ctx.Err()}
+			} else if err != nil {
+				return nil, nil, fmt.Errorf("parse variant %s: %w", mp, err)
+			}
+		}
+		dir := fmt.Sprintf("variant_%d", len(jobs))
+		jobs = append(jobs, playlistJob{result: variant, dir: dir, variant: mp})
+
+		rewritten := *mp
+		rewritten.URI = uri(dir)
+		master.MasterPlaylist = append(master.MasterPlaylist, &rewritten)
+	}
+
+	chosen := make(map[*parser.Media]*parser.Result)
+	for _, r := range result.Renditions {
+		chosen[r.Media] = r.Result
+	}
+	for i, m := range result.Master.Media {
+		rendition, ok := chosen[m]
+		switch {
+		case m.URI == "":
+			// Muxed into the variants
+			master.Media = append(master.Media, m)
+			continue
+		case !ok && !all:
+			continue
+		case !ok:
+			if rendition, err = parser.Parse(ctx, tools.ResolveURL(base, m.URI), task.parserOptions()); ctx.Err() != nil {
+				return nil, nil, &CanceledError{Cause: ctx.Err()}
+			} else if err != nil {
+				return nil, nil, fmt.Errorf("parse %s rendition %q: %w", m.Type, m.Name, err)
+			}
+		}
+		dir := fmt.Sprintf("%s_%d", strings.ToLower(string(m.Type)), i)
+		jobs = append(jobs, playlistJob{result: rendition, dir: dir, media: m})
+
+		rewritten := *m
+		rewritten.URI = uri(dir)
+		master.Media = append(master.Media, &rewritten)
+	}
+	return &master, jobs, nil
+}
@@ -0,0 +1,174 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"loki/pkg/parser"
+	"loki/pkg/tools"
+)
+
+// mirror saves the HLS package instead of merging it: the master playlist, the media playlists, their
+// segments, init sections and keys, with every URI rewritten to a relative path. The tree is written
+// to a folder named after the output file.
+func mirror(ctx context.Context, task *Task, result *parser.Result, outputFilePath, outputFileName, tsFolder string) error {
+	root := filepath.Join(outputFilePath, strings.TrimSuffix(outputFileName, filepath.Ext(outputFileName)))
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return fmt.Errorf("create mirror folder: %w", err)
+	}
+
+	// The shared work folder may hold an interrupted download to resume, mirror next to it
+	defer os.Remove(tsFolder) // only when empty
+	if result.Master == nil {
+		if err := mirrorPlaylist(ctx, task, playlistJob{result: result}, root, tsFolder+"_mirror"); err != nil {
+			return err
+		}
+		fmt.Printf("\n[output] %s\n", filepath.Join(root, mirrorPlaylistName))
+		return nil
+	}
+
+	master, jobs, err := masterJobs(ctx, task, result, task.MirrorAll, func(dir string) string {
+		return dir + "/" + mirrorPlaylistName
+	})
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if err := mirrorPlaylist(ctx, task, job, filepath.Join(root, job.dir), tsFolder+"_"+job.dir); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(root, mirrorMasterName)
+	if err := writePlaylist(path, master); err != nil {
+		return err
+	}
+	fmt.Printf("\n[output] %s\n", path)
+	return nil
+}
+
+// mirrorPlaylist downloads the segments of a media playlist into dir and writes the playlist next to them
+func mirrorPlaylist(ctx context.Context, task *Task, job playlistJob, dir, tsFolder string) error {
+	if isLive(job.result.M3U8) {
+		return errors.New("mirror mode only supports VOD playlists")
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("create mirror folder: %w", err)
+	}
+	if err := prepareFolder(tsFolder); err != nil {
+		return err
+	}
+
+	if job.media != nil {
+		fmt.Printf("[mirror] %s %q\n", job.media.Type, job.media.Name)
+	} else if job.variant != nil {
+		fmt.Printf("[mirror] variant %s\n", job.variant)
+	}
+
+	d := New()
+	d.tsFolder = tsFolder
+	d.result = job.result
+	d.media = job.media
+	d.keepEncrypted = !task.MirrorDecrypt
+	if err := d.downloadSegments(ctx, task, d.appendSegments(job.result, job.result.M3U8.Segments)); err != nil {
+		return err
+	}
+	fmt.Print("\n")
+
+	m3u8, err := d.store(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(tsFolder); err != nil {
+		fmt.Printf("[warning] Failed to remove temporary folder %s: %s\n", tsFolder, err.Error())
+	}
+	return writePlaylist(filepath.Join(dir, mirrorPlaylistName), m3u8)
+}
+
+// store moves the downloaded segments and init sections into dir, writes the keys next to them
+// and returns a copy of the playlist that points at the local files
+func (d *Downloader) store(dir string) (*parser.M3U8, error) {
+	m3u8 := *d.result.M3U8
+	m3u8.Segments = make([]*parser.Segment, 0, d.segLen)
+	m3u8.Keys = make(map[int]*parser.Key)
+	m3u8.PendingParts = nil
+	m3u8.PreloadHints = nil
+
+	// Encrypted segments keep their EXT-X-KEY, pointing at a local copy of the key
+	if d.keepEncrypted {
+		for idx, key := range d.result.M3U8.Keys {
+			rewritten := *key
+			if material, ok := d.result.Keys[idx]; ok {
+				name := fmt.Sprintf(mirrorKeyPattern, idx)
+				if err := os.WriteFile(filepath.Join(dir, name), material.Key, 0o600); err != nil {
+					return nil, fmt.Errorf("write key %s: %w", name, err)
+				}
+				rewritten.URI = name
+				if material.IV != nil {
+					rewritten.IV = material.IV
+				}
+			}
+			m3u8.Keys[idx] = &rewritten
+		}
+	}
+
+	maps := make(map[string]*parser.Map)
+	for idx := 0; idx < d.segLen; idx++ {
+		seg := d.segments[idx]
+		rewritten := *seg.Segment
+		rewritten.Length, rewritten.Offset = 0, 0
+		rewritten.Parts = nil
+
+		ext := tools.URLExt(seg.URI)
+		if ext == "" {
+			ext = tsExt
+		}
+		rewritten.URI = fmt.Sprintf(mirrorSegmentPattern, seg.Sequence, ext)
+		src := filepath.Join(d.tsFolder, tools.ResolveTSFilename(idx))
+		if d.failed[idx] {
+			// Given up under Task.OnFailure, players skip over it
+			rewritten.UnknownTags = append(slices.Clip(rewritten.UnknownTags), extGap)
+		} else if err := os.Rename(src, filepath.Join(dir, rewritten.URI)); err != nil {
+			return nil, fmt.Errorf("move segment %s: %w", rewritten.URI, err)
+		}
+
+		if seg.Map != nil {
+			key := seg.mapKey()
+			if maps[key] == nil {
+				local := &parser.Map{URI: fmt.Sprintf(initFilePattern, len(maps)), KeyIndex: seg.Map.KeyIndex}
+				if err := os.Rename(d.initFiles[key], filepath.Join(dir, local.URI)); err != nil {
+					return nil, fmt.Errorf("move init section %s: %w", local.URI, err)
+				}
+				maps[key] = local
+			}
+			rewritten.Map = maps[key]
+		}
+
+		if !d.keepEncrypted {
+			rewritten.KeyIndex = 0
+			if rewritten.Map != nil {
+				rewritten.Map.KeyIndex = 0
+			}
+		}
+		m3u8.Segments = append(m3u8.Segments, &rewritten)
+	}
+	return &m3u8, nil
+}
+
+// writePlaylist encodes a playlist to path
+func writePlaylist(path string, m3u8 *parser.M3U8) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create playlist %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if err := m3u8.Encode(f); err != nil {
+		return fmt.Errorf("write playlist %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"loki/pkg/parser"
+	"loki/pkg/tools"
+)
+
+func TestMirrorRewritesPackage(t *testing.T) {
+	// Arrange
+	key := []byte("0123456789abcdef")
+	files := map[string]string{
+		"/master.m3u8": "#EXTM3U\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=2000000\nhi/v.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=500000\nlo/v.m3u8\n",
+		"/hi/v.m3u8": "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:4\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"k.bin\",IV=0x00000000000000000000000000000001\n" +
+			"#EXT-X-MAP:URI=\"init.mp4\"\n" +
+			"#EXTINF:4,\nseg0.m4s\n#EXTINF:4,\nseg1.m4s\n#EXTINF:4,\nseg2.m4s\n#EXT-X-ENDLIST\n",
+		"/hi/init.mp4": "init",
+		"/hi/seg0.m4s": "fragment 0",
+		"/hi/seg2.m4s": "fragment 2",
+		"/hi/k.bin":    string(key),
+		"/lo/v.m3u8":   "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\ns0.ts\n#EXTINF:4,\ns1.ts\n#EXT-X-ENDLIST\n",
+		"/lo/s0.ts":    string(tsSegment(0)),
+		"/lo/s1.ts":    string(tsSegment(4)),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r) // seg1.m4s is given up under FailureSkip
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+	task := &Task{
+		M3U8URL:        server.URL + "/master.m3u8",
+		OutputFilePath: t.TempDir(),
+		OutputFileName: "out.ts",
+		Concurrency:    2,
+		Mirror:         true,
+		MirrorAll:      true,
+		OnFailure:      FailureSkip,
+	}
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	root := filepath.Join(task.OutputFilePath, "out")
+	mirrored := httptest.NewServer(http.FileServer(http.Dir(root)))
+	defer mirrored.Close()
+	master, err := parser.Parse(context.Background(), mirrored.URL+"/"+mirrorMasterName, &parser.Options{})
+	if err != nil {
+		t.Fatalf("Expected the mirrored master playlist to parse, got %v", err)
+	}
+	variants := master.Master.MasterPlaylist
+	if len(variants) != 2 {
+		t.Fatalf("Expected 2 variants, got %d", len(variants))
+	}
+	dirs := make(map[uint32]string)
+	for _, v := range variants {
+		if filepath.IsAbs(v.URI) || filepath.Base(v.URI) != mirrorPlaylistName {
+			t.Errorf("Expected a relative URI to %s, got %s", mirrorPlaylistName, v.URI)
+		}
+		dirs[v.BandWidth] = filepath.Dir(v.URI)
+	}
+
+	hi := parseMirrored(t, mirrored, dirs[2000000])
+	if len(hi.Segments) != 3 {
+		t.Fatalf("Expected 3 segments, got %d", len(hi.Segments))
+	}
+	for i, seg := range hi.Segments {
+		if want := fmt.Sprintf(mirrorSegmentPattern, i, ".m4s"); seg.URI != want {
+			t.Errorf("Expected segment URI %s, got %s", want, seg.URI)
+		}
+		if seg.Map == nil || seg.Map.URI != fmt.Sprintf(initFilePattern, 0) {
+			t.Errorf("Expected segment %d to use %s, got %+v", i, fmt.Sprintf(initFilePattern, 0), seg.Map)
+		}
+		gap := len(seg.UnknownTags) == 1 && seg.UnknownTags[0] == extGap
+		if gap != (i == 1) {
+			t.Errorf("Expected EXT-X-GAP on segment 1 only, got %v on segment %d", seg.UnknownTags, i)
+		}
+		k := hi.Keys[seg.KeyIndex]
+		if k == nil || k.URI != fmt.Sprintf(mirrorKeyPattern, seg.KeyIndex) {
+			t.Errorf("Expected segment %d to use a local key, got %+v", i, k)
+		}
+	}
+	dir := filepath.Join(root, dirs[2000000])
+	inits, _ := filepath.Glob(filepath.Join(dir, "init_*"))
+	if len(inits) != 1 {
+		t.Errorf("Expected one init section, got %v", inits)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, hi.Keys[hi.Segments[0].KeyIndex].URI)); !bytes.Equal(got, key) {
+		t.Errorf("Expected the key copy %q, got %q", key, got)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, hi.Segments[2].URI)); string(got) != "fragment 2" {
+		t.Errorf("Expected the segment kept encrypted as served, got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, hi.Segments[1].URI)); !os.IsNotExist(err) {
+		t.Errorf("Expected no file for the skipped segment, got %v", err)
+	}
+
+	lo := parseMirrored(t, mirrored, dirs[500000])
+	if len(lo.Segments) != 2 || lo.Segments[1].URI != fmt.Sprintf(mirrorSegmentPattern, 1, ".ts") {
+		t.Errorf("Expected 2 local MPEG-TS segments, got %+v", lo.Segments)
+	}
+}
+
+// parseMirrored parses the media playlist a mirror wrote into dir
+func parseMirrored(t *testing.T, server *httptest.Server, dir string) *parser.M3U8 {
+	t.Helper()
+	result, err := parser.Parse(context.Background(), server.URL+"/"+dir+"/"+mirrorPlaylistName, &parser.Options{})
+	if err != nil {
+		t.Fatalf("Expected the mirrored playlist in %s to parse, got %v", dir, err)
+	}
+	return result.M3U8
+}
+
+func TestMirrorKeepsResumeFolder(t *testing.T) {
+	// Arrange
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, mediaPlaylist(0, 3, true))
+	}, segmentHandler)
+	task := testTask(t, server)
+	stored := tsSegment(0)
+	writeWorkFolder(t, task, fingerprint(t), map[int][]byte{0: stored}, entryLine(0, stored))
+	task.Mirror = true
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	folder := filepath.Join(task.OutputFilePath, tsFolderName)
+	for _, name := range []string{stateFileName, tools.ResolveTSFilename(0)} {
+		if _, err := os.Stat(filepath.Join(folder, name)); err != nil {
+			t.Errorf("Expected %s of the interrupted download to be kept, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(folder + "_mirror"); !os.IsNotExist(err) {
+		t.Errorf("Expected the mirror work folder to be removed, got %v", err)
+	}
+	mirrored := httptest.NewServer(http.FileServer(http.Dir(filepath.Join(task.OutputFilePath, "out"))))
+	defer mirrored.Close()
+	if m3u8 := parseMirrored(t, mirrored, "."); len(m3u8.Segments) != 4 {
+		t.Errorf("Expected 4 mirrored segments, got %d", len(m3u8.Segments))
+	}
+}
@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"loki/pkg/tools"
+)
+
+// mergePartial merges the segments a canceled download completed and returns the cancellation with
+// the output files set. PartialPrefix stops at the first segment still to download, segments given up
+// under Task.OnFailure do not end it. PartialAll merges every completed one and realigns the timestamps
+// after each hole. The work folder of a VOD download is kept so it can still resume.
+func (d *Downloader) mergePartial(mode PartialMode, canceled *CanceledError) error {
+	total := d.segLen
+	done := make([]bool, total)
+	for idx := range done {
+		_, err := os.Stat(filepath.Join(d.tsFolder, tools.ResolveTSFilename(idx)))
+		done[idx] = err == nil
+	}
+	if mode == PartialPrefix {
+		for idx, ok := range done {
+			if !ok && !d.failed[idx] {
+				d.segLen = idx
+				break
+			}
+		}
+	}
+
+	count := 0
+	for _, ok := range done[:d.segLen] {
+		if ok {
+			count++
+		}
+	}
+	fmt.Print("\n")
+	if count == 0 {
+		fmt.Println("[partial] no segment was completed, nothing to merge")
+		return canceled
+	}
+
+	d.partial = true
+	if err := d.merge(); err != nil {
+		return fmt.Errorf("merge partial output: %w", err)
+	}
+	canceled.Outputs = d.outputs
+	d.printCovered(done[:d.segLen], count, total)
+	return canceled
+}
+
+// printCovered prints which part of the playlist a partial output covers, as offsets from the first
+// segment and as EXT-X-PROGRAM-DATE-TIME when the playlist has it, and the gaps left in it
+func (d *Downloader) printCovered(done []bool, count, total int) {
+	starts := make([]time.Duration, total+1)
+	for idx := 0; idx < total; idx++ {
+		starts[idx+1] = starts[idx] + segmentDuration(d.segments[idx].Segment)
+	}
+	span := func(from, to int) string {
+		s := fmt.Sprintf("%s - %s", formatOffset(starts[from]), formatOffset(starts[to]))
+		if first, last := d.segments[from], d.segments[to-1]; !first.ProgramDateTime.IsZero() {
+			end := last.ProgramDateTime.Add(segmentDuration(last.Segment))
+			s += fmt.Sprintf(" (%s - %s)", first.ProgramDateTime.Format(time.RFC3339), end.Format(time.RFC3339))
+		}
+		return s
+	}
+
+	fmt.Printf("[partial] %d of %d segments merged\n", count, total)
+	var covered time.Duration
+	lastEnd := -1
+	for idx := 0; idx < len(done); idx++ {
+		if !done[idx] {
+			continue
+		}
+		from := idx
+		for idx < len(done) && done[idx] {
+			idx++
+		}
+		if lastEnd >= 0 {
+			fmt.Printf("[partial] gap %s, %d missing\n", span(lastEnd, from), from-lastEnd)
+		}
+		fmt.Printf("[partial] covered %s\n", span(from, idx))
+		covered += starts[idx] - starts[from]
+		lastEnd = idx
+	}
+	fmt.Printf("[partial] %s of %s\n", formatOffset(covered), formatOffset(starts[total]))
+}
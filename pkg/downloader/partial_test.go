@@ -0,0 +1,90 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"loki/pkg/tools"
+)
+
+// canceledRun downloads mediaPlaylist(0, 5, true) under mode and cancels it while s3.ts is being
+// fetched, once the other segments are stored. s1.ts is missing and given up under FailureSkip,
+// s4.ts and s5.ts start 84 seconds later than the playlist durations say.
+func canceledRun(t *testing.T, mode PartialMode) (*Task, error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var task *Task
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, mediaPlaylist(0, 5, true))
+	}, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/s1.ts":
+			http.NotFound(w, r)
+		case "/s3.ts":
+			folder := filepath.Join(task.OutputFilePath, tsFolderName)
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+				stored := 0
+				for _, idx := range []int{0, 2, 4, 5} {
+					if _, err := os.Stat(filepath.Join(folder, tools.ResolveTSFilename(idx))); err == nil {
+						stored++
+					}
+				}
+				if stored == 4 {
+					break
+				}
+			}
+			cancel()
+			<-r.Context().Done()
+		case "/s4.ts", "/s5.ts":
+			var seq int
+			fmt.Sscanf(r.URL.Path, "/s%d.ts", &seq)
+			w.Write(tsSegment(float64(seq*4 + 84)))
+		default:
+			segmentHandler(w, r)
+		}
+	})
+	task = testTask(t, server)
+	task.OnFailure = FailureSkip
+	task.Partial = mode
+	return task, New().Start(ctx, task)
+}
+
+func TestPartialPrefixGoesPastSkippedSegments(t *testing.T) {
+	// Act
+	task, err := canceledRun(t, PartialPrefix)
+
+	// Assert
+	var canceled *CanceledError
+	if !errors.As(err, &canceled) || len(canceled.Outputs) != 1 {
+		t.Fatalf("Expected a cancellation with one output, got %v", err)
+	}
+	// Segment 1 was given up, the prefix ends at segment 3 that was still downloading
+	if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, []float64{0, 8}) {
+		t.Errorf("Expected segments 0 and 2, got %v", got)
+	}
+}
+
+func TestPartialAllRealignsAfterHoles(t *testing.T) {
+	// Act
+	task, err := canceledRun(t, PartialAll)
+
+	// Assert
+	var canceled *CanceledError
+	if !errors.As(err, &canceled) || len(canceled.Outputs) != 1 {
+		t.Fatalf("Expected a cancellation with one output, got %v", err)
+	}
+	// Segments 4 and 5 follow the hole left by segment 3 where the playlist durations place them
+	if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, []float64{0, 8, 16, 20}) {
+		t.Errorf("Expected segments at 0, 8, 16 and 20, got %v", got)
+	}
+	if _, err := os.Stat(canceled.WorkFolder); err != nil {
+		t.Errorf("Expected the work folder to be kept for resuming, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"time"
+
+	"loki/pkg/media"
+	"loki/pkg/tools"
+)
+
+// errDecrypt marks segments that failed to decrypt, fetching them again does not help
+var errDecrypt = errors.New("decrypt")
+
+// retries returns the fetch attempts per segment
+func (t *Task) retries() int {
+	if t.Retries > 0 {
+		return t.Retries
+	}
+	return DefaultRetries
+}
+
+// retry decides what happens to a failed fetch: the segment moves to a backup playlist, goes back on
+// the queue after a backoff, or is given up under Task.OnFailure once it is out of attempts or the
+// error is fatal. It returns the indexes to queue again and how long to wait before, or a live
+// backup to reload before deciding. Attempts count on the current playlist, a move starts them over.
+func (d *Downloader) retry(task *Task, segIndex int, err error) ([]int, time.Duration, *backupReload) {
+	if d.attempts == nil {
+		d.attempts = make(map[int]int)
+	}
+	d.attempts[segIndex]++
+	if moved, reload := d.failover(segIndex, err); moved != nil || reload != nil {
+		return moved, 0, reload
+	}
+	requeue, wait := d.retryLater(task, segIndex, err)
+	return requeue, wait, nil
+}
+
+// retryLater returns a segment that stays on its playlist to queue again after a backoff, or gives
+// it up once it is out of attempts or the error is fatal
+func (d *Downloader) retryLater(task *Task, segIndex int, err error) ([]int, time.Duration) {
+	attempts := d.attempts[segIndex]
+	if !retryable(err) || attempts >= task.retries() {
+		d.giveUp(segIndex, fmt.Errorf("segment %d, attempt %d: %w", d.segments[segIndex].Sequence, attempts, err))
+		return nil, 0
+	}
+	return []int{segIndex}, backoff(attempts)
+}
+
+// giveUp applies the failure policy to a segment that is out of retries, together with the byte ranges
+// fetched with it. FailureFail records err for the task to stop with, the other policies count the
+// segments as finished so the download goes on without them.
+func (d *Downloader) giveUp(segIndex int, err error) {
+	if d.onFailure == "" || d.onFailure == FailureFail {
+		if d.fatal == nil {
+			d.fatal = err
+		}
+		return
+	}
+
+	log.Printf("[%s] %s", d.onFailure, err)
+	group := d.group(segIndex)
+	if d.failed == nil {
+		d.failed = make(map[int]bool)
+	}
+	for _, idx := range group {
+		d.failed[idx] = true
+	}
+	delete(d.groups, segIndex)
+	d.finish += len(group)
+}
+
+// backoff returns the wait before the next attempt of a segment that failed attempts times,
+// doubled after each failure up to retryMaxDelay with half of it random so retries spread out
+func backoff(attempts int) time.Duration {
+	delay := retryMaxDelay
+	if attempts <= 30 {
+		delay = min(retryBaseDelay<<(attempts-1), retryMaxDelay)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retryable reports whether fetching the segment again may succeed: 5xx, 408, 429 and network errors
+// such as timeouts are retried, other client errors and decryption failures are not
+func retryable(err error) bool {
+	if errors.Is(err, errDecrypt) {
+		return false
+	}
+	var httpErr *tools.HTTPError
+	if errors.As(err, &httpErr) {
+		switch code := httpErr.StatusCode; {
+		case code >= http.StatusInternalServerError, code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+			return true
+		default:
+			return false
+		}
+	}
+	// Timeouts, dropped connections and the like
+	return true
+}
+
+// fill returns the stored data of the previous segment shifted by its duration, to stand in for
+// a segment given up under FailureFill
+func fill(prev []byte, duration float32, fragment bool, timescales map[uint32]uint32) ([]byte, error) {
+	data := slices.Clone(prev)
+	if fragment {
+		return data, media.ShiftFragment(data, timescales, float64(duration))
+	}
+	return data, media.ShiftTS(data, float64(duration))
+}
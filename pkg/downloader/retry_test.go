@@ -0,0 +1,126 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"loki/pkg/tools"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", &tools.HTTPError{StatusCode: http.StatusInternalServerError}, true},
+		{"unavailable", &tools.HTTPError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"request timeout", &tools.HTTPError{StatusCode: http.StatusRequestTimeout}, true},
+		{"too many requests", &tools.HTTPError{StatusCode: http.StatusTooManyRequests}, true},
+		{"not found", &tools.HTTPError{StatusCode: http.StatusNotFound}, false},
+		{"forbidden", &tools.HTTPError{StatusCode: http.StatusForbidden}, false},
+		{"wrapped client error", fmt.Errorf("request 3 failed: %w", &tools.HTTPError{StatusCode: http.StatusBadRequest}), false},
+		{"decryption", fmt.Errorf("%w AES-128: bad padding", errDecrypt), false},
+		{"network", errors.New("read: connection reset by peer"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Act
+			got := retryable(tt.err)
+
+			// Assert
+			if got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		min, max time.Duration
+	}{
+		{1, 250 * time.Millisecond, 500 * time.Millisecond},
+		{2, 500 * time.Millisecond, time.Second},
+		{4, 2 * time.Second, 4 * time.Second},
+		{7, 15 * time.Second, 30 * time.Second},   // 32s capped
+		{100, 15 * time.Second, 30 * time.Second}, // past the shift width
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("attempt %d", tt.attempts), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				// Act
+				got := backoff(tt.attempts)
+
+				// Assert
+				if got < tt.min || got > tt.max {
+					t.Fatalf("Expected a wait between %v and %v, got %v", tt.min, tt.max, got)
+				}
+			}
+		})
+	}
+}
+
+func TestFailurePolicies(t *testing.T) {
+	tests := []struct {
+		policy FailurePolicy
+		times  []float64 // output segments, nil when the task fails
+	}{
+		{FailureFail, nil},
+		{FailureSkip, []float64{0, 8, 12}},
+		{FailureFill, []float64{0, 4, 8, 12}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			// Arrange
+			var (
+				lock     sync.Mutex
+				requests int
+			)
+			server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, mediaPlaylist(0, 3, true))
+			}, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/s1.ts" {
+					lock.Lock()
+					requests++
+					lock.Unlock()
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				segmentHandler(w, r)
+			})
+			task := testTask(t, server)
+			task.Retries = 2
+			task.OnFailure = tt.policy
+
+			// Act
+			err := New().Start(context.Background(), task)
+
+			// Assert
+			lock.Lock()
+			defer lock.Unlock()
+			if requests != task.Retries {
+				t.Errorf("Expected %d attempts of segment 1, got %d", task.Retries, requests)
+			}
+			if tt.times == nil {
+				if err == nil || !strings.Contains(err.Error(), "segment 1, attempt 2") {
+					t.Errorf("Expected the task to fail on segment 1, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, tt.times) {
+				t.Errorf("Expected segments at %v, got %v", tt.times, got)
+			}
+		})
+	}
+}
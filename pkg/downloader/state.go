@@ -0,0 +1,206 @@
+package downloader
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"loki/pkg/parser"
+	"loki/pkg/tools"
+)
+
+// resume prepares the work folder of a VOD download. Segments an earlier run of the same task
+// completed are kept when they still match their hash, everything else in the folder is removed.
+// A state file left by another task is discarded, one left by this task for a playlist that has
+// changed since is an error.
+func (d *Downloader) resume(task *Task) error {
+	header := stateHeader{
+		Source:      stripQuery(task.M3U8URL),
+		Playlist:    stripQuery(d.result.URL.String()),
+		Fingerprint: playlistFingerprint(d.result.M3U8),
+	}
+	if d.result.Variant != nil {
+		header.Variant = d.result.Variant.String()
+	}
+
+	path := filepath.Join(d.tsFolder, stateFileName)
+	prev, entries, err := readState(path)
+	sameTask := err == nil && prev.Source == header.Source && prev.Playlist == header.Playlist
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		log.Printf("[warning] unreadable state file %s, starting over: %s", path, err)
+	case err == nil && !sameTask:
+		fmt.Printf("[resume] %s belongs to another download, starting over\n", d.tsFolder)
+	case sameTask && prev.Fingerprint != header.Fingerprint:
+		return fmt.Errorf("the playlist changed since the interrupted download, remove %s to start over", d.tsFolder)
+	}
+
+	d.state = &taskState{done: make(map[int]bool)}
+	var kept []stateEntry
+	if sameTask {
+		for _, e := range entries {
+			if !d.state.done[e.Index] && d.verify(e) {
+				d.state.done[e.Index] = true
+				kept = append(kept, e)
+			}
+		}
+		if err := d.clearFolder(kept); err != nil {
+			return err
+		}
+		d.finish = len(kept)
+		fmt.Printf("[resume] %d of %d segments already downloaded\n", len(kept), d.segLen)
+	} else if err := prepareFolder(d.tsFolder); err != nil {
+		return err
+	}
+
+	// Rewrite the file so a line cut short by the interruption does not stay in the middle of it
+	if d.state.file, err = os.Create(path); err != nil {
+		return fmt.Errorf("create state file: %w", err)
+	}
+	if err := d.state.write(header); err != nil {
+		return err
+	}
+	for _, e := range kept {
+		if err := d.state.write(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readState reads a state file, a line cut short by an interruption ends it
+func readState(path string) (*stateHeader, []stateEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return nil, nil, fmt.Errorf("empty state file")
+	}
+	header := new(stateHeader)
+	if err := json.Unmarshal(scanner.Bytes(), header); err != nil {
+		return nil, nil, fmt.Errorf("invalid state header: %v", err)
+	}
+
+	var entries []stateEntry
+	for scanner.Scan() {
+		var e stateEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+	return header, entries, nil
+}
+
+// verify reports whether the stored file of a state entry is still the segment it was written for
+func (d *Downloader) verify(e stateEntry) bool {
+	if e.Index < 0 || e.Index >= d.segLen || d.segments[e.Index].Sequence != e.Sequence {
+		return false
+	}
+	data, err := os.ReadFile(filepath.Join(d.tsFolder, tools.ResolveTSFilename(e.Index)))
+	if err != nil || len(data) != e.Size {
+		return false
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) == e.SHA256
+}
+
+// clearFolder removes everything in the work folder but the state file and the kept segments
+func (d *Downloader) clearFolder(kept []stateEntry) error {
+	keep := map[string]bool{stateFileName: true}
+	for _, e := range kept {
+		keep[tools.ResolveTSFilename(e.Index)] = true
+	}
+
+	files, err := os.ReadDir(d.tsFolder)
+	if err != nil {
+		return fmt.Errorf("read work folder: %w", err)
+	}
+	for _, f := range files {
+		if keep[f.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(d.tsFolder, f.Name())); err != nil {
+			return fmt.Errorf("remove %s: %w", f.Name(), err)
+		}
+	}
+	return nil
+}
+
+// playlistFingerprint hashes what decides which segment a stored file holds and how it was decoded.
+// Query strings are left out, CDNs often sign every URL again when the playlist is reloaded.
+func playlistFingerprint(m3u8 *parser.M3U8) string {
+	h := sha256.New()
+	for _, seg := range m3u8.Segments {
+		fmt.Fprintf(h, "%d|%s|%g|%d@%d|%d", seg.Sequence, stripQuery(seg.URI), seg.Duration, seg.Length, seg.Offset, seg.DiscontinuitySequence)
+		if key := m3u8.Keys[seg.KeyIndex]; key != nil {
+			fmt.Fprintf(h, "|%s|%s|%x", key.Method, stripQuery(key.URI), key.IV)
+		}
+		if seg.Map != nil {
+			fmt.Fprintf(h, "|%s|%d@%d", stripQuery(seg.Map.URI), seg.Map.Length, seg.Map.Offset)
+		}
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// stripQuery drops the query string of a URL
+func stripQuery(u string) string {
+	u, _, _ = strings.Cut(u, "?")
+	return u
+}
+
+// pending returns the indexes that are not done yet
+func (s *taskState) pending(indexes []int) []int {
+	if s == nil || len(s.done) == 0 {
+		return indexes
+	}
+	var left []int
+	for _, idx := range indexes {
+		if !s.done[idx] {
+			left = append(left, idx)
+		}
+	}
+	return left
+}
+
+// record appends a stored segment to the state file
+func (s *taskState) record(idx int, sequence uint64, data []byte) error {
+	if s == nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return s.write(stateEntry{Index: idx, Sequence: sequence, Size: len(data), SHA256: hex.EncodeToString(sum[:])})
+}
+
+// write appends a line to the state file
+func (s *taskState) write(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+	return nil
+}
+
+// close closes the state file, the work folder is removed with it after merging
+func (s *taskState) close() {
+	if s != nil && s.file != nil {
+		s.file.Close()
+	}
+}
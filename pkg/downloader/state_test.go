@@ -0,0 +1,171 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"loki/pkg/tools"
+)
+
+// resumeServer serves mediaPlaylist(0, 3, true) and counts the requests of every segment
+func resumeServer(t *testing.T) (*Task, func(seq int) int) {
+	t.Helper()
+	var (
+		lock     sync.Mutex
+		requests = make(map[string]int)
+	)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, mediaPlaylist(0, 3, true))
+	}, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests[r.URL.Path]++
+		lock.Unlock()
+		segmentHandler(w, r)
+	})
+	return testTask(t, server), func(seq int) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests[fmt.Sprintf("/s%d.ts", seq)]
+	}
+}
+
+// writeWorkFolder leaves the work folder of an interrupted run of task: the stored segments and a
+// state file made of a header with fingerprint and the given lines
+func writeWorkFolder(t *testing.T, task *Task, fingerprint string, segments map[int][]byte, lines ...string) {
+	t.Helper()
+	folder := filepath.Join(task.OutputFilePath, tsFolderName)
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for idx, data := range segments {
+		if err := os.WriteFile(filepath.Join(folder, tools.ResolveTSFilename(idx)), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	header, _ := json.Marshal(stateHeader{
+		Source:      stripQuery(task.M3U8URL),
+		Playlist:    stripQuery(task.M3U8URL),
+		Fingerprint: fingerprint,
+	})
+	content := string(header) + "\n" + strings.Join(lines, "")
+	if err := os.WriteFile(filepath.Join(folder, stateFileName), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// entryLine returns the state file line of segment idx stored with data
+func entryLine(idx int, data []byte) string {
+	sum := sha256.Sum256(data)
+	line, _ := json.Marshal(stateEntry{Index: idx, Sequence: uint64(idx), Size: len(data), SHA256: hex.EncodeToString(sum[:])})
+	return string(line) + "\n"
+}
+
+// fingerprint returns the playlist fingerprint of mediaPlaylist(0, 3, true)
+func fingerprint(t *testing.T) string {
+	t.Helper()
+	return playlistFingerprint(parseTestPlaylist(t, mediaPlaylist(0, 3, true)))
+}
+
+func TestResumeSkipsFinishedSegments(t *testing.T) {
+	// Arrange
+	task, requests := resumeServer(t)
+	s0, s1 := tsSegment(0), tsSegment(4)
+	writeWorkFolder(t, task, fingerprint(t), map[int][]byte{0: s0, 1: s1}, entryLine(0, s0), entryLine(1, s1))
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for seq, want := range []int{0, 0, 1, 1} {
+		if got := requests(seq); got != want {
+			t.Errorf("Expected %d requests of segment %d, got %d", want, seq, got)
+		}
+	}
+	if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, []float64{0, 4, 8, 12}) {
+		t.Errorf("Expected segments 0-3, got %v", got)
+	}
+}
+
+func TestResumeRefetchesDamagedSegments(t *testing.T) {
+	// Arrange
+	task, requests := resumeServer(t)
+	s0, s1, s2 := tsSegment(0), tsSegment(4), tsSegment(8)
+	corrupted := tsSegment(40) // same size, other bytes
+	writeWorkFolder(t, task, fingerprint(t), map[int][]byte{0: s0[:100], 1: corrupted, 2: s2},
+		entryLine(0, s0), entryLine(1, s1), entryLine(2, s2))
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for seq, want := range []int{1, 1, 0, 1} {
+		if got := requests(seq); got != want {
+			t.Errorf("Expected %d requests of segment %d, got %d", want, seq, got)
+		}
+	}
+	if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, []float64{0, 4, 8, 12}) {
+		t.Errorf("Expected segments 0-3, got %v", got)
+	}
+}
+
+func TestResumeToleratesCutLastLine(t *testing.T) {
+	// Arrange
+	task, requests := resumeServer(t)
+	s0, s1 := tsSegment(0), tsSegment(4)
+	cut := entryLine(1, s1)
+	writeWorkFolder(t, task, fingerprint(t), map[int][]byte{0: s0, 1: s1}, entryLine(0, s0), cut[:len(cut)/2])
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for seq, want := range []int{0, 1, 1, 1} {
+		if got := requests(seq); got != want {
+			t.Errorf("Expected %d requests of segment %d, got %d", want, seq, got)
+		}
+	}
+	if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, []float64{0, 4, 8, 12}) {
+		t.Errorf("Expected segments 0-3, got %v", got)
+	}
+}
+
+func TestResumeRejectsChangedPlaylist(t *testing.T) {
+	// Arrange
+	task, requests := resumeServer(t)
+	s0 := tsSegment(0)
+	writeWorkFolder(t, task, "another playlist", map[int][]byte{0: s0}, entryLine(0, s0))
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err == nil || !strings.Contains(err.Error(), "playlist changed") {
+		t.Fatalf("Expected the changed playlist to be rejected, got %v", err)
+	}
+	for seq := 0; seq < 4; seq++ {
+		if got := requests(seq); got != 0 {
+			t.Errorf("Expected no request of segment %d, got %d", seq, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(task.OutputFilePath, tsFolderName, tools.ResolveTSFilename(0))); err != nil {
+		t.Errorf("Expected the work folder to be left alone, got %v", err)
+	}
+}
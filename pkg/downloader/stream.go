@@ -0,0 +1,120 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"loki/pkg/tools"
+)
+
+// streamBuffer returns the bytes a streaming download holds in memory
+func (t *Task) streamBuffer() int {
+	if t.StreamBuffer > 0 {
+		return t.StreamBuffer
+	}
+	return defaultStreamBuffer
+}
+
+// openStream creates the output of a streaming download. Timestamps are rewritten on the same
+// terms as merge, a live playlist may reach a discontinuity later so it is always ready to.
+func (d *Downloader) openStream(task *Task) error {
+	rewrite := d.discontinuity != DiscontinuityConcat &&
+		(isLive(d.result.M3U8) || len(d.discontinuityRanges()) > 1 || len(d.cuts) > 0)
+	out, err := newMergeWriter(filepath.Join(d.outputFilePath, d.outputFileName), rewrite)
+	if err != nil {
+		return err
+	}
+	d.stream = &streamer{
+		out:     out,
+		pending: make(map[int][]byte),
+		spilled: make(map[int]bool),
+		limit:   task.streamBuffer(),
+	}
+	return nil
+}
+
+// streamSegment takes the decoded data of a segment and writes every segment whose turn has come
+func (d *Downloader) streamSegment(segIndex int, data []byte) error {
+	s := d.stream
+	if segIndex != s.next && s.buffered+len(data) > s.limit {
+		path := filepath.Join(d.tsFolder, tools.ResolveTSFilename(segIndex))
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			return fmt.Errorf("spill segment %d: %w", segIndex, err)
+		}
+		s.spilled[segIndex] = true
+	} else {
+		s.pending[segIndex] = data
+		s.buffered += len(data)
+	}
+	d.flushStream()
+	return nil
+}
+
+// flushStream writes the segments that are next in playlist order, from memory or from the work
+// folder. Segments given up under Task.OnFailure are left out or filled like merge does.
+func (d *Downloader) flushStream() {
+	s := d.stream
+	for s.next < d.segLen {
+		idx := s.next
+		var (
+			data []byte
+			err  error
+		)
+		if buffered, ok := s.pending[idx]; ok {
+			data = buffered
+			delete(s.pending, idx)
+			s.buffered -= len(data)
+		} else if s.spilled[idx] {
+			path := filepath.Join(d.tsFolder, tools.ResolveTSFilename(idx))
+			data, err = os.ReadFile(path)
+			os.Remove(path)
+			delete(s.spilled, idx)
+		} else if d.failed[idx] {
+			err = os.ErrNotExist
+		} else {
+			return
+		}
+		d.appendSegment(s.out, idx, data, err)
+		s.next++
+	}
+}
+
+// endStream closes the output of a streaming download once err is known. A canceled download keeps
+// the segments written so far when Task.Partial is set, otherwise an incomplete output is removed.
+func (d *Downloader) endStream(task *Task, err error) error {
+	s := d.stream
+	path := s.out.file.Name()
+	closeErr := s.out.close()
+	if err := os.RemoveAll(d.tsFolder); err != nil {
+		fmt.Printf("[warning] Failed to remove temporary folder %s: %s\n", d.tsFolder, err.Error())
+	}
+
+	var canceled *CanceledError
+	partial := errors.As(err, &canceled) && task.Partial != "" && s.out.merged > 0
+	if closeErr != nil || err != nil && !partial {
+		os.Remove(path)
+		if err != nil {
+			return err
+		}
+		return closeErr
+	}
+
+	d.outputs = []string{path}
+	fmt.Printf("\n[output] %s\n", path)
+	if partial {
+		// The output holds the segments before the first one still missing
+		done := make([]bool, s.next)
+		for idx := range done {
+			done[idx] = !d.failed[idx]
+		}
+		canceled.Outputs = d.outputs
+		d.printCovered(done, s.out.merged, d.segLen)
+		return canceled
+	}
+	if task.SkipAds {
+		return d.writeAdReport()
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamReordersSpilledSegments(t *testing.T) {
+	// Arrange
+	var (
+		task    *Task
+		lock    sync.Mutex
+		spilled int
+	)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, mediaPlaylist(0, 7, true))
+	}, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/s0.ts" {
+			// Segment 0 arrives last, two of the others fit in the buffer and five are spilled
+			lock.Lock()
+			defer lock.Unlock()
+			folder := filepath.Join(task.OutputFilePath, tsFolderName)
+			for deadline := time.Now().Add(5 * time.Second); spilled < 5 && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+				files, _ := os.ReadDir(folder)
+				spilled = len(files)
+			}
+		}
+		segmentHandler(w, r)
+	})
+	task = testTask(t, server)
+	task.Stream = true
+	task.StreamBuffer = 2 * 188
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if spilled != 5 {
+		t.Errorf("Expected 5 segments spilled while segment 0 was missing, got %d", spilled)
+	}
+	want := []float64{0, 4, 8, 12, 16, 20, 24, 28}
+	if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, want) {
+		t.Errorf("Expected segments in playlist order %v, got %v", want, got)
+	}
+	if _, err := os.Stat(filepath.Join(task.OutputFilePath, tsFolderName)); !os.IsNotExist(err) {
+		t.Errorf("Expected the spill folder to be removed, got %v", err)
+	}
+}
+
+func TestStreamFailurePolicies(t *testing.T) {
+	tests := []struct {
+		policy FailurePolicy
+		times  []float64 // output segments, nil when the task fails
+	}{
+		{FailureFail, nil},
+		{FailureSkip, []float64{0, 4, 12, 16, 20}},
+		{FailureFill, []float64{0, 4, 8, 12, 16, 20}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			// Arrange
+			server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, mediaPlaylist(0, 5, true))
+			}, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/s2.ts" {
+					http.NotFound(w, r)
+					return
+				}
+				segmentHandler(w, r)
+			})
+			task := testTask(t, server)
+			task.Stream = true
+			task.StreamBuffer = 188
+			task.OnFailure = tt.policy
+
+			// Act
+			err := New().Start(context.Background(), task)
+
+			// Assert
+			if _, err := os.Stat(filepath.Join(task.OutputFilePath, tsFolderName)); !os.IsNotExist(err) {
+				t.Errorf("Expected the spill folder to be removed, got %v", err)
+			}
+			if tt.times == nil {
+				if err == nil {
+					t.Fatal("Expected the task to fail on segment 2")
+				}
+				if _, err := os.Stat(filepath.Join(task.OutputFilePath, task.OutputFileName)); !os.IsNotExist(err) {
+					t.Errorf("Expected the incomplete output to be removed, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, tt.times) {
+				t.Errorf("Expected segments at %v, got %v", tt.times, got)
+			}
+		})
+	}
+}
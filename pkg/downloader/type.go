@@ -1,24 +1,170 @@
 package downloader
 
 import (
+	"bufio"
+	"loki/pkg/media"
 	"loki/pkg/parser"
+	"os"
 	"sync"
+	"time"
 )
 
+// DiscontinuityMode is how segments on both sides of an EXT-X-DISCONTINUITY are merged
+type DiscontinuityMode string
+
+// FailurePolicy is what happens to a segment that is out of retries
+type FailurePolicy string
+
+// PartialMode is what a canceled download merges from the segments it completed
+type PartialMode string
+
 // Downloader model
 type Downloader struct {
-	lock  sync.Mutex
-	queue []int
+	groups map[int][]int // first segment index to the adjacent byte ranges fetched with it
 
-	tsFolder string
+	tsFolder  string
+	initFiles map[string]string           // EXT-X-MAP key to the downloaded init section
+	protected map[string]media.Protection // EXT-X-MAP key to the SAMPLE-AES track encryption
 
 	outputFilePath string
 	outputFileName string
 
-	finish int32
+	finish int // segments stored, counted by the loop of downloadSegments
 	segLen int
 
+	result   *parser.Result // latest playlist, reloaded while recording live streams
+	segments []*segment
+	media    *parser.Media // set when downloading an EXT-X-MEDIA rendition
+	gaps     []gap
+
+	discontinuity DiscontinuityMode
+	trim          *clip // set when the merged output is cut at exact timestamps
+
+	ads      *adReport                // segments removed by Task.SkipAds
+	cuts     map[*parser.Segment]bool // first segments kept after a removed ad break
+	skipping bool                     // the last segment seen was removed
+
+	keepEncrypted bool // store segments and init sections as downloaded, used when mirroring
+
+	state *taskState // journal of completed segments, nil for live playlists
+
+	preferred int              // backup playlist segments are fetched from after a failover, 0 for none
+	opts      *parser.Options  // options backup playlists are reloaded with
+	backups   []*parser.Result // Result.Backups as last reloaded, only the download loop touches them
+
+	attempts  map[int]int   // failed fetches of a segment on its current playlist, reset when it moves
+	failed    map[int]bool  // segments given up under Task.OnFailure, left out or filled when merging
+	fatal     error         // failure of a segment that stops the task under FailureFail
+	onFailure FailurePolicy // Task.OnFailure of the download
+
+	progress *progress     // set when several playlists download at once, replaces the progress bar
+	limit    chan struct{} // segment requests in flight across the playlists of a ladder download
+	outputs  []string      // files written by merge
+	partial  bool          // merging what a canceled download completed, missing segments are expected
+	stream   *streamer     // set when segments are appended to the output while they download
+}
+
+// fetchJob is a segment handed to a worker, with the byte ranges fetched in the same request
+type fetchJob struct {
+	index  int
+	group  []int     // index first
+	segs   []segment // copies of the segments of group, taken when the job was queued
+	stream bool      // hand the decoded data back instead of storing it
+}
+
+// fetchResult is what a worker reports once it is done with a job
+type fetchResult struct {
+	fetchJob
+	datas [][]byte // decoded segments of the group when streaming
+	err   error
+}
+
+// backupReload is a live backup playlist parsed again because it did not list a failing segment yet
+type backupReload struct {
+	n      int            // backup playlist, counted from 1
+	url    string         // URL of the backup playlist
+	index  int            // segment waiting for the reload
+	cause  error          // failure the segment moves for
+	result *parser.Result // reloaded playlist, nil when err is set
+	err    error
+}
+
+// mergeWriter appends segments to an output file in playlist order
+type mergeWriter struct {
+	file     *os.File
+	writer   *bufio.Writer
+	rewrite  bool // shift timestamps after discontinuities so the timeline stays continuous
+	tl       timeline
+	lastInit string // EXT-X-MAP key of the init section written last
+	merged   int
+
+	last         []byte // stored data of the previous segment, repeated by FailureFill
+	lastDuration float32
+}
+
+// streamer appends segments to the output of a streaming download in playlist order. Segments done
+// before their turn wait in memory up to limit bytes, beyond it they are spilled to the work folder.
+type streamer struct {
+	out      *mergeWriter
+	next     int // index of the segment written next
+	pending  map[int][]byte
+	spilled  map[int]bool
+	buffered int // bytes held in pending
+	limit    int
+}
+
+// segment is a media segment together with the playlist it was listed in
+type segment struct {
+	*parser.Segment
 	result *parser.Result
+	cut    bool // segments right before it were removed, its timestamps do not follow the previous one
+	source int  // 0 for the playlist it was listed in, n when fetched from the n-th backup of it
+}
+
+// progress reports the progress of one playlist of a ladder download as lines, progress bars
+// of playlists downloaded side by side would overwrite each other
+type progress struct {
+	lock  sync.Mutex
+	label string
+	stage string
+	step  int
+}
+
+// taskState is the journal of a VOD download kept in the work folder so an interrupted run can resume.
+// The file starts with a stateHeader line followed by a stateEntry line per completed segment.
+type taskState struct {
+	lock sync.Mutex
+	file *os.File
+	done map[int]bool // segment indexes completed by an earlier run and still intact
+}
+
+// stateHeader identifies the task and the playlist a state file belongs to
+type stateHeader struct {
+	Source      string `json:"source"`            // task URL without its query
+	Playlist    string `json:"playlist"`          // media playlist URL without its query
+	Variant     string `json:"variant,omitempty"` // chosen EXT-X-STREAM-INF
+	Fingerprint string `json:"fingerprint"`       // hash of the segment list, see playlistFingerprint
+}
+
+// stateEntry is a segment stored in the work folder
+type stateEntry struct {
+	Index    int    `json:"index"`
+	Sequence uint64 `json:"sequence"`
+	Size     int    `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// CanceledError is returned by Start when its context is done before the download finished
+type CanceledError struct {
+	Cause      error    // context.Canceled or context.DeadlineExceeded
+	WorkFolder string   // folder a VOD download resumes from, empty when there is nothing to resume
+	Outputs    []string // files merged from the completed segments when Task.Partial is set
+}
+
+// gap is a range of media sequence numbers that left the live window before they were fetched
+type gap struct {
+	from uint64
+	to   uint64
 }
 
 // Task model
@@ -27,4 +173,29 @@ type Task struct {
 	OutputFilePath string
 	OutputFileName string
 	Concurrency    int
+	Variant        parser.VariantSelector
+	Languages      []string           // audio and subtitle languages to fetch, e.g. en, fr
+	MaxDuration    time.Duration      // stop recording a live playlist after this long, 0 records until EXT-X-ENDLIST
+	LowLatency     bool               // follow EXT-X-PART with blocking playlist reloads when the server supports it
+	KeyProvider    parser.KeyProvider // where EXT-X-KEY keys come from, fetched over HTTP when nil
+	IV             []byte             // overrides the IV of every EXT-X-KEY when set
+	Discontinuity  DiscontinuityMode  // rewrite, split or concat, rewrite when empty
+	Start          time.Time          // only fetch segments whose EXT-X-PROGRAM-DATE-TIME range ends after Start
+	End            time.Time          // only fetch segments whose EXT-X-PROGRAM-DATE-TIME is before End
+	From           time.Duration      // VOD only: skip segments that end before this offset into the playlist
+	To             time.Duration      // VOD only: skip segments that start at or after this offset, 0 means the end
+	ExactTrim      bool               // cut the first and last MPEG-TS segment at the From and To timestamps
+	SkipAds        bool               // drop segments inside ad breaks and write a JSON report of them
+	Lenient        bool               // skip playlist lines that cannot be parsed instead of failing
+	Mirror         bool               // save playlists, segments, init sections and keys instead of merging
+	MirrorAll      bool               // mirror every variant and rendition of the master playlist, not only the chosen ones
+	MirrorDecrypt  bool               // mirror decrypted segments and drop EXT-X-KEY instead of keeping them encrypted
+	Ladder         bool               // download every variant and rendition of the master playlist at once, sharing Concurrency
+	Partial        PartialMode        // what to merge when the context is canceled: prefix, all, nothing when empty
+	Retries        int                // fetch attempts per segment before OnFailure applies, DefaultRetries when 0
+	OnFailure      FailurePolicy      // fail the task, skip the segment or fill its place, fail when empty
+	Stream         bool               // append segments to the output while they download instead of merging stored files afterwards
+	StreamBuffer   int                // bytes of segments waiting for their turn in memory when streaming, defaultStreamBuffer when 0
+
+	opts *parser.Options // built once so the key cache outlives playlist reloads
 }
@@ -0,0 +1,55 @@
+package downloader
+
+import (
+	"errors"
+	"time"
+
+	"loki/pkg/parser"
+)
+
+// hasWindow reports whether the task is limited to a wall-clock range
+func (t *Task) hasWindow() bool {
+	return !t.Start.IsZero() || !t.End.IsZero()
+}
+
+// window keeps the segments whose EXT-X-PROGRAM-DATE-TIME range overlaps [Task.Start, Task.End).
+// Segments without a date cannot be placed and are dropped.
+func (t *Task) window(segs []*parser.Segment) []*parser.Segment {
+	if !t.hasWindow() {
+		return segs
+	}
+	var kept []*parser.Segment
+	for _, seg := range segs {
+		if seg.ProgramDateTime.IsZero() {
+			continue
+		}
+		end := seg.ProgramDateTime.Add(segmentDuration(seg))
+		if (t.Start.IsZero() || end.After(t.Start)) && (t.End.IsZero() || seg.ProgramDateTime.Before(t.End)) {
+			kept = append(kept, seg)
+		}
+	}
+	return kept
+}
+
+// pastWindow reports whether the segment starts at or after Task.End, so later ones will too
+func (t *Task) pastWindow(seg *parser.Segment) bool {
+	return !t.End.IsZero() && !seg.ProgramDateTime.IsZero() && !seg.ProgramDateTime.Before(t.End)
+}
+
+// checkProgramDateTime fails when a wall-clock range is asked for a playlist without dates
+func (t *Task) checkProgramDateTime(m3u8 *parser.M3U8) error {
+	if !t.hasWindow() || len(m3u8.Segments) == 0 {
+		return nil
+	}
+	for _, seg := range m3u8.Segments {
+		if !seg.ProgramDateTime.IsZero() {
+			return nil
+		}
+	}
+	return errors.New("start and end times need EXT-X-PROGRAM-DATE-TIME, the playlist has none")
+}
+
+// segmentDuration returns the EXTINF duration of the segment
+func segmentDuration(seg *parser.Segment) time.Duration {
+	return time.Duration(float64(seg.Duration) * float64(time.Second))
+}
@@ -0,0 +1,103 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// programStart is the EXT-X-PROGRAM-DATE-TIME of media sequence 0 in datedPlaylist
+var programStart = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// datedPlaylist is mediaPlaylist with every segment dated 4 seconds after the previous one
+func datedPlaylist(first, last int, endList bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-TARGETDURATION:0.05\n#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	for seq := first; seq <= last; seq++ {
+		date := programStart.Add(time.Duration(seq) * 4 * time.Second)
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n#EXTINF:4,\ns%d.ts\n", date.Format(time.RFC3339Nano), seq)
+	}
+	if endList {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String()
+}
+
+func TestWallClockWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		reloads    []string
+		start, end time.Duration
+		want       []float64
+	}{
+		{"range inside the playlist", []string{datedPlaylist(0, 5, true)}, 5 * time.Second, 13 * time.Second, []float64{4, 8, 12}},
+		{"open start", []string{datedPlaylist(0, 5, true)}, 0, 8 * time.Second, []float64{0, 4}},
+		{
+			"end before the live edge",
+			// Segment 3 starts after the end, the recording stops without waiting for ENDLIST
+			[]string{datedPlaylist(0, 2, false), datedPlaylist(1, 3, false)},
+			0, 10 * time.Second, []float64{0, 4, 8},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Arrange
+			var (
+				lock   sync.Mutex
+				served int
+			)
+			server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				defer lock.Unlock()
+				if served >= len(tt.reloads) {
+					t.Errorf("Expected no reload after the end time, got reload %d", served)
+					http.NotFound(w, r)
+					return
+				}
+				fmt.Fprint(w, tt.reloads[served])
+				served++
+			}, segmentHandler)
+			task := testTask(t, server)
+			task.Discontinuity = DiscontinuityConcat
+			if tt.start > 0 {
+				task.Start = programStart.Add(tt.start)
+			}
+			task.End = programStart.Add(tt.end)
+
+			// Act
+			err := New().Start(context.Background(), task)
+
+			// Assert
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if got := segmentTimes(t, readOutput(t, task)); !equalTimes(got, tt.want) {
+				t.Errorf("Expected segments at %v, got %v", tt.want, got)
+			}
+			if served != len(tt.reloads) {
+				t.Errorf("Expected %d playlist loads, got %d", len(tt.reloads), served)
+			}
+		})
+	}
+}
+
+func TestWallClockWindowNeedsProgramDateTime(t *testing.T) {
+	// Arrange
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, mediaPlaylist(0, 2, true))
+	}, segmentHandler)
+	task := testTask(t, server)
+	task.Start = programStart
+
+	// Act
+	err := New().Start(context.Background(), task)
+
+	// Assert
+	if err == nil || !strings.Contains(err.Error(), "EXT-X-PROGRAM-DATE-TIME") {
+		t.Errorf("Expected an error about missing EXT-X-PROGRAM-DATE-TIME, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package media
+
+// MPEG-TS
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	patPID       = 0x0000
+	nullPID      = 0x1fff
+
+	// Stream types of SAMPLE-AES elementary streams and their clear counterparts
+	streamTypeH264          = 0x1b
+	streamTypeAAC           = 0x0f
+	streamTypeAC3           = 0x81
+	streamTypeEAC3          = 0x87
+	streamTypeH264SampleAES = 0xdb
+	streamTypeAACSampleAES  = 0xcf
+	streamTypeAC3SampleAES  = 0xc1
+	streamTypeEAC3SampleAES = 0xc2
+
+	clock90kHz = 90000 // PTS and DTS units
+
+	descriptorRegistration     = 0x05
+	descriptorPrivateIndicator = 0x0f
+)
+
+// SAMPLE-AES
+const (
+	blockSize           = 16
+	nalClearLeader      = 32  // the first 32 bytes of an encrypted NAL unit stay clear
+	nalMinEncrypted     = 48  // NAL units up to this size are not encrypted
+	nalClearStride      = 144 // nine clear blocks follow every encrypted block
+	audioClearLeader    = 16  // the first 16 bytes of an audio frame after its header stay clear
+	h264NALSlice        = 1
+	h264NALIDRSlice     = 5
+	adtsHeaderSize      = 7
+	adtsHeaderSizeCRC   = 9
+	ac3SyncWord         = 0x0b77
+	ac3MaxBSID          = 10
+	schemeCBCS          = "cbcs"
+	sencSubsamples      = 0x02
+	tfhdBaseDataOffset  = 0x000001
+	tfhdSampleDescIndex = 0x000002
+	tfhdDefaultDuration = 0x000008
+	tfhdDefaultSize     = 0x000010
+	trunDataOffset      = 0x000001
+	trunFirstFlags      = 0x000004
+	trunDuration        = 0x000100
+	trunSize            = 0x000200
+	trunFlags           = 0x000400
+	trunCTO             = 0x000800
+)
+
+// ac3FrameWords is the AC-3 syncframe size in 16-bit words by frmsizecod and fscod (48, 44.1 and 32 kHz)
+var ac3FrameWords = [38][3]int{
+	{64, 69, 96}, {64, 70, 96}, {80, 87, 120}, {80, 88, 120},
+	{96, 104, 144}, {96, 105, 144}, {112, 121, 168}, {112, 122, 168},
+	{128, 139, 192}, {128, 140, 192}, {160, 174, 240}, {160, 175, 240},
+	{192, 208, 288}, {192, 209, 288}, {224, 243, 336}, {224, 244, 336},
+	{256, 278, 384}, {256, 279, 384}, {320, 348, 480}, {320, 349, 480},
+	{384, 417, 576}, {384, 418, 576}, {448, 487, 672}, {448, 488, 672},
+	{512, 557, 768}, {512, 558, 768}, {640, 696, 960}, {640, 697, 960},
+	{768, 835, 1152}, {768, 836, 1152}, {896, 975, 1344}, {896, 976, 1344},
+	{1024, 1114, 1536}, {1024, 1115, 1536}, {1152, 1253, 1728}, {1152, 1254, 1728},
+	{1280, 1393, 1920}, {1280, 1394, 1920},
+}
+
+// clearStreamTypes maps SAMPLE-AES stream types to the stream type of the decrypted stream
+var clearStreamTypes = map[byte]byte{
+	streamTypeH264SampleAES: streamTypeH264,
+	streamTypeAACSampleAES:  streamTypeAAC,
+	streamTypeAC3SampleAES:  streamTypeAC3,
+	streamTypeEAC3SampleAES: streamTypeEAC3,
+}
+
+// sampleAESFormats are the private data indicators and registration formats of SAMPLE-AES streams
+var sampleAESFormats = map[string]bool{
+	"zavc": true,
+	"aacd": true,
+	"ac3d": true,
+	"ec3d": true,
+	"apad": true,
+}
@@ -0,0 +1,472 @@
+package media
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ClearInit reads the track encryption of an fMP4 init section and rewrites it in place so it
+// describes clear media: encv and enca entries get their original format back and the sinf and
+// pssh boxes become free boxes. Box sizes do not change.
+func ClearInit(init []byte) (Protection, error) {
+	top, err := readBoxes(init, 0, len(init))
+	if err != nil {
+		return nil, err
+	}
+	moov := findBox(top, "moov")
+	if moov == nil {
+		return nil, errors.New("init section has no moov box")
+	}
+
+	protection := make(Protection)
+	children, err := readBoxes(init, moov.start+moov.header, moov.end)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range children {
+		switch b.typ {
+		case "pssh":
+			renameBox(init, b, "free")
+		case "trak":
+			trackID, te, err := clearTrack(init, b)
+			if err != nil {
+				return nil, err
+			}
+			if te != nil {
+				protection[trackID] = te
+			}
+		}
+	}
+	return protection, nil
+}
+
+// readTrackID returns the track ID from the tkhd box of a trak box
+func readTrackID(data []byte, trak box) (uint32, error) {
+	tkhd, err := boxPath(data, trak, "tkhd")
+	if err != nil {
+		return 0, err
+	}
+	if tkhd == nil {
+		return 0, errors.New("trak has no tkhd box")
+	}
+	body := data[tkhd.start+tkhd.header : tkhd.end]
+	idOffset := 12
+	if len(body) > 0 && body[0] == 1 {
+		idOffset = 20
+	}
+	if len(body) < idOffset+4 {
+		return 0, errors.New("truncated tkhd box")
+	}
+	return binary.BigEndian.Uint32(body[idOffset:]), nil
+}
+
+// clearTrack clears the protected sample entries of a trak box
+func clearTrack(data []byte, trak box) (uint32, *TrackEncryption, error) {
+	trackID, err := readTrackID(data, trak)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	stsd, err := boxPath(data, trak, "mdia", "minf", "stbl", "stsd")
+	if err != nil || stsd == nil {
+		return trackID, nil, err
+	}
+	// full box header and entry count come before the sample entries
+	entries, err := readBoxes(data, stsd.start+stsd.header+8, stsd.end)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var te *TrackEncryption
+	for _, entry := range entries {
+		var fixed int
+		switch entry.typ {
+		case "encv":
+			fixed = 78 // VisualSampleEntry fields
+		case "enca":
+			fixed = 28 // AudioSampleEntry fields
+		default:
+			continue
+		}
+		boxes, err := readBoxes(data, entry.start+entry.header+fixed, entry.end)
+		if err != nil {
+			return 0, nil, err
+		}
+		sinf := findBox(boxes, "sinf")
+		if sinf == nil {
+			continue
+		}
+		format, enc, err := readSinf(data, *sinf)
+		if err != nil {
+			return 0, nil, err
+		}
+		renameBox(data, entry, format)
+		renameBox(data, *sinf, "free")
+		te = enc
+	}
+	return trackID, te, nil
+}
+
+// readSinf returns the original format and the track encryption of a sinf box
+func readSinf(data []byte, sinf box) (string, *TrackEncryption, error) {
+	children, err := readBoxes(data, sinf.start+sinf.header, sinf.end)
+	if err != nil {
+		return "", nil, err
+	}
+	frma := findBox(children, "frma")
+	if frma == nil || frma.end-frma.start < frma.header+4 {
+		return "", nil, errors.New("sinf has no frma box")
+	}
+	format := string(data[frma.start+frma.header : frma.start+frma.header+4])
+
+	te := new(TrackEncryption)
+	if schm := findBox(children, "schm"); schm != nil && schm.end-schm.start >= schm.header+8 {
+		te.Scheme = string(data[schm.start+schm.header+4 : schm.start+schm.header+8])
+	}
+	tenc, err := boxPath(data, sinf, "schi", "tenc")
+	if err != nil {
+		return "", nil, err
+	}
+	if tenc == nil {
+		return format, nil, nil
+	}
+
+	body := data[tenc.start+tenc.header : tenc.end]
+	if len(body) < 24 {
+		return "", nil, errors.New("truncated tenc box")
+	}
+	if body[0] > 0 {
+		te.CryptByteBlock = int(body[5] >> 4)
+		te.SkipByteBlock = int(body[5] & 0x0f)
+	}
+	te.IsProtected = body[6] == 1
+	te.IVSize = int(body[7])
+	if te.IsProtected && te.IVSize == 0 && len(body) > 24 {
+		size := int(body[24])
+		if len(body) < 25+size {
+			return "", nil, errors.New("truncated tenc constant IV")
+		}
+		te.ConstantIV = append([]byte(nil), body[25:25+size]...)
+	}
+	return format, te, nil
+}
+
+// DecryptFragment decrypts the cbcs protected samples of an fMP4 fragment in place. Sample IVs come
+// from senc, the tenc constant IV or, failing both, iv from the playlist. The senc, saiz, saio and
+// pssh boxes are turned into free boxes so players do not expect encrypted samples.
+func DecryptFragment(fragment []byte, protection Protection, key, iv []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	top, err := readBoxes(fragment, 0, len(fragment))
+	if err != nil {
+		return err
+	}
+	for _, moof := range top {
+		if moof.typ != "moof" {
+			continue
+		}
+		children, err := readBoxes(fragment, moof.start+moof.header, moof.end)
+		if err != nil {
+			return err
+		}
+		for _, b := range children {
+			switch b.typ {
+			case "pssh":
+				renameBox(fragment, b, "free")
+			case "traf":
+				if err := decryptTraf(fragment, moof, b, protection, block, iv); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// decryptTraf decrypts the samples described by one traf box
+func decryptTraf(data []byte, moof, traf box, protection Protection, block cipher.Block, iv []byte) error {
+	children, err := readBoxes(data, traf.start+traf.header, traf.end)
+	if err != nil {
+		return err
+	}
+	tfhd := findBox(children, "tfhd")
+	if tfhd == nil {
+		return errors.New("traf has no tfhd box")
+	}
+	body := data[tfhd.start+tfhd.header : tfhd.end]
+	if len(body) < 8 {
+		return errors.New("truncated tfhd box")
+	}
+	flags := binary.BigEndian.Uint32(body) & 0xffffff
+	trackID := binary.BigEndian.Uint32(body[4:])
+	te := protection[trackID]
+	if te == nil || !te.IsProtected {
+		return nil
+	}
+	if te.Scheme != schemeCBCS {
+		return fmt.Errorf("unsupported protection scheme %q, only cbcs is SAMPLE-AES", te.Scheme)
+	}
+
+	base := moof.start
+	defaultSize := 0
+	pos := 8
+	if flags&tfhdBaseDataOffset != 0 {
+		base = int(binary.BigEndian.Uint64(body[pos:]))
+		pos += 8
+	}
+	if flags&tfhdSampleDescIndex != 0 {
+		pos += 4
+	}
+	if flags&tfhdDefaultDuration != 0 {
+		pos += 4
+	}
+	if flags&tfhdDefaultSize != 0 && len(body) >= pos+4 {
+		defaultSize = int(binary.BigEndian.Uint32(body[pos:]))
+	}
+
+	// Sample locations from every trun, in order
+	var samples [][2]int
+	next := base
+	for _, b := range children {
+		if b.typ != "trun" {
+			continue
+		}
+		runSamples, end, err := readTrun(data[b.start+b.header:b.end], base, next, defaultSize)
+		if err != nil {
+			return err
+		}
+		samples = append(samples, runSamples...)
+		next = end
+	}
+
+	senc := findBox(children, "senc")
+	var entries []sencEntry
+	if senc != nil {
+		entries, err = readSenc(data[senc.start+senc.header:senc.end], te.IVSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, s := range samples {
+		if s[0] < 0 || s[1] > len(data) {
+			return fmt.Errorf("sample %d is outside of the fragment", i)
+		}
+		sampleIV := te.ConstantIV
+		var subsamples [][2]int
+		if i < len(entries) {
+			if len(entries[i].iv) > 0 {
+				sampleIV = entries[i].iv
+			}
+			subsamples = entries[i].subsamples
+		}
+		if len(sampleIV) == 0 {
+			sampleIV = iv
+		}
+		sampleIV = padIV(sampleIV)
+
+		sample := data[s[0]:s[1]]
+		if len(subsamples) == 0 {
+			decryptPattern(sample, block, sampleIV, te.CryptByteBlock, te.SkipByteBlock)
+			continue
+		}
+		off := 0
+		for _, sub := range subsamples {
+			off += sub[0]
+			end := min(off+sub[1], len(sample))
+			if off >= end {
+				break
+			}
+			decryptPattern(sample[off:end], block, sampleIV, te.CryptByteBlock, te.SkipByteBlock)
+			off = end
+		}
+	}
+
+	for _, b := range children {
+		switch b.typ {
+		case "senc", "saiz", "saio":
+			renameBox(data, b, "free")
+		case "sbgp", "sgpd":
+			// sample groups of type seig carry per-sample key IDs
+			if b.end-b.start >= b.header+8 && string(data[b.start+b.header+4:b.start+b.header+8]) == "seig" {
+				renameBox(data, b, "free")
+			}
+		}
+	}
+	return nil
+}
+
+// sencEntry is the per-sample IV and subsample map of a senc box
+type sencEntry struct {
+	iv         []byte
+	subsamples [][2]int // clear and protected byte counts
+}
+
+// readSenc parses the body of a senc box
+func readSenc(body []byte, ivSize int) ([]sencEntry, error) {
+	if len(body) < 8 {
+		return nil, errors.New("truncated senc box")
+	}
+	flags := binary.BigEndian.Uint32(body) & 0xffffff
+	count := int(binary.BigEndian.Uint32(body[4:]))
+	pos := 8
+	entries := make([]sencEntry, 0, count)
+	for i := 0; i < count; i++ {
+		if pos+ivSize > len(body) {
+			return nil, errors.New("truncated senc box")
+		}
+		e := sencEntry{iv: body[pos : pos+ivSize]}
+		pos += ivSize
+		if flags&sencSubsamples != 0 {
+			if pos+2 > len(body) {
+				return nil, errors.New("truncated senc box")
+			}
+			n := int(binary.BigEndian.Uint16(body[pos:]))
+			pos += 2
+			if pos+n*6 > len(body) {
+				return nil, errors.New("truncated senc box")
+			}
+			for j := 0; j < n; j++ {
+				e.subsamples = append(e.subsamples, [2]int{
+					int(binary.BigEndian.Uint16(body[pos:])),
+					int(binary.BigEndian.Uint32(body[pos+2:])),
+				})
+				pos += 6
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// readTrun returns the [start, end) offsets of the samples of a trun box and where its data ends.
+// A trun without data offset continues where the previous one ended.
+func readTrun(body []byte, base, next, defaultSize int) ([][2]int, int, error) {
+	if len(body) < 8 {
+		return nil, 0, errors.New("truncated trun box")
+	}
+	flags := binary.BigEndian.Uint32(body) & 0xffffff
+	count := int(binary.BigEndian.Uint32(body[4:]))
+	pos := 8
+	offset := next
+	if flags&trunDataOffset != 0 {
+		offset = base + int(int32(binary.BigEndian.Uint32(body[pos:])))
+		pos += 4
+	}
+	if flags&trunFirstFlags != 0 {
+		pos += 4
+	}
+
+	samples := make([][2]int, 0, count)
+	for i := 0; i < count; i++ {
+		size := defaultSize
+		if flags&trunDuration != 0 {
+			pos += 4
+		}
+		if flags&trunSize != 0 {
+			if pos+4 > len(body) {
+				return nil, 0, errors.New("truncated trun box")
+			}
+			size = int(binary.BigEndian.Uint32(body[pos:]))
+			pos += 4
+		}
+		if flags&trunFlags != 0 {
+			pos += 4
+		}
+		if flags&trunCTO != 0 {
+			pos += 4
+		}
+		samples = append(samples, [2]int{offset, offset + size})
+		offset += size
+	}
+	return samples, offset, nil
+}
+
+// decryptPattern decrypts crypt blocks then skips skip blocks until the data ends.
+// Partial blocks stay clear and a 0:0 pattern means every whole block is encrypted.
+func decryptPattern(data []byte, block cipher.Block, iv []byte, crypt, skip int) {
+	mode := cipher.NewCBCDecrypter(block, iv)
+	if crypt == 0 && skip == 0 {
+		n := len(data) / blockSize * blockSize
+		mode.CryptBlocks(data[:n], data[:n])
+		return
+	}
+	for len(data) >= blockSize {
+		n := min(crypt*blockSize, len(data)/blockSize*blockSize)
+		mode.CryptBlocks(data[:n], data[:n])
+		data = data[n:]
+		data = data[min(skip*blockSize, len(data)):]
+	}
+}
+
+// padIV extends an 8 byte IV to 16 bytes with trailing zeros
+func padIV(iv []byte) []byte {
+	if len(iv) >= blockSize {
+		return iv[:blockSize]
+	}
+	padded := make([]byte, blockSize)
+	copy(padded, iv)
+	return padded
+}
+
+// readBoxes lists the boxes between start and end
+func readBoxes(data []byte, start, end int) ([]box, error) {
+	var boxes []box
+	for pos := start; pos+8 <= end; {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		b := box{typ: string(data[pos+4 : pos+8]), start: pos, header: 8}
+		switch size {
+		case 0:
+			size = end - pos
+		case 1:
+			if pos+16 > end {
+				return nil, errors.New("truncated box header")
+			}
+			size = int(binary.BigEndian.Uint64(data[pos+8:]))
+			b.header = 16
+		}
+		if size < b.header || pos+size > end {
+			return nil, fmt.Errorf("invalid %s box size %d", b.typ, size)
+		}
+		b.end = pos + size
+		boxes = append(boxes, b)
+		pos = b.end
+	}
+	return boxes, nil
+}
+
+// findBox returns the first box of the given type
+func findBox(boxes []box, typ string) *box {
+	for i := range boxes {
+		if boxes[i].typ == typ {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+// boxPath walks down the children of parent following the given types
+func boxPath(data []byte, parent box, path ...string) (*box, error) {
+	current := &parent
+	for _, typ := range path {
+		children, err := readBoxes(data, current.start+current.header, current.end)
+		if err != nil {
+			return nil, err
+		}
+		if current = findBox(children, typ); current == nil {
+			return nil, nil
+		}
+	}
+	return current, nil
+}
+
+// renameBox overwrites the four character type of a box
+func renameBox(data []byte, b box, typ string) {
+	copy(data[b.start+4:b.start+8], typ)
+}
@@ -0,0 +1,317 @@
+package media
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+)
+
+// DecryptSampleAESTS decrypts the H.264, AAC and AC-3 elementary streams of a SAMPLE-AES
+// MPEG-TS segment and rewrites the PMT, so the result plays without a key
+func DecryptSampleAESTS(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != blockSize {
+		return nil, errors.New("IV length must equal block size")
+	}
+
+	packets, err := splitPackets(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pmts := programTables(packets)
+	types := make(map[uint16]byte)
+	for _, p := range packets {
+		if !pmts[p.pid()] || !p.unitStart() {
+			continue
+		}
+		if section, ok := psiSection(p); ok {
+			for pid, t := range streamTypes(section) {
+				types[pid] = t
+			}
+		}
+	}
+
+	videoPIDs := make(map[uint16]bool)
+	for pid, t := range types {
+		switch t {
+		case streamTypeAACSampleAES, streamTypeAC3SampleAES, streamTypeEAC3SampleAES:
+			// Audio frames keep their size, they are decrypted in place
+			decryptAudioPID(packets, pid, t, block, iv)
+		case streamTypeH264SampleAES:
+			videoPIDs[pid] = true
+		}
+	}
+
+	for _, p := range packets {
+		if pmts[p.pid()] && p.unitStart() {
+			if err := clearPMT(p); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(videoPIDs) == 0 {
+		return joinPackets(packets), nil
+	}
+	return decryptVideoPIDs(packets, videoPIDs, block, iv), nil
+}
+
+// joinPackets concatenates the packets back into a segment
+func joinPackets(packets []packet) []byte {
+	out := make([]byte, 0, len(packets)*tsPacketSize)
+	for _, p := range packets {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// decryptVideoPIDs decrypts H.264 PES packets. Removing emulation prevention bytes shrinks the
+// NAL units, so every PES is cut into new TS packets at the position of its first packet.
+func decryptVideoPIDs(packets []packet, videoPIDs map[uint16]bool, block cipher.Block, iv []byte) []byte {
+	var chunks [][]byte
+	states := make(map[uint16]*pesState)
+
+	flush := func(pid uint16, st *pesState) {
+		if !st.started {
+			return
+		}
+		st.started = false
+		offset, err := pesPayloadOffset(st.pes)
+		if err != nil {
+			chunks[st.chunk] = st.raw
+			return
+		}
+		es := decryptH264(st.pes[offset:], block, iv)
+		pes := append(append([]byte(nil), st.pes[:offset]...), es...)
+		// PES_packet_length is optional for video, 0 when it does not fit
+		if pes[4] != 0 || pes[5] != 0 {
+			length := len(pes) - 6
+			if length > 0xffff {
+				length = 0
+			}
+			pes[4], pes[5] = byte(length>>8), byte(length)
+		}
+		chunks[st.chunk] = packetize(pid, &st.cc, st.adaptation, pes)
+	}
+
+	for _, p := range packets {
+		pid := p.pid()
+		if !videoPIDs[pid] {
+			chunks = append(chunks, p)
+			continue
+		}
+		st := states[pid]
+		if st == nil {
+			st = &pesState{cc: p.continuity()}
+			states[pid] = st
+		}
+		if p.unitStart() {
+			flush(pid, st)
+			st.started = true
+			st.chunk = len(chunks)
+			st.adaptation = p.adaptation()
+			st.pes = append([]byte(nil), p.payload()...)
+			st.raw = append([]byte(nil), p...)
+			chunks = append(chunks, nil)
+			continue
+		}
+		if !st.started || !p.hasPayload() {
+			// Continuation of a PES from the previous segment or an adaptation only packet
+			chunks = append(chunks, p)
+			continue
+		}
+		st.pes = append(st.pes, p.payload()...)
+		st.raw = append(st.raw, p...)
+	}
+	for pid, st := range states {
+		flush(pid, st)
+	}
+
+	var out []byte
+	for _, c := range chunks {
+		out = append(out, c...)
+	}
+	return out
+}
+
+// decryptH264 decrypts the slice NAL units of an Annex B elementary stream
+func decryptH264(es []byte, block cipher.Block, iv []byte) []byte {
+	out := make([]byte, 0, len(es))
+	prev := 0
+	for _, nal := range nalUnits(es) {
+		out = append(out, es[prev:nal[0]]...)
+		unit := es[nal[0]:nal[1]]
+		if t := unit[0] & 0x1f; (t == h264NALSlice || t == h264NALIDRSlice) && len(unit) > nalMinEncrypted {
+			unit = unescapeNAL(unit)
+			decryptNAL(unit, block, iv)
+		}
+		out = append(out, unit...)
+		prev = nal[1]
+	}
+	return append(out, es[prev:]...)
+}
+
+// nalUnits returns the [start, end) offsets of the NAL units after each start code, trailing zeros excluded
+func nalUnits(es []byte) [][2]int {
+	var starts []int
+	for i := 0; i+3 <= len(es); i++ {
+		if es[i] == 0 && es[i+1] == 0 && es[i+2] == 1 {
+			starts = append(starts, i+3)
+			i += 2
+		}
+	}
+	units := make([][2]int, 0, len(starts))
+	for i, start := range starts {
+		end := len(es)
+		if i+1 < len(starts) {
+			end = starts[i+1] - 3
+		}
+		for end > start && es[end-1] == 0 {
+			end--
+		}
+		if end > start {
+			units = append(units, [2]int{start, end})
+		}
+	}
+	return units
+}
+
+// unescapeNAL returns a copy of the NAL unit without emulation prevention bytes
+func unescapeNAL(unit []byte) []byte {
+	out := make([]byte, 0, len(unit))
+	for i := 0; i < len(unit); i++ {
+		if i+2 < len(unit) && unit[i] == 0 && unit[i+1] == 0 && unit[i+2] == 3 {
+			out = append(out, 0, 0)
+			i += 2
+			continue
+		}
+		out = append(out, unit[i])
+	}
+	return out
+}
+
+// decryptNAL decrypts one block in every ten after the 32 byte clear leader, the chain resets per NAL unit
+func decryptNAL(unit []byte, block cipher.Block, iv []byte) {
+	mode := cipher.NewCBCDecrypter(block, iv)
+	data := unit[nalClearLeader:]
+	for len(data) > 0 {
+		if len(data) > blockSize {
+			mode.CryptBlocks(data[:blockSize], data[:blockSize])
+			data = data[blockSize:]
+		}
+		data = data[min(nalClearStride, len(data)):]
+	}
+}
+
+// decryptAudioPID decrypts AAC or AC-3 frames of a PID in place across PES packets
+func decryptAudioPID(packets []packet, pid uint16, streamType byte, block cipher.Block, iv []byte) {
+	var (
+		ranges  [][]byte // elementary stream spans inside the packet payloads
+		started bool
+		size    int
+	)
+	for _, p := range packets {
+		if p.pid() != pid || !p.hasPayload() {
+			continue
+		}
+		payload := p.payload()
+		if p.unitStart() {
+			offset, err := pesPayloadOffset(payload)
+			if err != nil {
+				continue
+			}
+			payload = payload[offset:]
+			started = true
+		}
+		if started {
+			ranges = append(ranges, payload)
+			size += len(payload)
+		}
+	}
+
+	es := make([]byte, 0, size)
+	for _, r := range ranges {
+		es = append(es, r...)
+	}
+
+	if streamType == streamTypeAACSampleAES {
+		decryptADTS(es, block, iv)
+	} else {
+		decryptAC3(es, block, iv)
+	}
+
+	for _, r := range ranges {
+		es = es[copy(r, es):]
+	}
+}
+
+// decryptADTS decrypts every ADTS frame of the stream
+func decryptADTS(es []byte, block cipher.Block, iv []byte) {
+	for i := 0; i+adtsHeaderSize <= len(es); {
+		if es[i] != 0xff || es[i+1]&0xf0 != 0xf0 {
+			i++
+			continue
+		}
+		header := adtsHeaderSize
+		if es[i+1]&0x01 == 0 {
+			header = adtsHeaderSizeCRC
+		}
+		length := int(es[i+3]&0x03)<<11 | int(es[i+4])<<3 | int(es[i+5])>>5
+		if length < header || i+length > len(es) {
+			return
+		}
+		decryptFrame(es[i+header:i+length], block, iv)
+		i += length
+	}
+}
+
+// decryptAC3 decrypts every AC-3 or E-AC-3 syncframe of the stream
+func decryptAC3(es []byte, block cipher.Block, iv []byte) {
+	for i := 0; i+6 <= len(es); {
+		if uint16(es[i])<<8|uint16(es[i+1]) != ac3SyncWord {
+			i++
+			continue
+		}
+		length, err := ac3FrameSize(es[i:])
+		if err != nil {
+			i++
+			continue
+		}
+		if i+length > len(es) {
+			return
+		}
+		decryptFrame(es[i:i+length], block, iv)
+		i += length
+	}
+}
+
+// ac3FrameSize returns the syncframe size in bytes from an AC-3 or E-AC-3 header
+func ac3FrameSize(frame []byte) (int, error) {
+	if bsid := frame[5] >> 3; bsid > ac3MaxBSID {
+		// E-AC-3 carries the frame size in words minus one
+		return (int(frame[2]&0x07)<<8 | int(frame[3]) + 1) * 2, nil
+	}
+	fscod, frmsizecod := int(frame[4]>>6), int(frame[4]&0x3f)
+	if fscod > 2 || frmsizecod >= len(ac3FrameWords) {
+		return 0, fmt.Errorf("invalid AC-3 header")
+	}
+	return ac3FrameWords[frmsizecod][fscod] * 2, nil
+}
+
+// decryptFrame decrypts the whole blocks after the 16 byte clear leader of an audio frame
+func decryptFrame(frame []byte, block cipher.Block, iv []byte) {
+	if len(frame) <= audioClearLeader {
+		return
+	}
+	data := frame[audioClearLeader:]
+	n := len(data) / blockSize * blockSize
+	if n == 0 {
+		return
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data[:n], data[:n])
+}
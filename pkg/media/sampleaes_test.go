@@ -0,0 +1,173 @@
+package media
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+var (
+	testKey = []byte("0123456789abcdef")
+	testIV  = []byte("fedcba9876543210")
+)
+
+// psiPacket wraps a PSI section, CRC appended, in a single TS packet
+func psiPacket(pid uint16, section []byte) []byte {
+	crc := crc32MPEG(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	p := append([]byte{tsSyncByte, 0x40 | byte(pid>>8), byte(pid), 0x10, 0x00}, section...)
+	return append(p, bytes.Repeat([]byte{0xff}, tsPacketSize-len(p))...)
+}
+
+// escapeNAL inserts emulation prevention bytes like an encoder does after encryption
+func escapeNAL(unit []byte) []byte {
+	var out []byte
+	zeros := 0
+	for _, b := range unit {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+func TestDecryptSampleAESTS(t *testing.T) {
+	// Arrange
+	block, _ := aes.NewCipher(testKey)
+
+	nal := []byte{0x65}
+	for i := 0; i < 300; i++ {
+		nal = append(nal, byte(i%250+1))
+	}
+	encryptedNAL := append([]byte(nil), nal...)
+	enc := cipher.NewCBCEncrypter(block, testIV)
+	for data := encryptedNAL[nalClearLeader:]; len(data) > blockSize; data = data[min(blockSize+nalClearStride, len(data)):] {
+		enc.CryptBlocks(data[:blockSize], data[:blockSize])
+	}
+	clearES := append([]byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1}, nal...)
+	encryptedES := append([]byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1}, escapeNAL(encryptedNAL)...)
+
+	frame := []byte{0xff, 0xf1, 0x50, 0x80, 0, 0, 0xfc}
+	for i := 0; i < 100; i++ {
+		frame = append(frame, byte(i))
+	}
+	frame[3] |= byte(len(frame) >> 11)
+	frame[4] = byte(len(frame) >> 3)
+	frame[5] = byte(len(frame)<<5) | 0x1f
+	encryptedFrame := append([]byte(nil), frame...)
+	leader := adtsHeaderSize + audioClearLeader
+	cipher.NewCBCEncrypter(block, testIV).CryptBlocks(encryptedFrame[leader:leader+80], encryptedFrame[leader:leader+80])
+
+	pat := []byte{0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00}
+	pmt := []byte{0x02, 0xb0, 23, 0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0,
+		streamTypeH264SampleAES, 0xe1, 0x00, 0xf0, 0,
+		streamTypeAACSampleAES, 0xe1, 0x01, 0xf0, 0}
+	videoPES := append([]byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0, 0}, encryptedES...)
+	audioPES := append([]byte{0, 0, 1, 0xc0, 0, byte(3 + len(frame)), 0x80, 0, 0}, encryptedFrame...)
+
+	var segment []byte
+	var videoCC, audioCC byte
+	segment = append(segment, psiPacket(patPID, pat)...)
+	segment = append(segment, psiPacket(0x1000, pmt)...)
+	segment = append(segment, packetize(0x100, &videoCC, nil, videoPES)...)
+	segment = append(segment, packetize(0x101, &audioCC, nil, audioPES)...)
+
+	// Act
+	out, err := DecryptSampleAESTS(segment, testKey, testIV)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	packets, err := splitPackets(out)
+	if err != nil {
+		t.Fatalf("Expected valid packets, got %v", err)
+	}
+	section, _ := psiSection(packets[1])
+	types := streamTypes(section)
+	if types[0x100] != streamTypeH264 || types[0x101] != streamTypeAAC {
+		t.Errorf("Expected clear stream types, got %v", types)
+	}
+	if crc32MPEG(section) != 0 {
+		t.Error("Expected a valid PMT CRC")
+	}
+
+	streams := make(map[uint16][]byte)
+	for _, p := range packets[2:] {
+		streams[p.pid()] = append(streams[p.pid()], p.payload()...)
+	}
+	for pid, expected := range map[uint16][]byte{0x100: clearES, 0x101: frame} {
+		offset, err := pesPayloadOffset(streams[pid])
+		if err != nil {
+			t.Fatalf("Expected a PES on PID %d, got %v", pid, err)
+		}
+		if !bytes.Equal(streams[pid][offset:], expected) {
+			t.Errorf("Expected clear elementary stream on PID %d", pid)
+		}
+	}
+}
+
+func TestDecryptPattern(t *testing.T) {
+	// Arrange
+	block, _ := aes.NewCipher(testKey)
+	clear := bytes.Repeat([]byte("0123456789abcdef"), 20)
+	clear = append(clear, 1, 2, 3)
+	data := append([]byte(nil), clear...)
+	enc := cipher.NewCBCEncrypter(block, testIV)
+	for i := 0; i+blockSize <= len(data); i += 10 * blockSize {
+		enc.CryptBlocks(data[i:i+blockSize], data[i:i+blockSize])
+	}
+
+	// Act
+	decryptPattern(data, block, testIV, 1, 9)
+
+	// Assert
+	if !bytes.Equal(data, clear) {
+		t.Error("Expected the 1:9 pattern to be decrypted")
+	}
+}
+
+// mp4Box builds a box from its type and payload
+func mp4Box(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	size := 8 + len(body)
+	return append(append([]byte{byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size)}, typ...), body...)
+}
+
+func TestDecryptFragment(t *testing.T) {
+	// Arrange
+	block, _ := aes.NewCipher(testKey)
+	sample := bytes.Repeat([]byte("sample data 0123"), 12)
+	encrypted := append([]byte(nil), sample...)
+	cipher.NewCBCEncrypter(block, testIV).CryptBlocks(encrypted[32:48], encrypted[32:48])
+
+	tfhd := mp4Box("tfhd", []byte{0, 0, 0, 0, 0, 0, 0, 1})
+	trunBody := []byte{0, 0, 0x02, 0x01, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, byte(len(sample))}
+	senc := mp4Box("senc", []byte{0, 0, 0, 0x02, 0, 0, 0, 1, 0, 1, 0, 32, 0, 0, 0, byte(len(sample) - 32)})
+	moofSize := len(mp4Box("moof", mp4Box("traf", tfhd, mp4Box("trun", trunBody), senc)))
+	trunBody[11] = byte(moofSize + 8)
+	fragment := append(mp4Box("moof", mp4Box("traf", tfhd, mp4Box("trun", trunBody), senc)), mp4Box("mdat", encrypted)...)
+	protection := Protection{1: {Scheme: schemeCBCS, IsProtected: true, CryptByteBlock: 1, SkipByteBlock: 9, ConstantIV: testIV}}
+
+	// Act
+	err := DecryptFragment(fragment, protection, testKey, nil)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !bytes.Equal(fragment[len(fragment)-len(sample):], sample) {
+		t.Error("Expected the sample to be decrypted")
+	}
+	if bytes.Contains(fragment, []byte("senc")) {
+		t.Error("Expected senc to be replaced by a free box")
+	}
+}
@@ -0,0 +1,238 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// FirstTimestampTS returns the lowest PTS or DTS of an MPEG-TS segment in seconds
+func FirstTimestampTS(data []byte) (float64, bool) {
+	packets, err := splitPackets(data)
+	if err != nil {
+		return 0, false
+	}
+
+	first, found := uint64(0), false
+	for _, pes := range pesHeaders(packets) {
+		for _, field := range timestampFields(pes) {
+			if ts := readTimestamp(field); !found || ts < first {
+				first, found = ts, true
+			}
+		}
+	}
+	return float64(first) / clock90kHz, found
+}
+
+// ShiftTS moves every PTS, DTS and PCR of an MPEG-TS segment in place by offset seconds.
+// Timestamps wrap around at 33 bits like they do in the stream.
+func ShiftTS(data []byte, offset float64) error {
+	packets, err := splitPackets(data)
+	if err != nil {
+		return err
+	}
+	ticks := int64(math.Round(offset * clock90kHz))
+
+	for _, pes := range pesHeaders(packets) {
+		for _, field := range timestampFields(pes) {
+			writeTimestamp(field, wrap33(int64(readTimestamp(field))+ticks))
+		}
+	}
+
+	for _, p := range packets {
+		af := p.adaptation()
+		if len(af) < 8 || af[1]&0x10 == 0 {
+			continue
+		}
+		pcr := af[2:8]
+		base := uint64(pcr[0])<<25 | uint64(pcr[1])<<17 | uint64(pcr[2])<<9 | uint64(pcr[3])<<1 | uint64(pcr[4])>>7
+		base = wrap33(int64(base) + ticks)
+		pcr[0], pcr[1], pcr[2], pcr[3] = byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1)
+		pcr[4] = byte(base<<7) | pcr[4]&0x7f
+	}
+	return nil
+}
+
+// pesHeaders returns the start of every PES packet that carries an optional header
+func pesHeaders(packets []packet) [][]byte {
+	pmts := programTables(packets)
+	var headers [][]byte
+	for _, p := range packets {
+		if !p.unitStart() || !p.hasPayload() || p.pid() == patPID || pmts[p.pid()] {
+			continue
+		}
+		if pes := p.payload(); hasPESHeader(pes) {
+			headers = append(headers, pes)
+		}
+	}
+	return headers
+}
+
+// hasPESHeader reports whether pes starts a PES packet with the optional header that holds PTS and DTS
+func hasPESHeader(pes []byte) bool {
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return false
+	}
+	switch pes[3] {
+	case 0xbc, 0xbe, 0xbf, 0xf0, 0xf1, 0xf2, 0xf8, 0xff:
+		return false
+	}
+	return true
+}
+
+// timestampFields returns the 5 byte PTS and DTS fields of a PES header that fit in the packet
+func timestampFields(pes []byte) [][]byte {
+	var fields [][]byte
+	flags := pes[7] >> 6
+	if flags&0x02 != 0 && len(pes) >= 14 {
+		fields = append(fields, pes[9:14])
+	}
+	if flags == 0x03 && len(pes) >= 19 {
+		fields = append(fields, pes[14:19])
+	}
+	return fields
+}
+
+// readTimestamp decodes a 33-bit PTS or DTS field
+func readTimestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+// writeTimestamp encodes a 33-bit PTS or DTS field, keeping its prefix and marker bits
+func writeTimestamp(b []byte, ts uint64) {
+	b[0] = b[0]&0xf1 | byte(ts>>29)&0x0e
+	b[1] = byte(ts >> 22)
+	b[2] = byte(ts>>14) | 0x01
+	b[3] = byte(ts >> 7)
+	b[4] = byte(ts<<1) | 0x01
+}
+
+// wrap33 reduces a timestamp modulo 2^33
+func wrap33(ts int64) uint64 {
+	return uint64(ts) & (1<<33 - 1)
+}
+
+// Timescales returns the media timescale of every track of an fMP4 init section by track ID
+func Timescales(init []byte) (map[uint32]uint32, error) {
+	top, err := readBoxes(init, 0, len(init))
+	if err != nil {
+		return nil, err
+	}
+	moov := findBox(top, "moov")
+	if moov == nil {
+		return nil, errors.New("init section has no moov box")
+	}
+	children, err := readBoxes(init, moov.start+moov.header, moov.end)
+	if err != nil {
+		return nil, err
+	}
+
+	timescales := make(map[uint32]uint32)
+	for _, trak := range children {
+		if trak.typ != "trak" {
+			continue
+		}
+		trackID, err := readTrackID(init, trak)
+		if err != nil {
+			return nil, err
+		}
+		mdhd, err := boxPath(init, trak, "mdia", "mdhd")
+		if err != nil || mdhd == nil {
+			return nil, fmt.Errorf("track %d has no mdhd box", trackID)
+		}
+		body := init[mdhd.start+mdhd.header : mdhd.end]
+		offset := 12
+		if len(body) > 0 && body[0] == 1 {
+			offset = 20
+		}
+		if len(body) < offset+4 {
+			return nil, errors.New("truncated mdhd box")
+		}
+		timescales[trackID] = binary.BigEndian.Uint32(body[offset:])
+	}
+	return timescales, nil
+}
+
+// FirstTimestampFragment returns the lowest decode time of an fMP4 fragment in seconds
+func FirstTimestampFragment(fragment []byte, timescales map[uint32]uint32) (float64, bool) {
+	first, found := 0.0, false
+	err := forEachTfdt(fragment, func(trackID uint32, tfdt []byte) error {
+		timescale := timescales[trackID]
+		if timescale == 0 {
+			return nil
+		}
+		t := float64(readTfdt(tfdt)) / float64(timescale)
+		if !found || t < first {
+			first, found = t, true
+		}
+		return nil
+	})
+	return first, found && err == nil
+}
+
+// ShiftFragment moves the decode time of every track of an fMP4 fragment in place by offset seconds
+func ShiftFragment(fragment []byte, timescales map[uint32]uint32, offset float64) error {
+	return forEachTfdt(fragment, func(trackID uint32, tfdt []byte) error {
+		timescale := timescales[trackID]
+		if timescale == 0 {
+			return fmt.Errorf("unknown timescale of track %d", trackID)
+		}
+		t := int64(readTfdt(tfdt)) + int64(math.Round(offset*float64(timescale)))
+		if t < 0 || (tfdt[0] == 0 && t > math.MaxUint32) {
+			return fmt.Errorf("shifted decode time %d does not fit the tfdt box of track %d", t, trackID)
+		}
+		if tfdt[0] == 1 {
+			binary.BigEndian.PutUint64(tfdt[4:], uint64(t))
+		} else {
+			binary.BigEndian.PutUint32(tfdt[4:], uint32(t))
+		}
+		return nil
+	})
+}
+
+// forEachTfdt calls fn with the track ID and the tfdt body of every traf of the fragment
+func forEachTfdt(fragment []byte, fn func(trackID uint32, tfdt []byte) error) error {
+	top, err := readBoxes(fragment, 0, len(fragment))
+	if err != nil {
+		return err
+	}
+	for _, moof := range top {
+		if moof.typ != "moof" {
+			continue
+		}
+		children, err := readBoxes(fragment, moof.start+moof.header, moof.end)
+		if err != nil {
+			return err
+		}
+		for _, traf := range children {
+			if traf.typ != "traf" {
+				continue
+			}
+			boxes, err := readBoxes(fragment, traf.start+traf.header, traf.end)
+			if err != nil {
+				return err
+			}
+			tfhd, tfdt := findBox(boxes, "tfhd"), findBox(boxes, "tfdt")
+			if tfhd == nil || tfdt == nil || tfhd.end-tfhd.start < tfhd.header+8 {
+				continue
+			}
+			body := fragment[tfdt.start+tfdt.header : tfdt.end]
+			if len(body) < 8 || (body[0] == 1 && len(body) < 12) {
+				return errors.New("truncated tfdt box")
+			}
+			if err := fn(binary.BigEndian.Uint32(fragment[tfhd.start+tfhd.header+4:]), body); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readTfdt returns the base media decode time of a tfdt body
+func readTfdt(body []byte) uint64 {
+	if body[0] == 1 {
+		return binary.BigEndian.Uint64(body[4:])
+	}
+	return uint64(binary.BigEndian.Uint32(body[4:]))
+}
@@ -0,0 +1,129 @@
+package media
+
+import (
+	"testing"
+)
+
+func TestShiftTS(t *testing.T) {
+	// Arrange
+	pes := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0xc0, 10, 0x31, 0, 0, 0, 0, 0x11, 0, 0, 0, 0}
+	writeTimestamp(pes[9:14], 1<<33-90000) // one second before the wrap
+	writeTimestamp(pes[14:19], 1<<33-93000)
+	af := []byte{7, 0x10, 0, 0, 0, 0, 0x7e, 0}
+	var cc byte
+	segment := packetize(0x100, &cc, af, pes)
+
+	// Act
+	err := ShiftTS(segment, 2)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	packets, _ := splitPackets(segment)
+	fields := timestampFields(packets[0].payload())
+	if len(fields) != 2 || readTimestamp(fields[0]) != 90000 || readTimestamp(fields[1]) != 87000 {
+		t.Errorf("Expected PTS 90000 and DTS 87000 after the wrap, got %v", fields)
+	}
+	if first, ok := FirstTimestampTS(segment); !ok || first != 87000.0/clock90kHz {
+		t.Errorf("Expected first timestamp %v, got %v", 87000.0/clock90kHz, first)
+	}
+	pcr := packets[0].adaptation()[2:8]
+	if base := uint64(pcr[0])<<25 | uint64(pcr[1])<<17 | uint64(pcr[2])<<9 | uint64(pcr[3])<<1 | uint64(pcr[4])>>7; base != 180000 {
+		t.Errorf("Expected PCR base 180000, got %d", base)
+	}
+}
+
+func TestTrimTS(t *testing.T) {
+	// Arrange
+	var (
+		segment []byte
+		cc      byte
+	)
+	for i := 0; i < 4; i++ {
+		pes := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5, 0x21, 0, 0, 0, 0}
+		writeTimestamp(pes[9:14], uint64(10+i)*clock90kHz)
+		segment = append(segment, packetize(0x100, &cc, nil, pes)...)
+	}
+
+	// Act
+	trimmed, err := TrimTS(segment, 11, 13)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	packets, _ := splitPackets(trimmed)
+	if len(packets) != 2 {
+		t.Fatalf("Expected 2 packets, got %d", len(packets))
+	}
+	for i, p := range packets {
+		if pts, _ := pesPTS(p.payload()); pts != float64(11+i) {
+			t.Errorf("Expected PTS %d, got %v", 11+i, pts)
+		}
+		if p.continuity() != byte(1+i) {
+			t.Errorf("Expected continuity counter %d, got %d", 1+i, p.continuity())
+		}
+	}
+}
+
+func TestTrimTSKeepsLastKeyframe(t *testing.T) {
+	// Arrange
+	var (
+		segment []byte
+		cc      byte
+	)
+	for i := 0; i < 6; i++ {
+		pes := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5, 0x21, 0, 0, 0, 0}
+		writeTimestamp(pes[9:14], uint64(10+i)*clock90kHz)
+		var af []byte
+		if i%3 == 0 {
+			af = []byte{1, 0x40} // random access indicator at 10 and 13
+		}
+		segment = append(segment, packetize(0x100, &cc, af, pes)...)
+	}
+
+	// Act
+	trimmed, err := TrimTS(segment, 12, 15)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	packets, _ := splitPackets(trimmed)
+	if len(packets) != 5 {
+		t.Fatalf("Expected 5 packets from the keyframe at 10, got %d", len(packets))
+	}
+	if pts, _ := pesPTS(packets[0].payload()); pts != 10 {
+		t.Errorf("Expected the output to start at the keyframe at 10, got %v", pts)
+	}
+}
+
+func TestTrimTSAcrossWraparound(t *testing.T) {
+	// Arrange
+	var (
+		segment []byte
+		cc      byte
+	)
+	for i := -2; i < 2; i++ {
+		pes := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5, 0x21, 0, 0, 0, 0}
+		writeTimestamp(pes[9:14], wrap33(int64(i)*clock90kHz))
+		segment = append(segment, packetize(0x100, &cc, nil, pes)...)
+	}
+	wrap := float64(1<<33) / clock90kHz
+
+	// Act
+	trimmed, err := TrimTS(segment, wrap-1, wrap+1)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	packets, _ := splitPackets(trimmed)
+	if len(packets) != 2 {
+		t.Fatalf("Expected the packets at -1 and 0 around the wrap, got %d", len(packets))
+	}
+	if pts, _ := pesPTS(packets[1].payload()); pts != 0 {
+		t.Errorf("Expected PTS 0 after the wrap, got %v", pts)
+	}
+}
@@ -0,0 +1,132 @@
+package media
+
+import "math"
+
+// TrimTS drops the PES packets of an MPEG-TS segment whose PTS is outside [from, to) seconds.
+// Each elementary stream starts at its last random access point at or before from, so the first
+// kept frames can decode and the result may begin slightly earlier than from. PTS are compared on
+// the 33-bit clock they wrap around on. PSI tables are kept and continuity counters are renumbered
+// so the result stays valid.
+func TrimTS(data []byte, from, to float64) ([]byte, error) {
+	packets, err := splitPackets(data)
+	if err != nil {
+		return nil, err
+	}
+	pmts := programTables(packets)
+	starts := keyframeStarts(packets, pmts, from)
+
+	keep := make(map[uint16]bool) // decision for the PES being read on each PID
+	cc := make(map[uint16]byte)
+	out := make([]byte, 0, len(data))
+	for _, p := range packets {
+		pid := p.pid()
+		if pid != patPID && !pmts[pid] && p.unitStart() {
+			if pts, ok := pesPTS(p.payload()); ok {
+				start, ok := starts[pid]
+				if !ok {
+					start = from
+				}
+				keep[pid] = !ptsBefore(pts, start) && ptsBefore(pts, to)
+			}
+		}
+		if k, decided := keep[pid]; decided && !k {
+			continue
+		}
+
+		start := len(out)
+		out = append(out, p...)
+		if p.hasPayload() {
+			next, seen := cc[pid]
+			if !seen {
+				next = p.continuity()
+			}
+			out[start+3] = out[start+3]&0xf0 | next&0x0f
+			cc[pid] = (next + 1) & 0x0f
+		}
+	}
+	return out, nil
+}
+
+// keyframeStarts returns, for every PID with random access points, the PTS its trimmed stream starts
+// at: the last random access point at or before from, or the first one after it. PIDs without any,
+// such as audio where every frame decodes on its own, are left out and cut at from.
+func keyframeStarts(packets []packet, pmts map[uint16]bool, from float64) map[uint16]float64 {
+	starts := make(map[uint16]float64)
+	if math.IsInf(from, -1) {
+		return starts
+	}
+	types := make(map[uint16]byte)
+	for _, p := range packets {
+		if pmts[p.pid()] && p.unitStart() {
+			if section, ok := psiSection(p); ok {
+				for pid, t := range streamTypes(section) {
+					types[pid] = t
+				}
+			}
+		}
+	}
+
+	for _, p := range packets {
+		pid := p.pid()
+		if pid == patPID || pmts[pid] || !p.unitStart() || !randomAccess(p, types[pid]) {
+			continue
+		}
+		pts, ok := pesPTS(p.payload())
+		if !ok {
+			continue
+		}
+		// One at or before from replaces the previous start, a later one only stands in until then
+		if _, found := starts[pid]; !found || !ptsBefore(from, pts) {
+			starts[pid] = pts
+		}
+	}
+	return starts
+}
+
+// randomAccess reports whether the PES starting in p can be decoded on its own: the adaptation field
+// sets the random access indicator, or an H.264 PES starts with an IDR slice
+func randomAccess(p packet, streamType byte) bool {
+	if af := p.adaptation(); len(af) > 1 && af[1]&0x40 != 0 {
+		return true
+	}
+	if streamType != streamTypeH264 {
+		return false
+	}
+	pes := p.payload()
+	offset, err := pesPayloadOffset(pes)
+	if err != nil {
+		return false
+	}
+	es := pes[offset:]
+	for _, unit := range nalUnits(es) {
+		if es[unit[0]]&0x1f == h264NALIDRSlice {
+			return true
+		}
+	}
+	return false
+}
+
+// ptsBefore reports whether the PTS a in seconds comes before b on the 33-bit clock, taking the
+// shorter way around so timestamps just after a wraparound still follow the ones before it
+func ptsBefore(a, b float64) bool {
+	if math.IsInf(b, -1) {
+		return false
+	}
+	if math.IsInf(b, 1) {
+		return true
+	}
+	diff := wrap33(int64(math.Round(a*clock90kHz)) - int64(math.Round(b*clock90kHz)))
+	return diff >= 1<<32
+}
+
+// pesPTS returns the PTS in seconds of a PES packet start
+func pesPTS(pes []byte) (float64, bool) {
+	if !hasPESHeader(pes) {
+		return 0, false
+	}
+	fields := timestampFields(pes)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	return float64(readTimestamp(fields[0])) / clock90kHz, true
+}
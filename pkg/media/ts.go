@@ -0,0 +1,301 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+)
+
+// packet is a view on one 188 byte MPEG-TS packet
+type packet []byte
+
+func (p packet) pid() uint16 {
+	return uint16(p[1]&0x1f)<<8 | uint16(p[2])
+}
+
+func (p packet) unitStart() bool {
+	return p[1]&0x40 != 0
+}
+
+func (p packet) hasAdaptation() bool {
+	return p[3]&0x20 != 0
+}
+
+func (p packet) hasPayload() bool {
+	return p[3]&0x10 != 0
+}
+
+func (p packet) continuity() byte {
+	return p[3] & 0x0f
+}
+
+// adaptation returns the adaptation field including its length byte
+func (p packet) adaptation() []byte {
+	if !p.hasAdaptation() {
+		return nil
+	}
+	end := 5 + int(p[4])
+	if end > tsPacketSize {
+		end = tsPacketSize
+	}
+	return p[4:end]
+}
+
+// payload returns the bytes after the header and adaptation field
+func (p packet) payload() []byte {
+	if !p.hasPayload() {
+		return nil
+	}
+	start := 4
+	if p.hasAdaptation() {
+		start += 1 + int(p[4])
+	}
+	if start >= tsPacketSize {
+		return nil
+	}
+	return p[start:]
+}
+
+// splitPackets checks the sync bytes and cuts data into packets
+func splitPackets(data []byte) ([]packet, error) {
+	if len(data)%tsPacketSize != 0 {
+		data = data[:len(data)-len(data)%tsPacketSize]
+	}
+	packets := make([]packet, 0, len(data)/tsPacketSize)
+	for off := 0; off < len(data); off += tsPacketSize {
+		p := packet(data[off : off+tsPacketSize])
+		if p[0] != tsSyncByte {
+			return nil, fmt.Errorf("lost MPEG-TS sync at offset %d", off)
+		}
+		packets = append(packets, p)
+	}
+	return packets, nil
+}
+
+// programTables returns the PMT PIDs listed in the PAT
+func programTables(packets []packet) map[uint16]bool {
+	pmts := make(map[uint16]bool)
+	for _, p := range packets {
+		if p.pid() != patPID || !p.unitStart() {
+			continue
+		}
+		section, ok := psiSection(p)
+		if !ok || len(section) < 12 || section[0] != 0x00 {
+			continue
+		}
+		// program loop sits between the 8 byte header and the CRC
+		for i := 8; i+4 <= len(section)-4; i += 4 {
+			program := uint16(section[i])<<8 | uint16(section[i+1])
+			if program != 0 {
+				pmts[uint16(section[i+2]&0x1f)<<8|uint16(section[i+3])] = true
+			}
+		}
+	}
+	return pmts
+}
+
+// psiSection returns the PSI section starting in the packet, it must fit in the packet
+func psiSection(p packet) ([]byte, bool) {
+	payload := p.payload()
+	if len(payload) < 1 {
+		return nil, false
+	}
+	start := 1 + int(payload[0])
+	if start+3 > len(payload) {
+		return nil, false
+	}
+	length := int(payload[start+1]&0x0f)<<8 | int(payload[start+2])
+	end := start + 3 + length
+	if end > len(payload) {
+		return nil, false
+	}
+	return payload[start:end], true
+}
+
+// streamTypes reads the elementary stream types listed in a PMT section
+func streamTypes(section []byte) map[uint16]byte {
+	types := make(map[uint16]byte)
+	if len(section) < 16 || section[0] != 0x02 {
+		return types
+	}
+	programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	for i := 12 + programInfoLength; i+5 <= len(section)-4; {
+		pid := uint16(section[i+1]&0x1f)<<8 | uint16(section[i+2])
+		types[pid] = section[i]
+		i += 5 + (int(section[i+3]&0x0f)<<8 | int(section[i+4]))
+	}
+	return types
+}
+
+// clearPMT rewrites a single packet PMT in place so SAMPLE-AES streams are announced as clear streams
+func clearPMT(p packet) error {
+	payload := p.payload()
+	section, ok := psiSection(p)
+	if !ok || len(section) < 16 || section[0] != 0x02 {
+		return errors.New("PMT does not fit in a single packet")
+	}
+
+	programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	out := make([]byte, 0, len(section))
+	out = append(out, section[:12+programInfoLength]...)
+	for i := 12 + programInfoLength; i+5 <= len(section)-4; {
+		esInfoLength := int(section[i+3]&0x0f)<<8 | int(section[i+4])
+		streamType := section[i]
+		if clear, ok := clearStreamTypes[streamType]; ok {
+			streamType = clear
+		}
+		descriptors := stripSampleAESDescriptors(section[i+5 : i+5+esInfoLength])
+		out = append(out, streamType, section[i+1], section[i+2],
+			section[i+3]&0xf0|byte(len(descriptors)>>8), byte(len(descriptors)))
+		out = append(out, descriptors...)
+		i += 5 + esInfoLength
+	}
+
+	length := len(out) + 4 - 3
+	out[1] = out[1]&0xf0 | byte(length>>8)
+	out[2] = byte(length)
+	crc := crc32MPEG(out)
+	out = append(out, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	// The section only shrinks, the rest of the payload is stuffing
+	start := 1 + int(payload[0])
+	n := copy(payload[start:], out)
+	for i := start + n; i < len(payload); i++ {
+		payload[i] = 0xff
+	}
+	return nil
+}
+
+// stripSampleAESDescriptors drops the descriptors that announce SAMPLE-AES encryption
+func stripSampleAESDescriptors(descriptors []byte) []byte {
+	var kept []byte
+	for i := 0; i+2 <= len(descriptors); {
+		end := i + 2 + int(descriptors[i+1])
+		if end > len(descriptors) {
+			break
+		}
+		tag := descriptors[i]
+		drop := (tag == descriptorPrivateIndicator || tag == descriptorRegistration) &&
+			end-i >= 6 && sampleAESFormats[string(descriptors[i+2:i+6])]
+		if !drop {
+			kept = append(kept, descriptors[i:end]...)
+		}
+		i = end
+	}
+	return kept
+}
+
+// pesPayloadOffset returns where the elementary stream data starts in a PES packet
+func pesPayloadOffset(pes []byte) (int, error) {
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return 0, errors.New("invalid PES start code")
+	}
+	offset := 9 + int(pes[8])
+	if offset > len(pes) {
+		return 0, errors.New("PES header exceeds packet")
+	}
+	return offset, nil
+}
+
+// packetize cuts a PES packet into TS packets. The adaptation field of the original first packet
+// (PCR, random access indicator) is kept on the first new packet, the last one is padded with stuffing.
+func packetize(pid uint16, cc *byte, adaptation []byte, pes []byte) []byte {
+	var out []byte
+	first := true
+	for len(pes) > 0 {
+		var af []byte
+		if first && len(adaptation) > 0 {
+			af = trimAdaptation(adaptation)
+		}
+		space := tsPacketSize - 4 - len(af)
+		if len(pes) < space {
+			af = stuffAdaptation(af, space-len(pes))
+			space = len(pes)
+		}
+
+		header := []byte{tsSyncByte, byte(pid>>8) & 0x1f, byte(pid), 0x10 | (*cc & 0x0f)}
+		if first {
+			header[1] |= 0x40
+		}
+		if len(af) > 0 {
+			header[3] |= 0x20
+		}
+		out = append(out, header...)
+		out = append(out, af...)
+		out = append(out, pes[:space]...)
+
+		pes = pes[space:]
+		*cc = (*cc + 1) & 0x0f
+		first = false
+	}
+	return out
+}
+
+// stuffAdaptation grows an adaptation field (length byte included) by n bytes
+func stuffAdaptation(af []byte, n int) []byte {
+	if n <= 0 {
+		return af
+	}
+	switch len(af) {
+	case 0:
+		if n == 1 {
+			return []byte{0x00}
+		}
+		af = []byte{0x00, 0x00}
+		n -= 2
+	case 1:
+		// A field with length byte only has no flags byte yet
+		af = append(af, 0x00)
+		n--
+	}
+	for ; n > 0; n-- {
+		af = append(af, 0xff)
+	}
+	af[0] = byte(len(af) - 1)
+	return af
+}
+
+// trimAdaptation copies an adaptation field without its stuffing bytes
+func trimAdaptation(af []byte) []byte {
+	if len(af) < 2 {
+		return append([]byte(nil), af...)
+	}
+	flags := af[1]
+	n := 2
+	if flags&0x10 != 0 { // PCR
+		n += 6
+	}
+	if flags&0x08 != 0 { // OPCR
+		n += 6
+	}
+	if flags&0x04 != 0 { // splice countdown
+		n++
+	}
+	if flags&0x02 != 0 && n < len(af) { // transport private data
+		n += 1 + int(af[n])
+	}
+	if flags&0x01 != 0 && n < len(af) { // adaptation field extension
+		n += 1 + int(af[n])
+	}
+	if n > len(af) {
+		n = len(af)
+	}
+	trimmed := append([]byte(nil), af[:n]...)
+	trimmed[0] = byte(n - 1)
+	return trimmed
+}
+
+// crc32MPEG is the CRC of PSI sections: polynomial 0x04c11db7, no reflection, no final xor
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
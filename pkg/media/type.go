@@ -0,0 +1,34 @@
+package media
+
+type (
+	// TrackEncryption is the default encryption of an fMP4 track, read from its tenc box
+	TrackEncryption struct {
+		Scheme         string // schm scheme type, only cbcs is supported for SAMPLE-AES
+		IsProtected    bool
+		IVSize         int // per-sample IV size in senc, 0 when ConstantIV is used
+		CryptByteBlock int
+		SkipByteBlock  int
+		ConstantIV     []byte
+	}
+
+	// Protection lists the encrypted tracks of an fMP4 init section by track ID
+	Protection map[uint32]*TrackEncryption
+)
+
+// box is an ISO BMFF box located by absolute offsets
+type box struct {
+	typ    string
+	start  int // first byte of the size field
+	header int // size of the size and type fields
+	end    int
+}
+
+// pesState collects the TS packets of one PES packet of a video PID
+type pesState struct {
+	cc         byte
+	started    bool
+	chunk      int // index of the output chunk reserved for the PES
+	adaptation []byte
+	pes        []byte
+	raw        []byte
+}
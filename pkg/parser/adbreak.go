@@ -0,0 +1,233 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cueState follows the ad break opened by cue tags while the playlist is read
+type cueState struct {
+	open    *AdBreak // break the next segments belong to
+	pending *SCTE35  // EXT-OATCLS-SCTE35 waiting for the cue tag it usually precedes
+}
+
+// out opens a break at the next segment, a break that is still open ends there
+func (c *cueState) out(m3u8 *M3U8, source string, duration float64) {
+	c.open = &AdBreak{Source: source, Duration: duration, Out: c.pending}
+	if duration == 0 && c.pending != nil {
+		c.open.Duration = c.pending.Duration
+	}
+	c.pending = nil
+	m3u8.AdBreaks = append(m3u8.AdBreaks, c.open)
+}
+
+// in closes the open break
+func (c *cueState) in() {
+	if c.open != nil && c.pending != nil && c.pending.In {
+		c.open.In = c.pending
+	}
+	c.open, c.pending = nil, nil
+}
+
+// current returns the break the next segment or part belongs to. An EXT-OATCLS-SCTE35 that was
+// not followed by a cue tag opens or closes a break on its own.
+func (c *cueState) current(m3u8 *M3U8) *AdBreak {
+	switch {
+	case c.pending == nil:
+	case c.pending.Out:
+		c.out(m3u8, strings.Trim(extOATCLS, "#:"), 0)
+	case c.pending.In:
+		c.in()
+	default:
+		c.pending = nil
+	}
+	return c.open
+}
+
+// parseCueOut returns the duration of an EXT-X-CUE-OUT tag, written as
+// #EXT-X-CUE-OUT:30, #EXT-X-CUE-OUT:DURATION=30 or without any
+func parseCueOut(line string) (float64, error) {
+	_, value, _ := strings.Cut(line, ":")
+	if value == "" {
+		return 0, nil
+	}
+	if attrs := cueAttributes(value); attrs["DURATION"] != "" {
+		value = attrs["DURATION"]
+	}
+	duration, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid EXT-X-CUE-OUT duration: %s", value)
+	}
+	return duration, nil
+}
+
+// parseCueOutCont returns the duration of an EXT-X-CUE-OUT-CONT tag, written as
+// #EXT-X-CUE-OUT-CONT:ElapsedTime=5,Duration=30 or #EXT-X-CUE-OUT-CONT:5/30
+func parseCueOutCont(line string) (float64, error) {
+	_, value, _ := strings.Cut(line, ":")
+	if _, total, found := strings.Cut(value, "/"); found {
+		value = total
+	} else {
+		value = cueAttributes(value)["DURATION"]
+	}
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid EXT-X-CUE-OUT-CONT duration: %s", value)
+	}
+	return duration, nil
+}
+
+// cueAttributes splits the attributes of a cue tag, whose names are not always upper case
+func cueAttributes(value string) map[string]string {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(value, ",") {
+		if k, v, found := strings.Cut(field, "="); found {
+			attrs[strings.ToUpper(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(v), "\"")
+		}
+	}
+	return attrs
+}
+
+// parseDateRange parses an EXT-X-DATERANGE tag
+func parseDateRange(line string) (*DateRange, error) {
+	params := parseLineParameters(line)
+	dr := &DateRange{ID: params["ID"], Class: params["CLASS"], EndOnNext: params["END-ON-NEXT"] == "YES"}
+	if dr.ID == "" {
+		return nil, fmt.Errorf("invalid EXT-X-DATERANGE, missing ID")
+	}
+
+	var err error
+	if v, ok := params["START-DATE"]; ok {
+		if dr.StartDate, err = parseProgramDateTime(v); err != nil {
+			return nil, fmt.Errorf("invalid EXT-X-DATERANGE START-DATE: %s", v)
+		}
+	}
+	if v, ok := params["END-DATE"]; ok {
+		if dr.EndDate, err = parseProgramDateTime(v); err != nil {
+			return nil, fmt.Errorf("invalid EXT-X-DATERANGE END-DATE: %s", v)
+		}
+	}
+	for name, target := range map[string]*float64{"DURATION": &dr.Duration, "PLANNED-DURATION": &dr.PlannedDuration} {
+		if v, ok := params[name]; ok {
+			if *target, err = strconv.ParseFloat(v, 64); err != nil || *target < 0 {
+				return nil, fmt.Errorf("invalid EXT-X-DATERANGE %s: %s", name, v)
+			}
+		}
+	}
+	for name, target := range map[string]**SCTE35{"SCTE35-CMD": &dr.SCTE35Cmd, "SCTE35-OUT": &dr.SCTE35Out, "SCTE35-IN": &dr.SCTE35In} {
+		if v, ok := params[name]; ok {
+			if *target, err = decodeSCTE35(v); err != nil {
+				return nil, fmt.Errorf("invalid EXT-X-DATERANGE %s: %v", name, err)
+			}
+		}
+	}
+	for k, v := range params {
+		if strings.HasPrefix(k, "X-") {
+			if dr.ClientAttributes == nil {
+				dr.ClientAttributes = make(map[string]string)
+			}
+			dr.ClientAttributes[k] = v
+		}
+	}
+	return dr, nil
+}
+
+// end returns when the date range ends, zero when the playlist does not tell yet
+func (dr *DateRange) end(ranges []*DateRange) time.Time {
+	if !dr.EndDate.IsZero() {
+		return dr.EndDate
+	}
+	if dr.Duration > 0 {
+		return dr.StartDate.Add(seconds(dr.Duration))
+	}
+	if dr.EndOnNext {
+		for _, next := range ranges {
+			if next.Class == dr.Class && next.StartDate.After(dr.StartDate) {
+				return next.StartDate
+			}
+		}
+	}
+	if dr.PlannedDuration > 0 {
+		return dr.StartDate.Add(seconds(dr.PlannedDuration))
+	}
+	return time.Time{}
+}
+
+// isAd reports whether the date range carries a splice out of the network feed
+func (dr *DateRange) isAd() bool {
+	return dr.SCTE35Out != nil || (dr.SCTE35Cmd != nil && dr.SCTE35Cmd.Out)
+}
+
+// dateRangeBreaks turns the EXT-X-DATERANGE ad splices into ad breaks and places the segments
+// into them by EXT-X-PROGRAM-DATE-TIME. Tags sharing an ID describe the same range, a later one
+// usually adds the SCTE35-IN and the end.
+func dateRangeBreaks(m3u8 *M3U8) {
+	merged := make(map[string]*DateRange)
+	var ids []string
+	for _, dr := range m3u8.DateRanges {
+		prev, ok := merged[dr.ID]
+		if !ok {
+			copied := *dr
+			merged[dr.ID] = &copied
+			ids = append(ids, dr.ID)
+			continue
+		}
+		if !dr.EndDate.IsZero() {
+			prev.EndDate = dr.EndDate
+		}
+		if dr.Duration > 0 {
+			prev.Duration = dr.Duration
+		}
+		if dr.SCTE35In != nil {
+			prev.SCTE35In = dr.SCTE35In
+		}
+		if dr.SCTE35Out != nil {
+			prev.SCTE35Out = dr.SCTE35Out
+		}
+	}
+
+	for _, id := range ids {
+		dr := merged[id]
+		if !dr.isAd() || dr.StartDate.IsZero() {
+			continue
+		}
+		out := dr.SCTE35Out
+		if out == nil {
+			out = dr.SCTE35Cmd
+		}
+		end := dr.end(m3u8.DateRanges)
+		if end.IsZero() && out.Duration > 0 {
+			end = dr.StartDate.Add(seconds(out.Duration))
+		}
+		ad := &AdBreak{ID: dr.ID, Source: strings.Trim(extDateRange, "#:"), StartDate: dr.StartDate, Out: out, In: dr.SCTE35In}
+		if !end.IsZero() {
+			ad.Duration = end.Sub(dr.StartDate).Seconds()
+		}
+		m3u8.AdBreaks = append(m3u8.AdBreaks, ad)
+
+		for _, seg := range m3u8.Segments {
+			if seg.AdBreak != nil || seg.ProgramDateTime.IsZero() {
+				continue
+			}
+			// The middle of the segment decides, dates are rarely frame accurate
+			mid := seg.ProgramDateTime.Add(seconds(float64(seg.Duration)) / 2)
+			if mid.Before(dr.StartDate) || (!end.IsZero() && !mid.Before(end)) {
+				continue
+			}
+			seg.AdBreak = ad
+			for _, p := range seg.Parts {
+				p.AdBreak = ad
+			}
+		}
+	}
+}
+
+// seconds converts a duration in seconds to a time.Duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -1,32 +1,88 @@
 package parser
 
-import "regexp"
+import (
+	"regexp"
+	"time"
+)
 
 // custom
 const (
 	PlaylistTypeVOD   PlaylistType = "VOD"
 	PlaylistTypeEvent PlaylistType = "EVENT"
 
-	CryptMethodAES  CryptMethod = "AES-128"
-	CryptMethodNONE CryptMethod = "NONE"
+	CryptMethodAES       CryptMethod = "AES-128"
+	CryptMethodSampleAES CryptMethod = "SAMPLE-AES"
+	CryptMethodNONE      CryptMethod = "NONE"
+
+	VariantPolicyHighest    VariantPolicy = "highest"
+	VariantPolicyLowest     VariantPolicy = "lowest"
+	VariantPolicyResolution VariantPolicy = "resolution"
+	VariantPolicyFirst      VariantPolicy = "first"
+
+	MediaTypeAudio          MediaType = "AUDIO"
+	MediaTypeVideo          MediaType = "VIDEO"
+	MediaTypeSubtitles      MediaType = "SUBTITLES"
+	MediaTypeClosedCaptions MediaType = "CLOSED-CAPTIONS"
 
 	extM3U           = "#EXTM3U"
 	extInfPrefix     = "#EXTINF:"
 	extByteRange     = "#EXT-X-BYTERANGE:"
 	extKey           = "#EXT-X-KEY"
+	extMap           = "#EXT-X-MAP:"
 	extStreamInf     = "#EXT-X-STREAM-INF:"
+	extMedia         = "#EXT-X-MEDIA:"
 	endList          = "#EXT-X-ENDLIST"
+	extDiscontinuity = "#EXT-X-DISCONTINUITY"
+	discontinuitySeq = "#EXT-X-DISCONTINUITY-SEQUENCE:"
+	programDateTime  = "#EXT-X-PROGRAM-DATE-TIME:"
+	extPart          = "#EXT-X-PART:"
+	extPartInf       = "#EXT-X-PART-INF:"
+	extPreloadHint   = "#EXT-X-PRELOAD-HINT:"
+	extServerControl = "#EXT-X-SERVER-CONTROL:"
+	extSkip          = "#EXT-X-SKIP:"
+	extDateRange     = "#EXT-X-DATERANGE:"
+	extCueOut        = "#EXT-X-CUE-OUT"
+	extCueOutCont    = "#EXT-X-CUE-OUT-CONT"
+	extCueIn         = "#EXT-X-CUE-IN"
+	extOATCLS        = "#EXT-OATCLS-SCTE35:"
+	extSteering      = "#EXT-X-CONTENT-STEERING:"
 	playlistType     = "#EXT-X-PLAYLIST-TYPE:"
 	targetDuration   = "#EXT-X-TARGETDURATION:"
 	mediaSequence    = "#EXT-X-MEDIA-SEQUENCE:"
 	version          = "#EXT-X-VERSION:"
-	invalidExtM3U    = "invalid m3u8, missing #EXTM3U in line 1"
-	invalidURI       = "invalid EXT-X-STREAM-INF URI, line: %d"
-	duplicateExtInf  = "duplicate EXTINF: %s, line: %d"
-	duplicateExtByte = "duplicate EXT-X-BYTERANGE: %s, line: %d"
-	invalidLine      = "invalid line: %s"
-	invalidExtKey    = "invalid EXT-X-KEY: %s, line: %d"
-	invalidKeyMethod = "invalid EXT-X-KEY method: %s, line: %d"
+	invalidExtM3U    = "invalid m3u8, missing #EXTM3U"
+	invalidURI       = "missing EXT-X-STREAM-INF URI"
+	duplicateExtInf  = "duplicate EXTINF"
+	duplicateExtByte = "duplicate EXT-X-BYTERANGE"
+	invalidLine      = "URI without EXTINF"
+	invalidExtKey    = "invalid EXT-X-KEY, no attributes"
+
+	keyFormatIdentity = "identity"
+	defaultPathwayID  = "." // PATHWAY-ID of variants that do not name one
+
+	// SCTE-35
+	spliceInfoTable        = 0xfc
+	spliceInsert           = 0x05
+	timeSignal             = 0x06
+	segmentationDescriptor = 0x02
 )
 
-var linePattern = regexp.MustCompile(`(?P<key>[^=]+)=(?P<value>\"[^\"]*\"|[^,]*)`)
+// adSegmentationTypes are the segmentation_type_id values that start an ad, the matching end is the next value
+var adSegmentationTypes = map[uint8]bool{
+	0x22: true, // break start
+	0x30: true, // provider advertisement start
+	0x32: true, // distributor advertisement start
+	0x34: true, // provider placement opportunity start
+	0x36: true, // distributor placement opportunity start
+	0x44: true, // provider ad block start
+	0x46: true, // distributor ad block start
+}
+
+// programDateTimeLayouts are the ISO 8601 forms seen in EXT-X-PROGRAM-DATE-TIME, fractional seconds are optional
+var programDateTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05Z07",
+}
+
+var linePattern = regexp.MustCompile(`(?P<key>[A-Z0-9-]+)=(?P<value>\"[^\"]*\"|[^,]*)`)
@@ -0,0 +1,396 @@
+package parser
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unquotedValue matches attribute values that are written without quotes: numbers, hex and enumerated strings
+var unquotedValue = regexp.MustCompile(`^(-?[0-9.]+|0[xX][0-9A-Fa-f]+|[0-9]+x[0-9]+|[A-Z0-9-]+)$`)
+
+// Encode writes the playlist in M3U8 format. A playlist with variants is written as a master playlist,
+// anything else as a media playlist. Tags the parser does not handle are written back where they were
+// found, cue tags are written from the ad breaks they opened.
+func (m *M3U8) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if len(m.MasterPlaylist) > 0 || len(m.Media) > 0 {
+		m.encodeMaster(bw)
+	} else {
+		m.encodeMedia(bw)
+	}
+	return bw.Flush()
+}
+
+// encodeMaster writes the renditions and variants of a master playlist
+func (m *M3U8) encodeMaster(w *bufio.Writer) {
+	m.encodeHeader(w)
+	if cs := m.ContentSteering; cs != nil {
+		w.WriteString(extSteering + cs.attributes() + "\n")
+	}
+	for _, tag := range m.UnknownTags {
+		w.WriteString(tag + "\n")
+	}
+	for _, media := range m.Media {
+		w.WriteString(extMedia + media.attributes() + "\n")
+	}
+	for _, mp := range m.MasterPlaylist {
+		w.WriteString(extStreamInf + mp.attributes() + "\n")
+		w.WriteString(mp.URI + "\n")
+	}
+}
+
+// encodeHeader writes #EXTM3U and the version
+func (m *M3U8) encodeHeader(w *bufio.Writer) {
+	w.WriteString(extM3U + "\n")
+	if m.Version > 0 {
+		fmt.Fprintf(w, "%s%d\n", version, m.Version)
+	}
+}
+
+// encodeMedia writes the segments of a media playlist with the tags that apply to them
+func (m *M3U8) encodeMedia(w *bufio.Writer) {
+	m.encodeHeader(w)
+	fmt.Fprintf(w, "%s%d\n", targetDuration, int(math.Ceil(m.TargetDuration)))
+	if m.MediaSequence > 0 {
+		fmt.Fprintf(w, "%s%d\n", mediaSequence, m.MediaSequence)
+	}
+	if m.DiscontinuitySequence > 0 {
+		fmt.Fprintf(w, "%s%d\n", discontinuitySeq, m.DiscontinuitySequence)
+	}
+	if m.PlaylistType != "" {
+		fmt.Fprintf(w, "%s%s\n", playlistType, m.PlaylistType)
+	}
+	if m.ServerControl != nil {
+		w.WriteString(extServerControl + m.ServerControl.attributes() + "\n")
+	}
+	if m.PartTarget > 0 {
+		fmt.Fprintf(w, "%sPART-TARGET=%s\n", extPartInf, formatFloat(m.PartTarget))
+	}
+	if m.Skip != nil {
+		w.WriteString(extSkip + m.Skip.attributes() + "\n")
+	}
+
+	ranges := m.DateRanges
+	var (
+		keyIndex int
+		initMap  *Map
+		ad       *AdBreak
+		next     time.Time // EXT-X-PROGRAM-DATE-TIME the next segment has when it is not written
+	)
+	for i, seg := range m.Segments {
+		for _, tag := range seg.UnknownTags {
+			w.WriteString(tag + "\n")
+		}
+		// Date ranges go in front of the first segment that ends after they start
+		if !seg.ProgramDateTime.IsZero() {
+			end := seg.ProgramDateTime.Add(seconds(float64(seg.Duration)))
+			for len(ranges) > 0 && ranges[0].StartDate.Before(end) {
+				w.WriteString(extDateRange + ranges[0].attributes() + "\n")
+				ranges = ranges[1:]
+			}
+		}
+		if seg.Discontinuity {
+			w.WriteString(extDiscontinuity + "\n")
+		}
+		if seg.KeyIndex != keyIndex {
+			if key := m.Keys[seg.KeyIndex]; key != nil {
+				w.WriteString(extKey + ":" + key.attributes() + "\n")
+			} else {
+				w.WriteString(extKey + ":METHOD=NONE\n")
+			}
+			keyIndex = seg.KeyIndex
+		}
+		if seg.Map != initMap && seg.Map != nil {
+			w.WriteString(extMap + seg.Map.attributes() + "\n")
+		}
+		initMap = seg.Map
+		if pdt := seg.ProgramDateTime; !pdt.IsZero() && (i == 0 || seg.Discontinuity || !pdt.Equal(next)) {
+			fmt.Fprintf(w, "%s%s\n", programDateTime, pdt.Format("2006-01-02T15:04:05.000Z07:00"))
+		}
+		if !seg.ProgramDateTime.IsZero() {
+			next = seg.ProgramDateTime.Add(seconds(float64(seg.Duration)))
+		}
+		if seg.AdBreak != ad {
+			encodeCue(w, ad, seg.AdBreak)
+			ad = seg.AdBreak
+		}
+
+		for _, p := range seg.Parts {
+			w.WriteString(extPart + p.attributes() + "\n")
+		}
+		if seg.Length > 0 {
+			fmt.Fprintf(w, "%s%d@%d\n", extByteRange, seg.Length, seg.Offset)
+		}
+		fmt.Fprintf(w, "%s%s,%s\n", extInfPrefix, strconv.FormatFloat(float64(seg.Duration), 'f', -1, 32), seg.Title)
+		w.WriteString(seg.URI + "\n")
+	}
+
+	for _, p := range m.PendingParts {
+		w.WriteString(extPart + p.attributes() + "\n")
+	}
+	for _, hint := range m.PreloadHints {
+		w.WriteString(extPreloadHint + hint.attributes() + "\n")
+	}
+	for _, dr := range ranges {
+		w.WriteString(extDateRange + dr.attributes() + "\n")
+	}
+	for _, tag := range m.UnknownTags {
+		w.WriteString(tag + "\n")
+	}
+	if m.EndList {
+		w.WriteString(endList + "\n")
+	}
+}
+
+// encodeCue writes the cue tags between two segments that belong to different ad breaks.
+// Breaks signalled by EXT-X-DATERANGE are written with the date ranges.
+func encodeCue(w *bufio.Writer, from, to *AdBreak) {
+	if from != nil && from.ID == "" {
+		if from.In != nil {
+			w.WriteString(extOATCLS + base64.StdEncoding.EncodeToString(from.In.Raw) + "\n")
+		}
+		w.WriteString(extCueIn + "\n")
+	}
+	if to == nil || to.ID != "" {
+		return
+	}
+	if to.Out != nil {
+		w.WriteString(extOATCLS + base64.StdEncoding.EncodeToString(to.Out.Raw) + "\n")
+	}
+	switch to.Source {
+	case strings.TrimPrefix(extCueOutCont, "#"):
+		fmt.Fprintf(w, "%s:Duration=%s\n", extCueOutCont, formatFloat(to.Duration))
+	case strings.TrimPrefix(extCueOut, "#"):
+		if to.Duration > 0 {
+			fmt.Fprintf(w, "%s:%s\n", extCueOut, formatFloat(to.Duration))
+		} else {
+			w.WriteString(extCueOut + "\n")
+		}
+	}
+}
+
+// attributes formats the attributes of an EXT-X-CONTENT-STEERING tag
+func (cs *ContentSteering) attributes() string {
+	a := attributeList{}
+	a.quoted("SERVER-URI", cs.ServerURI)
+	a.quoted("PATHWAY-ID", cs.PathwayID)
+	return a.String()
+}
+
+// attributes formats the attributes of an EXT-X-STREAM-INF tag
+func (mp *MasterPlaylist) attributes() string {
+	a := attributeList{}
+	a.number("BANDWIDTH", uint64(mp.BandWidth))
+	if mp.AverageBandwidth > 0 {
+		a.number("AVERAGE-BANDWIDTH", uint64(mp.AverageBandwidth))
+	}
+	if mp.ProgramID > 0 {
+		a.number("PROGRAM-ID", uint64(mp.ProgramID))
+	}
+	a.quoted("CODECS", mp.Codecs)
+	if !mp.Resolution.IsZero() {
+		a.enum("RESOLUTION", mp.Resolution.String())
+	}
+	if mp.FrameRate > 0 {
+		a.enum("FRAME-RATE", strconv.FormatFloat(mp.FrameRate, 'f', 3, 64))
+	}
+	a.enum("HDCP-LEVEL", mp.HDCPLevel)
+	a.enum("VIDEO-RANGE", mp.VideoRange)
+	a.quoted("STABLE-VARIANT-ID", mp.StableVariantID)
+	a.quoted("PATHWAY-ID", mp.PathwayID)
+	a.quoted("AUDIO", mp.Audio)
+	a.quoted("VIDEO", mp.Video)
+	a.quoted("SUBTITLES", mp.Subtitles)
+	if mp.ClosedCaptions == "NONE" {
+		a.enum("CLOSED-CAPTIONS", mp.ClosedCaptions)
+	} else {
+		a.quoted("CLOSED-CAPTIONS", mp.ClosedCaptions)
+	}
+	a.unknown(mp.Unknown)
+	return a.String()
+}
+
+// attributes formats the attributes of an EXT-X-MEDIA tag
+func (m *Media) attributes() string {
+	a := attributeList{}
+	a.enum("TYPE", string(m.Type))
+	a.quoted("GROUP-ID", m.GroupID)
+	a.quoted("LANGUAGE", m.Language)
+	a.quoted("ASSOC-LANGUAGE", m.AssocLanguage)
+	a.quoted("NAME", m.Name)
+	a.yes("DEFAULT", m.Default)
+	a.yes("AUTOSELECT", m.AutoSelect)
+	a.yes("FORCED", m.Forced)
+	a.quoted("INSTREAM-ID", m.InstreamID)
+	a.quoted("CHARACTERISTICS", m.Characteristics)
+	a.quoted("CHANNELS", m.Channels)
+	a.quoted("URI", m.URI)
+	a.unknown(m.Unknown)
+	return a.String()
+}
+
+// attributes formats the attributes of an EXT-X-KEY tag
+func (k *Key) attributes() string {
+	a := attributeList{}
+	a.enum("METHOD", string(k.Method))
+	a.quoted("URI", k.URI)
+	if k.IV != nil {
+		a.enum("IV", "0x"+strings.ToUpper(hex.EncodeToString(k.IV)))
+	}
+	a.quoted("KEYFORMAT", k.KeyFormat)
+	a.quoted("KEYFORMATVERSIONS", k.KeyFormatVersions)
+	return a.String()
+}
+
+// attributes formats the attributes of an EXT-X-MAP tag
+func (m *Map) attributes() string {
+	a := attributeList{}
+	a.quoted("URI", m.URI)
+	if m.Length > 0 {
+		a.quoted("BYTERANGE", fmt.Sprintf("%d@%d", m.Length, m.Offset))
+	}
+	return a.String()
+}
+
+// attributes formats the attributes of an EXT-X-PART tag
+func (p *Part) attributes() string {
+	a := attributeList{}
+	a.enum("DURATION", formatFloat(p.Duration))
+	a.quoted("URI", p.URI)
+	a.yes("INDEPENDENT", p.Independent)
+	if p.Length > 0 {
+		a.quoted("BYTERANGE", fmt.Sprintf("%d@%d", p.Length, p.Offset))
+	}
+	a.yes("GAP", p.Gap)
+	return a.String()
+}
+
+// attributes formats the attributes of an EXT-X-PRELOAD-HINT tag
+func (h *PreloadHint) attributes() string {
+	a := attributeList{}
+	a.enum("TYPE", h.Type)
+	a.quoted("URI", h.URI)
+	if h.Offset > 0 {
+		a.number("BYTERANGE-START", h.Offset)
+	}
+	if h.Length > 0 {
+		a.number("BYTERANGE-LENGTH", h.Length)
+	}
+	return a.String()
+}
+
+// attributes formats the attributes of an EXT-X-SERVER-CONTROL tag
+func (sc *ServerControl) attributes() string {
+	a := attributeList{}
+	if sc.CanSkipUntil > 0 {
+		a.enum("CAN-SKIP-UNTIL", formatFloat(sc.CanSkipUntil))
+	}
+	a.yes("CAN-SKIP-DATERANGES", sc.CanSkipDateRanges)
+	if sc.HoldBack > 0 {
+		a.enum("HOLD-BACK", formatFloat(sc.HoldBack))
+	}
+	if sc.PartHoldBack > 0 {
+		a.enum("PART-HOLD-BACK", formatFloat(sc.PartHoldBack))
+	}
+	a.yes("CAN-BLOCK-RELOAD", sc.CanBlockReload)
+	return a.String()
+}
+
+// attributes formats the attributes of an EXT-X-SKIP tag
+func (s *Skip) attributes() string {
+	a := attributeList{}
+	a.number("SKIPPED-SEGMENTS", s.SkippedSegments)
+	a.quoted("RECENTLY-REMOVED-DATERANGES", strings.Join(s.RecentlyRemovedDateRanges, "\t"))
+	return a.String()
+}
+
+// attributes formats the attributes of an EXT-X-DATERANGE tag
+func (dr *DateRange) attributes() string {
+	a := attributeList{}
+	a.quoted("ID", dr.ID)
+	a.quoted("CLASS", dr.Class)
+	if !dr.StartDate.IsZero() {
+		a.quoted("START-DATE", dr.StartDate.Format("2006-01-02T15:04:05.000Z07:00"))
+	}
+	if !dr.EndDate.IsZero() {
+		a.quoted("END-DATE", dr.EndDate.Format("2006-01-02T15:04:05.000Z07:00"))
+	}
+	if dr.Duration > 0 {
+		a.enum("DURATION", formatFloat(dr.Duration))
+	}
+	if dr.PlannedDuration > 0 {
+		a.enum("PLANNED-DURATION", formatFloat(dr.PlannedDuration))
+	}
+	a.scte35("SCTE35-CMD", dr.SCTE35Cmd)
+	a.scte35("SCTE35-OUT", dr.SCTE35Out)
+	a.scte35("SCTE35-IN", dr.SCTE35In)
+	a.yes("END-ON-NEXT", dr.EndOnNext)
+	a.unknown(dr.ClientAttributes)
+	return a.String()
+}
+
+// attributeList builds an attribute list in the order the attributes are added, empty values are left out
+type attributeList []string
+
+func (a *attributeList) quoted(name, value string) {
+	if value != "" {
+		*a = append(*a, name+"=\""+value+"\"")
+	}
+}
+
+func (a *attributeList) enum(name, value string) {
+	if value != "" {
+		*a = append(*a, name+"="+value)
+	}
+}
+
+func (a *attributeList) number(name string, value uint64) {
+	*a = append(*a, name+"="+strconv.FormatUint(value, 10))
+}
+
+func (a *attributeList) scte35(name string, cue *SCTE35) {
+	if cue != nil {
+		a.enum(name, "0x"+strings.ToUpper(hex.EncodeToString(cue.Raw)))
+	}
+}
+
+func (a *attributeList) yes(name string, value bool) {
+	if value {
+		*a = append(*a, name+"=YES")
+	}
+}
+
+// unknown adds attributes kept as strings by the parser in name order. Their quotes were dropped,
+// values that do not look like numbers or enumerated strings are quoted again.
+func (a *attributeList) unknown(attrs map[string]string) {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if v := attrs[name]; unquotedValue.MatchString(v) {
+			a.enum(name, v)
+		} else {
+			*a = append(*a, name+"=\""+v+"\"")
+		}
+	}
+}
+
+func (a attributeList) String() string {
+	return strings.Join(a, ",")
+}
+
+// formatFloat formats a decimal attribute without trailing zeros
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,110 @@
+package parser
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeMediaPlaylist(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:7",
+		"#EXT-X-TARGETDURATION:6",
+		"#EXT-X-MEDIA-SEQUENCE:10",
+		"#EXT-X-PLAYLIST-TYPE:VOD",
+		"#EXT-X-INDEPENDENT-SEGMENTS",
+		`#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x000102030405060708090A0B0C0D0E0F`,
+		`#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"`,
+		"#EXT-X-PROGRAM-DATE-TIME:2024-05-01T10:00:00.000Z",
+		"#EXTINF:6,intro",
+		"#EXT-X-BYTERANGE:1000@720",
+		"main.mp4",
+		"#EXT-X-CUE-OUT:6",
+		"#EXTINF:6,",
+		"#EXT-X-BYTERANGE:1000",
+		"main.mp4",
+		"#EXT-X-CUE-IN",
+		"#EXT-X-DISCONTINUITY",
+		"#EXT-X-KEY:METHOD=NONE",
+		"#EXT-X-GAP",
+		"#EXTINF:5.5,",
+		"other.ts",
+		"#EXT-X-ENDLIST",
+	}, "\n")
+	m3u8, err := parse(strings.NewReader(content), false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Act
+	var buf bytes.Buffer
+	err = m3u8.Encode(&buf)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, tag := range []string{"#EXT-X-INDEPENDENT-SEGMENTS", "#EXT-X-GAP", "#EXT-X-CUE-OUT:6", "#EXT-X-CUE-IN", "#EXT-X-KEY:METHOD=NONE"} {
+		if !strings.Contains(buf.String(), tag+"\n") {
+			t.Errorf("Expected %s in the output, got\n%s", tag, buf.String())
+		}
+	}
+	again, err := parse(&buf, false)
+	if err != nil {
+		t.Fatalf("Expected the output to parse, got %v", err)
+	}
+	if len(again.Segments) != len(m3u8.Segments) || again.MediaSequence != 10 || !again.EndList || again.Version != 7 {
+		t.Fatalf("Unexpected playlist after round trip: %+v", again)
+	}
+	for i, seg := range again.Segments {
+		orig := m3u8.Segments[i]
+		if seg.URI != orig.URI || seg.Duration != orig.Duration || seg.Title != orig.Title || seg.Length != orig.Length ||
+			seg.Offset != orig.Offset || seg.KeyIndex != orig.KeyIndex || seg.Discontinuity != orig.Discontinuity ||
+			!seg.ProgramDateTime.Equal(orig.ProgramDateTime) || (seg.AdBreak == nil) != (orig.AdBreak == nil) ||
+			!reflect.DeepEqual(seg.UnknownTags, orig.UnknownTags) {
+			t.Errorf("Expected segment %d %+v, got %+v", i, orig, seg)
+		}
+	}
+	if !reflect.DeepEqual(again.Keys, m3u8.Keys) || !reflect.DeepEqual(again.Segments[0].Map, m3u8.Segments[0].Map) {
+		t.Errorf("Expected keys and map to survive the round trip")
+	}
+}
+
+func TestEncodeMasterPlaylist(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-INDEPENDENT-SEGMENTS",
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="en",NAME="English",DEFAULT=YES,AUTOSELECT=YES,URI="audio/en.m3u8"`,
+		`#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1920x1080,FRAME-RATE=29.970,CODECS="avc1.640028,mp4a.40.2",AUDIO="aac",CLOSED-CAPTIONS=NONE,X-CUSTOM="yes"`,
+		"1080/index.m3u8",
+		`#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,AUDIO="aac"`,
+		"360/index.m3u8",
+	}, "\n")
+	m3u8, err := parse(strings.NewReader(content), false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Act
+	var buf bytes.Buffer
+	err = m3u8.Encode(&buf)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	again, err := parse(&buf, false)
+	if err != nil {
+		t.Fatalf("Expected the output to parse, got %v", err)
+	}
+	if !reflect.DeepEqual(again.MasterPlaylist, m3u8.MasterPlaylist) || !reflect.DeepEqual(again.Media, m3u8.Media) {
+		t.Errorf("Expected variants and renditions to survive the round trip, got\n%s", buf.String())
+	}
+	if !reflect.DeepEqual(again.UnknownTags, []string{"#EXT-X-INDEPENDENT-SEGMENTS"}) {
+		t.Errorf("Expected unknown tags to be kept, got %v", again.UnknownTags)
+	}
+}
@@ -0,0 +1,241 @@
+package parser
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"loki/pkg/tools"
+)
+
+// HTTPKeyProvider fetches keys over HTTP, Header is sent with every request
+type HTTPKeyProvider struct {
+	Header http.Header
+}
+
+// Key requests and reads the key from the URI
+func (p *HTTPKeyProvider) Key(ctx context.Context, uri string) ([]byte, error) {
+	body, err := tools.GetWithHeader(ctx, uri, p.Header)
+	if err != nil {
+		return nil, fmt.Errorf("request key URL failed: %v", err)
+	}
+	defer body.Close()
+
+	keyData, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("read key data failed: %v", err)
+	}
+	return keyData, nil
+}
+
+// FileKeyProvider reads the key of every URI from a local file
+type FileKeyProvider struct {
+	Path string
+}
+
+// Key reads the key file
+func (p *FileKeyProvider) Key(context.Context, string) ([]byte, error) {
+	return os.ReadFile(p.Path)
+}
+
+// StaticKeyProvider returns the same key for every URI
+type StaticKeyProvider []byte
+
+// Key returns the static key
+func (p StaticKeyProvider) Key(context.Context, string) ([]byte, error) {
+	return p, nil
+}
+
+// NewHexKeyProvider returns a StaticKeyProvider for a hexadecimal key, 0x prefix optional
+func NewHexKeyProvider(s string) (StaticKeyProvider, error) {
+	key, err := hex.DecodeString(trimHexPrefix(s))
+	if err != nil || len(key) != 16 {
+		return nil, fmt.Errorf("invalid key %s: must be 128 bits of hex", s)
+	}
+	return key, nil
+}
+
+// DataKeyProvider decodes keys carried inline in RFC 2397 data: URIs
+type DataKeyProvider struct{}
+
+// Key decodes the data: URI
+func (DataKeyProvider) Key(_ context.Context, uri string) ([]byte, error) {
+	rest, ok := strings.CutPrefix(uri, "data:")
+	if !ok {
+		return nil, fmt.Errorf("not a data URI: %s", uri)
+	}
+	meta, data, ok := strings.Cut(rest, ",")
+	if !ok {
+		return nil, errors.New("invalid data URI: missing ','")
+	}
+	if strings.HasSuffix(meta, ";base64") {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	decoded, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data URI: %v", err)
+	}
+	return []byte(decoded), nil
+}
+
+// schemeKeyProvider picks a provider by URI scheme
+type schemeKeyProvider struct {
+	http KeyProvider
+}
+
+// Key decodes data: URIs, reads file: URIs and fetches everything else over HTTP
+func (p *schemeKeyProvider) Key(ctx context.Context, uri string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(uri, "data:"):
+		return DataKeyProvider{}.Key(ctx, uri)
+	case strings.HasPrefix(uri, "file://"):
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+		return (&FileKeyProvider{Path: u.Path}).Key(ctx, uri)
+	default:
+		return p.http.Key(ctx, uri)
+	}
+}
+
+// cachedKeyProvider remembers the keys returned by another provider
+type cachedKeyProvider struct {
+	provider KeyProvider
+	lock     sync.Mutex
+	calls    map[string]*keyCall
+}
+
+// keyCall is the fetch of one key URI, shared by everyone asking for it while it runs and after
+type keyCall struct {
+	done chan struct{} // closed once key and err are set
+	key  []byte
+	err  error
+}
+
+// NewCachedKeyProvider wraps a provider so each URI is requested once, even when a rotated key comes back
+func NewCachedKeyProvider(p KeyProvider) KeyProvider {
+	return &cachedKeyProvider{provider: p, calls: make(map[string]*keyCall)}
+}
+
+// Key returns the cached key or asks the wrapped provider. Keys of different URIs are fetched at the
+// same time, callers asking for a URI being fetched wait for that fetch. A failed fetch is not kept.
+func (p *cachedKeyProvider) Key(ctx context.Context, uri string) ([]byte, error) {
+	p.lock.Lock()
+	call, ok := p.calls[uri]
+	if !ok {
+		call = &keyCall{done: make(chan struct{})}
+		p.calls[uri] = call
+	}
+	p.lock.Unlock()
+
+	if ok {
+		select {
+		case <-call.done:
+			return call.key, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	call.key, call.err = p.provider.Key(ctx, uri)
+	if call.err != nil {
+		p.lock.Lock()
+		delete(p.calls, uri)
+		p.lock.Unlock()
+	}
+	close(call.done)
+	return call.key, call.err
+}
+
+// NewKeyProvider returns the default provider: data: and file: URIs are read locally, the rest is
+// fetched over HTTP with header, and every key is cached by URI
+func NewKeyProvider(header http.Header) KeyProvider {
+	return NewCachedKeyProvider(&schemeKeyProvider{http: &HTTPKeyProvider{Header: header}})
+}
+
+// fetchKeys retrieves decryption keys for the M3U8 segments
+func fetchKeys(ctx context.Context, result *Result, baseURL *url.URL, opts *Options) error {
+	for idx, key := range result.M3U8.Keys {
+		switch key.Method {
+		case "", CryptMethodNONE:
+			continue
+		case CryptMethodAES, CryptMethodSampleAES:
+			if !key.isIdentity() {
+				return fmt.Errorf("unsupported KEYFORMAT %s: only identity keys can be fetched", key.KeyFormat)
+			}
+			keyURL := resolveKeyURI(baseURL, key.URI)
+			keyData, err := opts.KeyProvider.Key(ctx, keyURL)
+			if err != nil {
+				return fmt.Errorf("extract key failed: %v", err)
+			}
+			keyData, err = normalizeKey(keyData)
+			if err != nil {
+				return fmt.Errorf("invalid key from %s: %v", keyURL, err)
+			}
+			iv := key.IV
+			if opts.IV != nil {
+				iv = opts.IV
+			}
+			result.Keys[idx] = &KeyMaterial{Method: key.Method, Key: keyData, IV: iv}
+		default:
+			return fmt.Errorf("unknown or unsupported encryption method: %s", key.Method)
+		}
+	}
+	return nil
+}
+
+// resolveKeyURI resolves a relative key URI, URIs with a scheme such as data: are kept as they are
+func resolveKeyURI(baseURL *url.URL, uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Scheme != "" {
+		return uri
+	}
+	return tools.ResolveURL(baseURL, uri)
+}
+
+// normalizeKey turns a key served as 16 raw bytes, 32 hex digits or base64 into 16 bytes
+func normalizeKey(data []byte) ([]byte, error) {
+	if len(data) == 16 {
+		return data, nil
+	}
+	s := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(trimHexPrefix(s)); err == nil && len(key) == 16 {
+		return key, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if key, err := enc.DecodeString(s); err == nil && len(key) == 16 {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("expected 16 bytes, got %d", len(data))
+}
+
+// ParseIV decodes a 128-bit hexadecimal IV, 0x prefix optional
+func ParseIV(s string) ([]byte, error) {
+	return decodeIV("0x" + trimHexPrefix(s))
+}
+
+// trimHexPrefix drops a 0x or 0X prefix
+func trimHexPrefix(s string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+}
+
+// IVFor returns the IV for the segment with the given media sequence number.
+// Without an IV attribute RFC 8216 uses the sequence number as a big-endian 128-bit integer.
+func (k *KeyMaterial) IVFor(sequence uint64) []byte {
+	if k.IV != nil {
+		return k.IV
+	}
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint64(iv[8:], sequence)
+	return iv
+}
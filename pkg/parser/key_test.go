@@ -0,0 +1,141 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingKeyProvider counts how often each URI is requested
+type countingKeyProvider map[string]int
+
+func (p countingKeyProvider) Key(_ context.Context, uri string) ([]byte, error) {
+	p[uri]++
+	return []byte("000102030405060708090a0b0c0d0e0f\n"), nil
+}
+
+func TestNormalizeKey(t *testing.T) {
+	expected := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	encoded := map[string][]byte{
+		"raw":    expected,
+		"hex":    []byte("0x000102030405060708090A0B0C0D0E0F"),
+		"base64": []byte("AAECAwQFBgcICQoLDA0ODw==\r\n"),
+	}
+
+	for name, data := range encoded {
+		key, err := normalizeKey(data)
+		if err != nil || !bytes.Equal(key, expected) {
+			t.Errorf("Expected %s key to normalize to %x, got %x (%v)", name, expected, key, err)
+		}
+	}
+	if _, err := normalizeKey([]byte("too short")); err == nil {
+		t.Error("Expected error, but got nil")
+	}
+}
+
+func TestDataKeyProvider(t *testing.T) {
+	// Act
+	key, err := DataKeyProvider{}.Key(context.Background(), "data:application/octet-stream;base64,AAECAwQFBgcICQoLDA0ODw==")
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(key) != 16 || key[15] != 15 {
+		t.Errorf("Unexpected key %x", key)
+	}
+}
+
+func TestCachedKeyProviderFetchesRotatedKeysOnce(t *testing.T) {
+	// Arrange
+	counter := countingKeyProvider{}
+	m3u8 := &M3U8{Keys: map[int]*Key{
+		1: {Method: CryptMethodAES, URI: "k1.bin"},
+		2: {Method: CryptMethodAES, URI: "k2.bin"},
+		3: {Method: CryptMethodAES, URI: "k1.bin"},
+	}}
+	result := &Result{URL: mustParseURL(t, "https://example.com/live/index.m3u8"), M3U8: m3u8, Keys: make(map[int]*KeyMaterial)}
+	iv := bytes.Repeat([]byte{7}, 16)
+
+	// Act
+	err := fetchKeys(context.Background(), result, result.URL, &Options{KeyProvider: NewCachedKeyProvider(counter), IV: iv})
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if counter["https://example.com/live/k1.bin"] != 1 || counter["https://example.com/live/k2.bin"] != 1 {
+		t.Errorf("Expected each key URI to be fetched once, got %v", counter)
+	}
+	if len(result.Keys[3].Key) != 16 || !bytes.Equal(result.Keys[3].IV, iv) {
+		t.Errorf("Expected normalized key with IV override, got %+v", result.Keys[3])
+	}
+}
+
+// blockingKeyProvider holds the fetch of slow until release is closed
+type blockingKeyProvider struct {
+	slow    string
+	release chan struct{}
+	lock    sync.Mutex
+	counts  map[string]int
+}
+
+func (p *blockingKeyProvider) Key(_ context.Context, uri string) ([]byte, error) {
+	p.lock.Lock()
+	p.counts[uri]++
+	p.lock.Unlock()
+	if uri == p.slow {
+		<-p.release
+	}
+	return []byte(uri), nil
+}
+
+func TestCachedKeyProviderFetchesURIsConcurrently(t *testing.T) {
+	// Arrange
+	blocking := &blockingKeyProvider{slow: "slow", release: make(chan struct{}), counts: make(map[string]int)}
+	cached := NewCachedKeyProvider(blocking)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if key, err := cached.Key(context.Background(), "slow"); err != nil || string(key) != "slow" {
+				t.Errorf("Expected key slow, got %q, %v", key, err)
+			}
+		}()
+	}
+
+	// Act
+	fast := make(chan []byte)
+	go func() {
+		key, _ := cached.Key(context.Background(), "fast")
+		fast <- key
+	}()
+
+	// Assert
+	select {
+	case key := <-fast:
+		if string(key) != "fast" {
+			t.Errorf("Expected key fast, got %q", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected another URI to be fetched while the slow one is pending")
+	}
+	close(blocking.release)
+	wg.Wait()
+	if blocking.counts["slow"] != 1 {
+		t.Errorf("Expected the slow key to be fetched once, got %d", blocking.counts["slow"])
+	}
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
@@ -0,0 +1,97 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseExtPart parses an EXT-X-PART tag, partEnd tracks where the previous byte range of each URI ended
+// so that a BYTERANGE without offset can continue from it
+func parseExtPart(line string, partEnd map[string]uint64) (*Part, error) {
+	params := parseLineParameters(line)
+	part := &Part{
+		URI:         params["URI"],
+		Independent: params["INDEPENDENT"] == "YES",
+		Gap:         params["GAP"] == "YES",
+	}
+	if part.URI == "" {
+		return nil, fmt.Errorf("invalid EXT-X-PART, missing URI")
+	}
+	duration, err := strconv.ParseFloat(params["DURATION"], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EXT-X-PART DURATION: %v", err)
+	}
+	part.Duration = duration
+
+	if b, ok := params["BYTERANGE"]; ok {
+		length, offset, found := strings.Cut(b, "@")
+		if part.Length, err = strconv.ParseUint(length, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid EXT-X-PART BYTERANGE: %s", b)
+		}
+		part.Offset = partEnd[part.URI]
+		if found {
+			if part.Offset, err = strconv.ParseUint(offset, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid EXT-X-PART BYTERANGE: %s", b)
+			}
+		}
+		partEnd[part.URI] = part.Offset + part.Length
+	}
+	return part, nil
+}
+
+func parsePreloadHint(line string) (*PreloadHint, error) {
+	params := parseLineParameters(line)
+	hint := &PreloadHint{Type: params["TYPE"], URI: params["URI"]}
+	if (hint.Type != "PART" && hint.Type != "MAP") || hint.URI == "" {
+		return nil, fmt.Errorf("invalid EXT-X-PRELOAD-HINT: %s", line)
+	}
+	var err error
+	if v, ok := params["BYTERANGE-START"]; ok {
+		if hint.Offset, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid EXT-X-PRELOAD-HINT BYTERANGE-START: %v", err)
+		}
+	}
+	if v, ok := params["BYTERANGE-LENGTH"]; ok {
+		if hint.Length, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid EXT-X-PRELOAD-HINT BYTERANGE-LENGTH: %v", err)
+		}
+	}
+	return hint, nil
+}
+
+func parseServerControl(line string) (*ServerControl, error) {
+	sc := new(ServerControl)
+	for k, v := range parseLineParameters(line) {
+		var err error
+		switch k {
+		case "CAN-BLOCK-RELOAD":
+			sc.CanBlockReload = v == "YES"
+		case "CAN-SKIP-DATERANGES":
+			sc.CanSkipDateRanges = v == "YES"
+		case "CAN-SKIP-UNTIL":
+			sc.CanSkipUntil, err = strconv.ParseFloat(v, 64)
+		case "HOLD-BACK":
+			sc.HoldBack, err = strconv.ParseFloat(v, 64)
+		case "PART-HOLD-BACK":
+			sc.PartHoldBack, err = strconv.ParseFloat(v, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid EXT-X-SERVER-CONTROL %s: %v", k, err)
+		}
+	}
+	return sc, nil
+}
+
+func parseExtSkip(line string) (*Skip, error) {
+	params := parseLineParameters(line)
+	skipped, err := strconv.ParseUint(params["SKIPPED-SEGMENTS"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EXT-X-SKIP SKIPPED-SEGMENTS: %v", err)
+	}
+	skip := &Skip{SkippedSegments: skipped}
+	if removed := params["RECENTLY-REMOVED-DATERANGES"]; removed != "" {
+		skip.RecentlyRemovedDateRanges = strings.Split(removed, "\t")
+	}
+	return skip, nil
+}
@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/url"
@@ -8,40 +9,84 @@ import (
 	"loki/pkg/tools"
 )
 
-// Parse parses the provided endpoint and returns a Result
-func Parse(endpoint string) (*Result, error) {
+// Parse parses the provided endpoint and returns a Result, requests are aborted when ctx is done
+func Parse(ctx context.Context, endpoint string, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.KeyProvider == nil {
+		// Share one cache between the variant, its renditions and their keys
+		withKeys := *opts
+		withKeys.KeyProvider = NewKeyProvider(nil)
+		opts = &withKeys
+	}
+
 	u, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("invalid URL: %v", err)
 	}
 
-	body, err := tools.Get(u.String())
+	body, err := tools.Get(ctx, u.String())
 	if err != nil {
 		return nil, err
 	}
 	defer body.Close()
 
-	m3u8, err := parse(body)
+	m3u8, err := parse(body, opts.Lenient)
 	if err != nil {
-		return nil, fmt.Errorf("parse m3u8 failed: %v", err)
+		return nil, fmt.Errorf("parse m3u8 failed: %w", err)
 	}
 
 	if len(m3u8.MasterPlaylist) > 0 {
-		sf := m3u8.MasterPlaylist[0]
-		return Parse(tools.ResolveURL(u, sf.URI))
+		// Redundant copies of a variant are not candidates of their own, they back up the chosen one
+		pathways := pathwayPriority(ctx, m3u8, u)
+		primaries, copies := GroupRedundant(m3u8.MasterPlaylist, pathways)
+		variant, rejected, err := opts.Variant.Select(primaries)
+		if err != nil {
+			return nil, err
+		}
+		variants := append([]*MasterPlaylist{variant}, copies[variant]...)
+		uris := make([]string, 0, len(variants))
+		for _, v := range variants {
+			uris = append(uris, v.URI)
+		}
+		result, primary, err := parseCopies(ctx, u, uris, opts)
+		if err != nil {
+			return nil, err
+		}
+		result.Master = m3u8
+		result.Variant = variants[primary]
+		result.Rejected = rejected
+		result.Pathways = pathways
+
+		for _, media := range selectRenditions(m3u8, result.Variant, opts.Languages) {
+			uris := []string{media.URI}
+			for _, v := range variants {
+				if backup := backupMedia(m3u8, media, v); backup != nil {
+					uris = append(uris, backup.URI)
+				}
+			}
+			rendition, _, err := parseCopies(ctx, u, uris, opts)
+			if err != nil {
+				return nil, fmt.Errorf("parse %s rendition %q failed: %w", media.Type, media.Name, err)
+			}
+			result.Renditions = append(result.Renditions, &Rendition{Media: media, Result: rendition})
+		}
+		return result, nil
 	}
 
-	if len(m3u8.Segments) == 0 {
+	// A live playlist may be empty until the first segment is published
+	if len(m3u8.Segments) == 0 && (m3u8.EndList || m3u8.PlaylistType == PlaylistTypeVOD) {
 		return nil, errors.New("no TS file description found in the M3U8 file")
 	}
 
 	result := &Result{
 		URL:  u,
 		M3U8: m3u8,
-		Keys: make(map[int]string),
+		Keys: make(map[int]*KeyMaterial),
 	}
 
-	if err := fetchKeys(result, u); err != nil {
+	if err := fetchKeys(ctx, result, u, opts); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,78 @@
+package parser
+
+import (
+	"log"
+	"strings"
+)
+
+// selectRenditions returns the EXT-X-MEDIA entries that have to be fetched next to the variant.
+// Renditions without a URI are muxed into the variant stream and are skipped.
+func selectRenditions(master *M3U8, variant *MasterPlaylist, languages []string) []*Media {
+	var selected []*Media
+	groups := []struct {
+		mediaType MediaType
+		groupID   string
+	}{
+		{MediaTypeAudio, variant.Audio},
+		{MediaTypeSubtitles, variant.Subtitles},
+	}
+
+	for _, g := range groups {
+		if g.groupID == "" {
+			continue
+		}
+		var group []*Media
+		for _, m := range master.Media {
+			if m.Type == g.mediaType && m.GroupID == g.groupID && m.URI != "" {
+				group = append(group, m)
+			}
+		}
+		if len(group) == 0 {
+			continue
+		}
+
+		if len(languages) > 0 {
+			var matched []*Media
+			for _, m := range group {
+				if matchLanguage(m.Language, languages) {
+					matched = append(matched, m)
+				}
+			}
+			if len(matched) > 0 {
+				selected = append(selected, matched...)
+				continue
+			}
+			log.Printf("[warning] no %s rendition of group %q in %s, falling back to the default one",
+				strings.ToLower(string(g.mediaType)), g.groupID, strings.Join(languages, ","))
+		}
+
+		// Without a language filter, or when none matches, follow what a player would pick on its own
+		var chosen *Media
+		for _, m := range group {
+			if m.Default {
+				chosen = m
+				break
+			}
+		}
+		if chosen == nil && g.mediaType == MediaTypeAudio {
+			chosen = group[0]
+		}
+		if chosen != nil {
+			selected = append(selected, chosen)
+		}
+	}
+
+	return selected
+}
+
+// matchLanguage reports whether an RFC 5646 tag matches any of the wanted languages, "en" matches "en-US"
+func matchLanguage(tag string, languages []string) bool {
+	tag = strings.ToLower(tag)
+	for _, l := range languages {
+		l = strings.ToLower(l)
+		if tag == l || strings.HasPrefix(tag, l+"-") {
+			return true
+		}
+	}
+	return false
+}
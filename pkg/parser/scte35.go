@@ -0,0 +1,211 @@
+package parser
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errTruncatedSCTE35 = errors.New("invalid SCTE-35: truncated splice_info_section")
+
+// decodeSCTE35 decodes a splice_info_section written as 0x prefixed hex or base64
+func decodeSCTE35(s string) (*SCTE35, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if h := trimHexPrefix(s); len(h) != len(s) {
+		data, err = hex.DecodeString(h)
+	} else {
+		data, err = base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid SCTE-35 %s: %v", s, err)
+	}
+	return parseSCTE35(data)
+}
+
+// parseSCTE35 reads the command and segmentation descriptors of a splice_info_section,
+// only what tells whether an ad break starts or ends is kept
+func parseSCTE35(data []byte) (*SCTE35, error) {
+	if len(data) < 14 || data[0] != spliceInfoTable {
+		return nil, errors.New("invalid SCTE-35: not a splice_info_section")
+	}
+	size := int(binary.BigEndian.Uint16(data[1:])&0x0fff) + 3
+	if size > len(data) {
+		return nil, errTruncatedSCTE35
+	}
+	data = data[:size]
+	if data[4]&0x80 != 0 {
+		return nil, errors.New("invalid SCTE-35: encrypted splice commands are not supported")
+	}
+
+	cue := &SCTE35{Command: data[13], Raw: data}
+	commandLength := int(binary.BigEndian.Uint16(data[11:]) & 0x0fff)
+	command := data[14:]
+
+	var (
+		n   int
+		err error
+	)
+	switch cue.Command {
+	case spliceInsert:
+		n, err = cue.readSpliceInsert(command)
+	case timeSignal:
+		n, err = spliceTimeLength(command)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Legacy encoders write 0xfff when they do not know the length
+	if commandLength == 0xfff {
+		commandLength = n
+	}
+
+	descriptors := command[min(commandLength, len(command)):]
+	if len(descriptors) < 2 {
+		return cue, nil
+	}
+	loop := descriptors[2:min(2+int(binary.BigEndian.Uint16(descriptors)), len(descriptors))]
+	for len(loop) >= 2 {
+		tag, length := loop[0], int(loop[1])
+		if 2+length > len(loop) {
+			return nil, errTruncatedSCTE35
+		}
+		if tag == segmentationDescriptor && cue.Command == timeSignal && !cue.Out && !cue.In {
+			if err := cue.readSegmentation(loop[2 : 2+length]); err != nil {
+				return nil, err
+			}
+		}
+		loop = loop[2+length:]
+	}
+	return cue, nil
+}
+
+// readSpliceInsert reads a splice_insert command and returns its length
+func (cue *SCTE35) readSpliceInsert(b []byte) (int, error) {
+	if len(b) < 5 {
+		return 0, errTruncatedSCTE35
+	}
+	cue.EventID = binary.BigEndian.Uint32(b)
+	if b[4]&0x80 != 0 {
+		// splice_event_cancel_indicator, nothing else follows
+		return 5, nil
+	}
+	if len(b) < 6 {
+		return 0, errTruncatedSCTE35
+	}
+	flags := b[5]
+	outOfNetwork, program, duration, immediate := flags&0x80 != 0, flags&0x40 != 0, flags&0x20 != 0, flags&0x10 != 0
+
+	n := 6
+	if program && !immediate {
+		length, err := spliceTimeLength(b[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += length
+	}
+	if !program {
+		if len(b) < n+1 {
+			return 0, errTruncatedSCTE35
+		}
+		components := int(b[n])
+		n++
+		for i := 0; i < components; i++ {
+			n++ // component_tag
+			if !immediate {
+				if len(b) < n {
+					return 0, errTruncatedSCTE35
+				}
+				length, err := spliceTimeLength(b[n:])
+				if err != nil {
+					return 0, err
+				}
+				n += length
+			}
+		}
+	}
+	if duration {
+		if len(b) < n+5 {
+			return 0, errTruncatedSCTE35
+		}
+		cue.Duration = float64(readTicks(b[n:n+5])) / 90000
+		n += 5
+	}
+	// unique_program_id, avail_num and avails_expected
+	n += 4
+
+	cue.Out, cue.In = outOfNetwork, !outOfNetwork
+	return n, nil
+}
+
+// readSegmentation reads a segmentation_descriptor of a time_signal
+func (cue *SCTE35) readSegmentation(b []byte) error {
+	// identifier "CUEI", segmentation_event_id and the cancel indicator
+	if len(b) < 9 {
+		return errTruncatedSCTE35
+	}
+	if b[8]&0x80 != 0 {
+		return nil
+	}
+	if len(b) < 10 {
+		return errTruncatedSCTE35
+	}
+	flags := b[9]
+	n := 10
+	if flags&0x80 == 0 {
+		// component_count followed by 6 bytes per component
+		if len(b) < n+1 {
+			return errTruncatedSCTE35
+		}
+		n += 1 + 6*int(b[n])
+	}
+	var duration float64
+	if flags&0x40 != 0 {
+		if len(b) < n+5 {
+			return errTruncatedSCTE35
+		}
+		duration = float64(binary.BigEndian.Uint64(append([]byte{0, 0, 0}, b[n:n+5]...))) / 90000
+		n += 5
+	}
+	// segmentation_upid_type, segmentation_upid_length and the upid
+	if len(b) < n+2 {
+		return errTruncatedSCTE35
+	}
+	n += 2 + int(b[n+1])
+	if len(b) < n+1 {
+		return errTruncatedSCTE35
+	}
+
+	typ := b[n]
+	cue.Out, cue.In = adSegmentationTypes[typ], adSegmentationTypes[typ-1]
+	if cue.Out || cue.In {
+		cue.EventID = binary.BigEndian.Uint32(b[4:])
+		cue.SegmentationType = typ
+		cue.Duration = duration
+	}
+	return nil
+}
+
+// spliceTimeLength returns the length of a splice_time structure
+func spliceTimeLength(b []byte) (int, error) {
+	if len(b) < 1 {
+		return 0, errTruncatedSCTE35
+	}
+	if b[0]&0x80 != 0 {
+		if len(b) < 5 {
+			return 0, errTruncatedSCTE35
+		}
+		return 5, nil
+	}
+	return 1, nil
+}
+
+// readTicks decodes the 33-bit 90 kHz value at the end of a 5 byte field
+func readTicks(b []byte) uint64 {
+	return uint64(b[0]&0x01)<<32 | uint64(binary.BigEndian.Uint32(b[1:]))
+}
@@ -0,0 +1,164 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"loki/pkg/tools"
+)
+
+// parseContentSteering parses an EXT-X-CONTENT-STEERING tag
+func parseContentSteering(line string) (*ContentSteering, error) {
+	params := parseLineParameters(line)
+	cs := &ContentSteering{ServerURI: params["SERVER-URI"], PathwayID: params["PATHWAY-ID"]}
+	if cs.ServerURI == "" {
+		return nil, errors.New("invalid EXT-X-CONTENT-STEERING, missing SERVER-URI")
+	}
+	return cs, nil
+}
+
+// fetchSteeringManifest loads the content steering manifest at uri
+func fetchSteeringManifest(ctx context.Context, uri string) (*SteeringManifest, error) {
+	body, err := tools.Get(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	manifest := new(SteeringManifest)
+	if err := json.NewDecoder(body).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("invalid steering manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+// pathwayPriority returns the content steering pathways of the master playlist in the order they
+// are tried. The steering manifest decides when it loads, otherwise the PATHWAY-ID of the tag comes
+// first. Pathways it does not list are kept at the end as a last resort.
+func pathwayPriority(ctx context.Context, master *M3U8, base *url.URL) []string {
+	cs := master.ContentSteering
+	if cs == nil {
+		return nil
+	}
+
+	var priority []string
+	if manifest, err := fetchSteeringManifest(ctx, tools.ResolveURL(base, cs.ServerURI)); err == nil {
+		priority = manifest.PathwayPriority
+	}
+	if len(priority) == 0 && cs.PathwayID != "" {
+		priority = []string{cs.PathwayID}
+	}
+
+	seen := make(map[string]bool)
+	var pathways []string
+	for _, id := range priority {
+		if !seen[id] {
+			seen[id] = true
+			pathways = append(pathways, id)
+		}
+	}
+	for _, mp := range master.MasterPlaylist {
+		if id := mp.pathway(); !seen[id] {
+			seen[id] = true
+			pathways = append(pathways, id)
+		}
+	}
+	return pathways
+}
+
+// GroupRedundant groups variants that only differ by URI and pathway, they are copies of the same
+// stream on other hosts. It returns the first copy of every group by pathway priority, and the
+// other copies of each in failover order.
+func GroupRedundant(variants []*MasterPlaylist, pathways []string) ([]*MasterPlaylist, map[*MasterPlaylist][]*MasterPlaylist) {
+	rank := make(map[string]int)
+	for i, id := range pathways {
+		rank[id] = i
+	}
+
+	var keys []string
+	groups := make(map[string][]*MasterPlaylist)
+	for _, mp := range variants {
+		key := mp.redundancyKey()
+		if groups[key] == nil {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], mp)
+	}
+
+	primaries := make([]*MasterPlaylist, 0, len(keys))
+	copies := make(map[*MasterPlaylist][]*MasterPlaylist)
+	for _, key := range keys {
+		group := groups[key]
+		sort.SliceStable(group, func(i, j int) bool {
+			return rank[group[i].pathway()] < rank[group[j].pathway()]
+		})
+		primaries = append(primaries, group[0])
+		if len(group) > 1 {
+			copies[group[0]] = group[1:]
+		}
+	}
+	return primaries, copies
+}
+
+// redundancyKey returns what redundant copies of a variant have in common
+func (mp *MasterPlaylist) redundancyKey() string {
+	return fmt.Sprintf("%d|%s|%s|%g|%s|%s", mp.BandWidth, mp.Resolution, mp.Codecs, mp.FrameRate, mp.VideoRange, mp.HDCPLevel)
+}
+
+// pathway returns the PATHWAY-ID of the variant, "." when it has none
+func (mp *MasterPlaylist) pathway() string {
+	if mp.PathwayID == "" {
+		return defaultPathwayID
+	}
+	return mp.PathwayID
+}
+
+// backupMedia returns the rendition of a redundant variant matching media, nil when the
+// variant shares the rendition or has no such one
+func backupMedia(master *M3U8, media *Media, backup *MasterPlaylist) *Media {
+	groupID := backup.Audio
+	if media.Type == MediaTypeSubtitles {
+		groupID = backup.Subtitles
+	}
+	for _, m := range master.Media {
+		if m.Type == media.Type && m.GroupID == groupID && m.Name == media.Name && m.Language == media.Language &&
+			m.URI != "" && m.URI != media.URI {
+			return m
+		}
+	}
+	return nil
+}
+
+// parseCopies parses redundant copies of a playlist. The first one that loads is returned with the
+// others as its backups, together with its position in uris.
+func parseCopies(ctx context.Context, base *url.URL, uris []string, opts *Options) (*Result, int, error) {
+	var (
+		result   *Result
+		primary  int
+		firstErr error
+	)
+	for i, uri := range uris {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		r, err := Parse(ctx, tools.ResolveURL(base, uri), opts)
+		switch {
+		case err != nil:
+			if firstErr == nil {
+				firstErr = err
+			}
+		case result == nil:
+			result, primary = r, i
+		default:
+			result.Backups = append(result.Backups, r)
+		}
+	}
+	if result == nil {
+		return nil, 0, firstErr
+	}
+	return result, primary, nil
+}
@@ -1,18 +1,73 @@
 package parser
 
-import "net/url"
+import (
+	"context"
+	"net/url"
+	"time"
+)
 
 type (
 	// PlaylistType is the type of playlist
 	PlaylistType string
 	// CryptMethod is the method of encryption
 	CryptMethod string
+	// VariantPolicy is the rule used to pick one EXT-X-STREAM-INF entry
+	VariantPolicy string
+	// MediaType is the TYPE of an EXT-X-MEDIA rendition
+	MediaType string
+
+	// Options controls how Parse resolves a playlist
+	Options struct {
+		Variant     VariantSelector
+		Languages   []string    // EXT-X-MEDIA languages to fetch, the DEFAULT rendition when empty
+		KeyProvider KeyProvider // where EXT-X-KEY keys come from, NewKeyProvider(nil) when nil
+		IV          []byte      // overrides the IV of every key when set
+		Lenient     bool        // skip lines that cannot be parsed and report them in M3U8.Warnings
+	}
+
+	// ParseError is a playlist line that could not be parsed
+	ParseError struct {
+		Line int    // 1-based line number
+		Tag  string // tag name such as #EXT-X-KEY, empty for URI lines
+		Err  error
+	}
+
+	// KeyProvider returns the key behind an EXT-X-KEY URI, raw or hex or base64 encoded
+	KeyProvider interface {
+		Key(ctx context.Context, uri string) ([]byte, error)
+	}
+
+	// VariantSelector picks a variant from a master playlist
+	VariantSelector struct {
+		Policy       VariantPolicy // highest, lowest, resolution or first; highest when empty
+		Resolution   string        // target resolution, e.g. 1280x720
+		MaxBandwidth uint32        // variants above this BANDWIDTH are rejected, 0 means no cap
+		Codecs       []string      // preferred codec prefixes in order, e.g. avc1, hvc1
+	}
+
+	// Rejection explains why a variant was not chosen
+	Rejection struct {
+		Variant *MasterPlaylist
+		Reason  string
+	}
 
 	// Result model
 	Result struct {
-		URL  *url.URL
-		M3U8 *M3U8
-		Keys map[int]string
+		URL        *url.URL
+		M3U8       *M3U8
+		Keys       map[int]*KeyMaterial // fetched keys by EXT-X-KEY index
+		Master     *M3U8                // nil when the endpoint is a media playlist
+		Variant    *MasterPlaylist      // nil when the endpoint is a media playlist
+		Rejected   []*Rejection
+		Renditions []*Rendition // alternate audio and subtitle playlists linked to Variant
+		Backups    []*Result    // redundant copies of the playlist on other hosts or steering pathways, in failover order
+		Pathways   []string     // content steering pathways in priority order, empty without EXT-X-CONTENT-STEERING
+	}
+
+	// Rendition is an EXT-X-MEDIA playlist fetched alongside the chosen variant
+	Rendition struct {
+		Media  *Media
+		Result *Result
 	}
 
 	// M3U8 model
@@ -21,37 +76,207 @@ type (
 		MediaSequence  uint64 // Default 0, #EXT-X-MEDIA-SEQUENCE:sequence
 		Segments       []*Segment
 		MasterPlaylist []*MasterPlaylist
+		Media          []*Media // #EXT-X-MEDIA
 		Keys           map[int]*Key
 		EndList        bool         // #EXT-X-ENDLIST
 		PlaylistType   PlaylistType // VOD or EVENT
 		TargetDuration float64      // #EXT-X-TARGETDURATION:duration
+
+		DiscontinuitySequence uint64 // #EXT-X-DISCONTINUITY-SEQUENCE:number
+
+		Warnings    []*ParseError // lines skipped in lenient mode
+		UnknownTags []string      // tags the parser does not handle that are not followed by a segment
+
+		ContentSteering *ContentSteering // #EXT-X-CONTENT-STEERING
+
+		DateRanges []*DateRange // #EXT-X-DATERANGE in playlist order
+		AdBreaks   []*AdBreak   // ad breaks signalled by EXT-X-DATERANGE, EXT-X-CUE-OUT or EXT-OATCLS-SCTE35
+
+		// Low-Latency HLS
+		ServerControl *ServerControl // #EXT-X-SERVER-CONTROL
+		PartTarget    float64        // #EXT-X-PART-INF:PART-TARGET=duration
+		Skip          *Skip          // #EXT-X-SKIP, set on playlist delta updates
+		PendingParts  []*Part        // parts of the segment that is still being produced
+		PreloadHints  []*PreloadHint // #EXT-X-PRELOAD-HINT
 	}
 
 	// Segment model
 	Segment struct {
 		URI      string
+		Sequence uint64 // media sequence number, EXT-X-MEDIA-SEQUENCE plus the position in the playlist
 		KeyIndex int
 		Title    string  // #EXTINF: duration,<title>
 		Duration float32 // #EXTINF: duration,<title>
 		Length   uint64  // #EXT-X-BYTERANGE: length[@offset]
 		Offset   uint64  // #EXT-X-BYTERANGE: length[@offset]
+		Map      *Map    // #EXT-X-MAP in effect, nil for self-initializing segments such as MPEG-TS
+		Parts    []*Part // #EXT-X-PART entries of the segment, only listed close to the live edge
+
+		Discontinuity         bool   // #EXT-X-DISCONTINUITY before the segment
+		DiscontinuitySequence uint64 // discontinuity sequence number the segment belongs to
+
+		ProgramDateTime time.Time // #EXT-X-PROGRAM-DATE-TIME, carried forward from earlier segments with their durations
+
+		AdBreak *AdBreak // ad break the segment belongs to, nil for program content
+
+		UnknownTags []string // tags the parser does not handle listed before the segment
+	}
+
+	// Part #EXT-X-PART:DURATION=0.33334,URI="part1.mp4",INDEPENDENT=YES
+	Part struct {
+		URI         string
+		Duration    float64
+		Independent bool
+		Gap         bool
+		Length      uint64 // BYTERANGE length, 0 means the whole resource
+		Offset      uint64
+		KeyIndex    int
+		Map         *Map
+
+		DiscontinuitySequence uint64 // discontinuity sequence number of the parent segment
+
+		AdBreak *AdBreak // ad break the part belongs to, nil for program content
+	}
+
+	// PreloadHint #EXT-X-PRELOAD-HINT:TYPE=PART,URI="part2.mp4"
+	PreloadHint struct {
+		Type   string // PART or MAP
+		URI    string
+		Offset uint64 // BYTERANGE-START
+		Length uint64 // BYTERANGE-LENGTH, 0 means until the end of the resource
+	}
+
+	// ServerControl #EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=36,PART-HOLD-BACK=1.0
+	ServerControl struct {
+		CanBlockReload    bool
+		CanSkipUntil      float64
+		CanSkipDateRanges bool
+		HoldBack          float64
+		PartHoldBack      float64
+	}
+
+	// Skip #EXT-X-SKIP:SKIPPED-SEGMENTS=20
+	Skip struct {
+		SkippedSegments           uint64
+		RecentlyRemovedDateRanges []string
+	}
+
+	// DateRange #EXT-X-DATERANGE:ID="ad1",START-DATE="2024-05-01T10:00:00Z",PLANNED-DURATION=30,SCTE35-OUT=0xFC30...
+	DateRange struct {
+		ID               string
+		Class            string
+		StartDate        time.Time
+		EndDate          time.Time // zero when absent
+		Duration         float64   // DURATION in seconds, 0 when absent
+		PlannedDuration  float64   // PLANNED-DURATION in seconds, 0 when absent
+		EndOnNext        bool      // END-ON-NEXT=YES, the range ends where the next one of the same CLASS starts
+		SCTE35Cmd        *SCTE35
+		SCTE35Out        *SCTE35
+		SCTE35In         *SCTE35
+		ClientAttributes map[string]string // X-<client-attribute>
+	}
+
+	// AdBreak is a run of segments that an ad marker takes out of the program
+	AdBreak struct {
+		ID        string    // EXT-X-DATERANGE ID, empty for cue tags
+		Source    string    // tag that opened the break, e.g. EXT-X-CUE-OUT
+		StartDate time.Time // zero when the playlist has no EXT-X-PROGRAM-DATE-TIME
+		Duration  float64   // signalled duration in seconds, 0 when unknown
+		Out       *SCTE35   // splice that opened the break, nil when not signalled
+		In        *SCTE35   // splice that closed the break, nil when not signalled
+	}
+
+	// SCTE35 is a decoded SCTE-35 splice_info_section
+	SCTE35 struct {
+		Command          uint8   // splice_command_type: 0x05 splice_insert, 0x06 time_signal
+		EventID          uint32  // splice_event_id or segmentation_event_id
+		Out              bool    // leaves the network feed, an ad break starts
+		In               bool    // returns to the network feed, the ad break ends
+		Duration         float64 // break or segmentation duration in seconds, 0 when not signalled
+		SegmentationType uint8   // segmentation_type_id of a time_signal, 0 when absent
+		Raw              []byte
+	}
+
+	// Map #EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+	Map struct {
+		URI      string
+		Length   uint64 // 0 means the whole resource
+		Offset   uint64
+		KeyIndex int // EXT-X-KEY in effect when the tag appeared
 	}
 
 	// MasterPlaylist #EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=240000,RESOLUTION=416x234,CODECS="avc1.42e00a,mp4a.40.2"
 	MasterPlaylist struct {
-		URI        string
-		BandWidth  uint32
-		Resolution string
-		Codecs     string
-		ProgramID  uint32
+		URI              string
+		BandWidth        uint32     // BANDWIDTH
+		AverageBandwidth uint32     // AVERAGE-BANDWIDTH
+		Resolution       Resolution // RESOLUTION
+		FrameRate        float64    // FRAME-RATE
+		Codecs           string     // CODECS
+		ProgramID        uint32     // PROGRAM-ID, removed in protocol version 6 but still common
+		HDCPLevel        string     // HDCP-LEVEL: TYPE-0, TYPE-1 or NONE
+		VideoRange       string     // VIDEO-RANGE: SDR, HLG or PQ
+		Audio            string     // AUDIO group ID
+		Video            string     // VIDEO group ID
+		Subtitles        string     // SUBTITLES group ID
+		ClosedCaptions   string     // CLOSED-CAPTIONS group ID or NONE
+		StableVariantID  string     // STABLE-VARIANT-ID
+		PathwayID        string     // PATHWAY-ID, the content steering pathway serving the variant
+		Unknown          map[string]string
+	}
+
+	// Media #EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="en",NAME="English",DEFAULT=YES,URI="en/index.m3u8"
+	Media struct {
+		Type            MediaType // AUDIO, VIDEO, SUBTITLES or CLOSED-CAPTIONS
+		URI             string    // empty when the rendition is muxed into the variant
+		GroupID         string
+		Language        string
+		AssocLanguage   string
+		Name            string
+		Default         bool
+		AutoSelect      bool
+		Forced          bool
+		InstreamID      string
+		Characteristics string
+		Channels        string
+		Unknown         map[string]string
 	}
 
-	// Key #EXT-X-KEY:METHOD=AES-128,URI="key.key"
+	// ContentSteering #EXT-X-CONTENT-STEERING:SERVER-URI="/steering?video=00012",PATHWAY-ID="CDN-A"
+	ContentSteering struct {
+		ServerURI string
+		PathwayID string // pathway used until the steering manifest is loaded
+	}
+
+	// SteeringManifest is the JSON document served at the content steering SERVER-URI
+	SteeringManifest struct {
+		Version         int      `json:"VERSION"`
+		TTL             int      `json:"TTL"`
+		ReloadURI       string   `json:"RELOAD-URI"`
+		PathwayPriority []string `json:"PATHWAY-PRIORITY"`
+	}
+
+	// Resolution #EXT-X-STREAM-INF:RESOLUTION=<width>x<height>
+	Resolution struct {
+		Width  int
+		Height int
+	}
+
+	// Key #EXT-X-KEY:METHOD=AES-128,URI="key.key",IV=0x0123456789abcdef0123456789abcdef
 	Key struct {
 		// 'AES-128' or 'NONE'
 		// If the encryption method is NONE, the URI and the IV attributes MUST NOT be present
+		Method            CryptMethod
+		URI               string
+		IV                []byte // decoded IV attribute, nil when absent
+		KeyFormat         string
+		KeyFormatVersions string
+	}
+
+	// KeyMaterial is everything needed to decrypt the segments of one EXT-X-KEY
+	KeyMaterial struct {
 		Method CryptMethod
-		URI    string
-		IV     string
+		Key    []byte // 16 byte AES key
+		IV     []byte // explicit IV, nil when it derives from the media sequence number
 	}
 )
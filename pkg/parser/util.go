@@ -2,17 +2,18 @@ package parser
 
 import (
 	"bufio"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"loki/pkg/tools"
-	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// parse parses the M3U8 content from the provided reader
-func parse(reader io.Reader) (*M3U8, error) {
+// parse parses the M3U8 content from the provided reader. In lenient mode lines that cannot be parsed
+// are skipped and reported in M3U8.Warnings instead of failing.
+func parse(reader io.Reader, lenient bool) (*M3U8, error) {
 	lines, err := readLines(reader)
 	if err != nil {
 		return nil, err
@@ -22,13 +23,49 @@ func parse(reader io.Reader) (*M3U8, error) {
 		Keys: make(map[int]*Key),
 	}
 
-	if err := processLines(lines, m3u8); err != nil {
+	if err := processLines(lines, m3u8, lenient); err != nil {
 		return nil, err
 	}
 
+	// Segments left out of a delta update still count towards the media sequence
+	first := m3u8.MediaSequence
+	if m3u8.Skip != nil {
+		first += m3u8.Skip.SkippedSegments
+	}
+	for i, seg := range m3u8.Segments {
+		seg.Sequence = first + uint64(i)
+		// EXT-X-PROGRAM-DATE-TIME applies to the segments after it too
+		if i > 0 && seg.ProgramDateTime.IsZero() {
+			if prev := m3u8.Segments[i-1]; !prev.ProgramDateTime.IsZero() {
+				seg.ProgramDateTime = prev.ProgramDateTime.Add(time.Duration(float64(prev.Duration) * float64(time.Second)))
+			}
+		}
+	}
+	dateRangeBreaks(m3u8)
+
 	return m3u8, nil
 }
 
+func (e *ParseError) Error() string {
+	if e.Tag == "" {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %s: %v", e.Line, e.Tag, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// tagName returns the tag of a playlist line without its attributes, empty for URI lines
+func tagName(line string) string {
+	if !strings.HasPrefix(line, "#") {
+		return ""
+	}
+	name, _, _ := strings.Cut(line, ":")
+	return name
+}
+
 // readLines reads all lines from the provided reader
 func readLines(reader io.Reader) ([]string, error) {
 	s := bufio.NewScanner(reader)
@@ -43,27 +80,37 @@ func readLines(reader io.Reader) ([]string, error) {
 }
 
 // processLines processes each line of the M3U8 content
-func processLines(lines []string, m3u8 *M3U8) error {
-	if len(lines) == 0 || lines[0] != extM3U {
-		return errors.New(invalidExtM3U)
+func processLines(lines []string, m3u8 *M3U8, lenient bool) error {
+	// Some editors save playlists with a UTF-8 byte order mark
+	if len(lines) == 0 || strings.TrimSpace(strings.TrimPrefix(lines[0], "\ufeff")) != extM3U {
+		return &ParseError{Line: 1, Tag: extM3U, Err: errors.New(invalidExtM3U)}
 	}
 
 	var (
 		seg      *Segment
 		key      *Key
+		initMap  *Map
 		keyIndex = 0
+		keyUsed  bool // a segment, part or map refers to the current key
 		extInf   bool
 		extByte  bool
+		parts    []*Part
+		partEnd  = make(map[string]uint64) // end of the last part byte range per URI
+		rangeEnd = make(map[string]uint64) // end of the last segment byte range per URI
+		implicit bool                      // EXT-X-BYTERANGE without offset, continues the previous range
+		discSeq  uint64                    // discontinuity sequence number of the next segment
+		disc     bool                      // EXT-X-DISCONTINUITY seen since the last segment
+		pdt      time.Time                 // EXT-X-PROGRAM-DATE-TIME of the next segment
+		cue      cueState                  // ad break opened by cue tags
+		unknown  []string                  // tags the parser does not handle, kept for Encode
+		i        int                       // index of the current line, EXT-X-STREAM-INF moves it past its URI
 	)
 
-	for i := 1; i < len(lines); i++ {
-		line := strings.TrimSpace(lines[i])
-		if line == "" {
-			continue
-		}
+	// processLine handles one line and returns why it could not be parsed
+	processLine := func(line string) error {
 		switch {
 		case strings.HasPrefix(line, playlistType):
-			if err := parsePlaylistType(line, m3u8, i); err != nil {
+			if err := parsePlaylistType(line, m3u8); err != nil {
 				return err
 			}
 		case strings.HasPrefix(line, targetDuration):
@@ -74,6 +121,52 @@ func processLines(lines []string, m3u8 *M3U8) error {
 			if err := parseMediaSequence(line, m3u8); err != nil {
 				return err
 			}
+		case strings.HasPrefix(line, discontinuitySeq):
+			if _, err := fmt.Sscanf(line, discontinuitySeq+"%d", &m3u8.DiscontinuitySequence); err != nil {
+				return fmt.Errorf("invalid EXT-X-DISCONTINUITY-SEQUENCE: %v", err)
+			}
+			discSeq = m3u8.DiscontinuitySequence
+		case strings.HasPrefix(line, programDateTime):
+			t, err := parseProgramDateTime(strings.TrimPrefix(line, programDateTime))
+			if err != nil {
+				return err
+			}
+			pdt = t
+		case line == extDiscontinuity:
+			// The sequence number given by the tag already belongs to the first segment
+			if !disc && len(m3u8.Segments) > 0 {
+				discSeq++
+			}
+			disc = true
+		case strings.HasPrefix(line, extDateRange):
+			dr, err := parseDateRange(line)
+			if err != nil {
+				return err
+			}
+			m3u8.DateRanges = append(m3u8.DateRanges, dr)
+		case strings.HasPrefix(line, extCueOutCont):
+			duration, err := parseCueOutCont(line)
+			if err != nil {
+				return err
+			}
+			// The playlist starts in the middle of a break
+			if cue.current(m3u8) == nil {
+				cue.out(m3u8, strings.TrimPrefix(extCueOutCont, "#"), duration)
+			}
+		case line == extCueOut || strings.HasPrefix(line, extCueOut+":"):
+			duration, err := parseCueOut(line)
+			if err != nil {
+				return err
+			}
+			cue.out(m3u8, strings.TrimPrefix(extCueOut, "#"), duration)
+		case strings.HasPrefix(line, extCueIn):
+			cue.in()
+		case strings.HasPrefix(line, extOATCLS):
+			scte, err := decodeSCTE35(strings.TrimPrefix(line, extOATCLS))
+			if err != nil {
+				return err
+			}
+			cue.pending = scte
 		case strings.HasPrefix(line, version):
 			if err := parseVersion(line, m3u8); err != nil {
 				return err
@@ -83,15 +176,27 @@ func processLines(lines []string, m3u8 *M3U8) error {
 			if err != nil {
 				return err
 			}
-			i++
-			if i >= len(lines) || lines[i] == "" || strings.HasPrefix(lines[i], "#") {
-				return fmt.Errorf(invalidURI, i+1)
+			if i+1 >= len(lines) || strings.TrimSpace(lines[i+1]) == "" || strings.HasPrefix(lines[i+1], "#") {
+				return errors.New(invalidURI)
 			}
-			mp.URI = lines[i]
+			i++
+			mp.URI = strings.TrimSpace(lines[i])
 			m3u8.MasterPlaylist = append(m3u8.MasterPlaylist, mp)
+		case strings.HasPrefix(line, extSteering):
+			cs, err := parseContentSteering(line)
+			if err != nil {
+				return err
+			}
+			m3u8.ContentSteering = cs
+		case strings.HasPrefix(line, extMedia):
+			media, err := parseMedia(line)
+			if err != nil {
+				return err
+			}
+			m3u8.Media = append(m3u8.Media, media)
 		case strings.HasPrefix(line, extInfPrefix):
 			if extInf {
-				return fmt.Errorf(duplicateExtInf, line, i+1)
+				return errors.New(duplicateExtInf)
 			}
 			if seg == nil {
 				seg = new(Segment)
@@ -100,48 +205,149 @@ func processLines(lines []string, m3u8 *M3U8) error {
 				return err
 			}
 			extInf = true
+			keyUsed = true
 			seg.KeyIndex = keyIndex
+			seg.Map = initMap
+			seg.Discontinuity = disc
+			seg.DiscontinuitySequence = discSeq
+			seg.AdBreak = cue.current(m3u8)
 		case strings.HasPrefix(line, extByteRange):
 			if extByte {
-				return fmt.Errorf(duplicateExtByte, line, i+1)
+				return errors.New(duplicateExtByte)
 			}
 			if seg == nil {
 				seg = new(Segment)
 			}
-			if err := parseExtByteRange(line, seg, i); err != nil {
+			explicit, err := parseExtByteRange(line, seg)
+			if err != nil {
 				return err
 			}
+			implicit = !explicit
 			extByte = true
 		case strings.HasPrefix(line, extKey):
-			keyIndex++
 			key = new(Key)
-			if err := parseExtKey(line, key, keyIndex, m3u8); err != nil {
+			if err := parseExtKey(line, key); err != nil {
+				return err
+			}
+			// Consecutive tags describe the same segments in several key formats, keep the identity one
+			if keyIndex > 0 && !keyUsed {
+				if m3u8.Keys[keyIndex].isIdentity() && !key.isIdentity() {
+					return nil
+				}
+				m3u8.Keys[keyIndex] = key
+				return nil
+			}
+			keyIndex++
+			keyUsed = false
+			m3u8.Keys[keyIndex] = key
+		case strings.HasPrefix(line, extMap):
+			initMap = new(Map)
+			if err := parseExtMap(line, initMap); err != nil {
+				return err
+			}
+			initMap.KeyIndex = keyIndex
+			keyUsed = true
+		case strings.HasPrefix(line, extPart):
+			part, err := parseExtPart(line, partEnd)
+			if err != nil {
+				return err
+			}
+			part.KeyIndex = keyIndex
+			keyUsed = true
+			part.Map = initMap
+			part.DiscontinuitySequence = discSeq
+			part.AdBreak = cue.current(m3u8)
+			parts = append(parts, part)
+		case strings.HasPrefix(line, extPartInf):
+			if _, err := fmt.Sscanf(parseLineParameters(line)["PART-TARGET"], "%f", &m3u8.PartTarget); err != nil {
+				return fmt.Errorf("invalid EXT-X-PART-INF: %v", err)
+			}
+		case strings.HasPrefix(line, extPreloadHint):
+			hint, err := parsePreloadHint(line)
+			if err != nil {
 				return err
 			}
+			m3u8.PreloadHints = append(m3u8.PreloadHints, hint)
+		case strings.HasPrefix(line, extServerControl):
+			sc, err := parseServerControl(line)
+			if err != nil {
+				return err
+			}
+			m3u8.ServerControl = sc
+		case strings.HasPrefix(line, extSkip):
+			skip, err := parseExtSkip(line)
+			if err != nil {
+				return err
+			}
+			m3u8.Skip = skip
 		case line == endList:
 			m3u8.EndList = true
+		case strings.HasPrefix(line, "#EXT"):
+			unknown = append(unknown, line)
 		case !strings.HasPrefix(line, "#"):
 			if extInf {
 				seg.URI = line
+				seg.ProgramDateTime = pdt
+				pdt = time.Time{}
+				if extByte {
+					if implicit {
+						seg.Offset = rangeEnd[line]
+					}
+					rangeEnd[line] = seg.Offset + seg.Length
+				}
+				seg.Parts = parts
+				seg.UnknownTags = unknown
 				m3u8.Segments = append(m3u8.Segments, seg)
 				seg = nil
+				parts = nil
+				unknown = nil
+				disc = false
 				extInf = false
 				extByte = false
 			} else {
-				return fmt.Errorf(invalidLine, line)
+				return errors.New(invalidLine)
+			}
+		}
+		return nil
+	}
+
+	for i = 1; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" {
+			continue
+		}
+		if err := processLine(line); err != nil {
+			perr := &ParseError{Line: i + 1, Tag: tagName(line), Err: err}
+			if !lenient {
+				return perr
 			}
+			m3u8.Warnings = append(m3u8.Warnings, perr)
 		}
 	}
+
+	// Parts after the last complete segment belong to the one being produced
+	m3u8.PendingParts = parts
+	m3u8.UnknownTags = unknown
 	return nil
 }
 
-func parsePlaylistType(line string, m3u8 *M3U8, lineNumber int) error {
+// parseProgramDateTime parses the ISO 8601 date of EXT-X-PROGRAM-DATE-TIME
+func parseProgramDateTime(s string) (time.Time, error) {
+	for _, layout := range programDateTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid EXT-X-PROGRAM-DATE-TIME: %s", s)
+}
+
+func parsePlaylistType(line string, m3u8 *M3U8) error {
 	if _, err := fmt.Sscanf(line, "#EXT-X-PLAYLIST-TYPE:%s", &m3u8.PlaylistType); err != nil {
 		return err
 	}
 	isValid := m3u8.PlaylistType == "" || m3u8.PlaylistType == "VOD" || m3u8.PlaylistType == "EVENT"
 	if !isValid {
-		return fmt.Errorf("invalid playlist type: %s, line: %d", m3u8.PlaylistType, lineNumber+1)
+		return fmt.Errorf("invalid playlist type: %s", m3u8.PlaylistType)
 	}
 	return nil
 }
@@ -172,24 +378,107 @@ func parseMasterPlaylist(line string) (*MasterPlaylist, error) {
 		case "BANDWIDTH":
 			bandwidth, err := strconv.ParseUint(v, 10, 32)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("invalid BANDWIDTH: %v", err)
 			}
 			mp.BandWidth = uint32(bandwidth)
+		case "AVERAGE-BANDWIDTH":
+			bandwidth, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid AVERAGE-BANDWIDTH: %v", err)
+			}
+			mp.AverageBandwidth = uint32(bandwidth)
 		case "RESOLUTION":
-			mp.Resolution = v
+			resolution, ok := parseResolution(v)
+			if !ok {
+				return nil, fmt.Errorf("invalid RESOLUTION: %s", v)
+			}
+			mp.Resolution = resolution
+		case "FRAME-RATE":
+			frameRate, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid FRAME-RATE: %v", err)
+			}
+			mp.FrameRate = frameRate
 		case "PROGRAM-ID":
 			programID, err := strconv.ParseUint(v, 10, 32)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("invalid PROGRAM-ID: %v", err)
 			}
 			mp.ProgramID = uint32(programID)
 		case "CODECS":
 			mp.Codecs = v
+		case "HDCP-LEVEL":
+			mp.HDCPLevel = v
+		case "VIDEO-RANGE":
+			mp.VideoRange = v
+		case "AUDIO":
+			mp.Audio = v
+		case "VIDEO":
+			mp.Video = v
+		case "SUBTITLES":
+			mp.Subtitles = v
+		case "CLOSED-CAPTIONS":
+			mp.ClosedCaptions = v
+		case "STABLE-VARIANT-ID":
+			mp.StableVariantID = v
+		case "PATHWAY-ID":
+			mp.PathwayID = v
+		default:
+			if mp.Unknown == nil {
+				mp.Unknown = make(map[string]string)
+			}
+			mp.Unknown[k] = v
 		}
 	}
 	return mp, nil
 }
 
+func parseMedia(line string) (*Media, error) {
+	params := parseLineParameters(line)
+	media := &Media{
+		Type:    MediaType(params["TYPE"]),
+		GroupID: params["GROUP-ID"],
+		Name:    params["NAME"],
+	}
+	switch media.Type {
+	case MediaTypeAudio, MediaTypeVideo, MediaTypeSubtitles, MediaTypeClosedCaptions:
+	default:
+		return nil, fmt.Errorf("invalid EXT-X-MEDIA TYPE: %s", media.Type)
+	}
+	if media.GroupID == "" || media.Name == "" {
+		return nil, errors.New("EXT-X-MEDIA requires GROUP-ID and NAME")
+	}
+	for k, v := range params {
+		switch k {
+		case "TYPE", "GROUP-ID", "NAME":
+		case "URI":
+			media.URI = v
+		case "LANGUAGE":
+			media.Language = v
+		case "ASSOC-LANGUAGE":
+			media.AssocLanguage = v
+		case "DEFAULT":
+			media.Default = v == "YES"
+		case "AUTOSELECT":
+			media.AutoSelect = v == "YES"
+		case "FORCED":
+			media.Forced = v == "YES"
+		case "INSTREAM-ID":
+			media.InstreamID = v
+		case "CHARACTERISTICS":
+			media.Characteristics = v
+		case "CHANNELS":
+			media.Channels = v
+		default:
+			if media.Unknown == nil {
+				media.Unknown = make(map[string]string)
+			}
+			media.Unknown[k] = v
+		}
+	}
+	return media, nil
+}
+
 func parseExtInf(line string, seg *Segment) error {
 	var s string
 	if _, err := fmt.Sscanf(line, "#EXTINF:%s", &s); err != nil {
@@ -208,28 +497,55 @@ func parseExtInf(line string, seg *Segment) error {
 	return nil
 }
 
-func parseExtByteRange(line string, seg *Segment, lineNumber int) error {
+// parseExtByteRange fills the segment range and reports whether the offset was given
+func parseExtByteRange(line string, seg *Segment) (bool, error) {
 	var b string
 	if _, err := fmt.Sscanf(line, "#EXT-X-BYTERANGE:%s", &b); err != nil {
-		return err
+		return false, err
 	}
 	if b == "" {
-		return fmt.Errorf("invalid EXT-X-BYTERANGE, line: %d", lineNumber+1)
+		return false, errors.New("invalid EXT-X-BYTERANGE")
 	}
+	explicit := false
 	if strings.Contains(b, "@") {
 		split := strings.Split(b, "@")
 		offset, err := strconv.ParseUint(split[1], 10, 64)
 		if err != nil {
-			return err
+			return false, err
 		}
 		seg.Offset = uint64(offset)
 		b = split[0]
+		explicit = true
 	}
 	length, err := strconv.ParseUint(b, 10, 64)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if length == 0 {
+		return false, errors.New("invalid EXT-X-BYTERANGE length 0")
 	}
 	seg.Length = uint64(length)
+	return explicit, nil
+}
+
+func parseExtMap(line string, m *Map) error {
+	params := parseLineParameters(line)
+	m.URI = params["URI"]
+	if m.URI == "" {
+		return errors.New("invalid EXT-X-MAP, missing URI")
+	}
+	if b, ok := params["BYTERANGE"]; ok {
+		length, offset, found := strings.Cut(b, "@")
+		var err error
+		if m.Length, err = strconv.ParseUint(length, 10, 64); err != nil {
+			return fmt.Errorf("invalid EXT-X-MAP BYTERANGE: %s", b)
+		}
+		if found {
+			if m.Offset, err = strconv.ParseUint(offset, 10, 64); err != nil {
+				return fmt.Errorf("invalid EXT-X-MAP BYTERANGE: %s", b)
+			}
+		}
+	}
 	return nil
 }
 
@@ -243,10 +559,10 @@ func validateCryptMethod(method string) error {
 	return fmt.Errorf("invalid CryptMethod: %s", method)
 }
 
-func parseExtKey(line string, key *Key, keyIndex int, m3u8 *M3U8) error {
+func parseExtKey(line string, key *Key) error {
 	params := parseLineParameters(line)
 	if len(params) == 0 {
-		return fmt.Errorf(invalidExtKey, line, keyIndex)
+		return errors.New(invalidExtKey)
 	}
 	method := params["METHOD"]
 	if err := validateCryptMethod(method); err != nil {
@@ -254,52 +570,49 @@ func parseExtKey(line string, key *Key, keyIndex int, m3u8 *M3U8) error {
 	}
 	key.Method = CryptMethod(method)
 	key.URI = params["URI"]
-	key.IV = params["IV"]
-	m3u8.Keys[keyIndex] = key
+	key.KeyFormat = params["KEYFORMAT"]
+	key.KeyFormatVersions = params["KEYFORMATVERSIONS"]
+	if iv, ok := params["IV"]; ok {
+		decoded, err := decodeIV(iv)
+		if err != nil {
+			return err
+		}
+		key.IV = decoded
+	}
 	return nil
 }
 
-func parseLineParameters(line string) map[string]string {
-	matches := linePattern.FindAllStringSubmatch(line, -1)
-	params := make(map[string]string)
-	for _, match := range matches {
-		params[match[1]] = strings.Trim(match[2], "\"")
-	}
-	return params
+// isIdentity reports whether the key is delivered as is rather than through a DRM system
+func (k *Key) isIdentity() bool {
+	return k.KeyFormat == "" || k.KeyFormat == keyFormatIdentity
 }
 
-// fetchKeys retrieves decryption keys for the M3U8 segments
-func fetchKeys(result *Result, baseURL *url.URL) error {
-	for idx, key := range result.M3U8.Keys {
-		switch key.Method {
-		case "", CryptMethodNONE:
-			continue
-		case CryptMethodAES:
-			keyURL := tools.ResolveURL(baseURL, key.URI)
-			keyData, err := fetchKey(keyURL)
-			if err != nil {
-				return fmt.Errorf("extract key failed: %v", err)
-			}
-			result.Keys[idx] = keyData
-		default:
-			return fmt.Errorf("unknown or unsupported encryption method: %s", key.Method)
-		}
+// decodeIV decodes an IV attribute, a 0x or 0X prefixed hexadecimal-sequence of 128 bits
+func decodeIV(s string) ([]byte, error) {
+	h := trimHexPrefix(s)
+	if len(h) == len(s) {
+		return nil, fmt.Errorf("invalid IV %s: missing 0x prefix", s)
 	}
-	return nil
+	// Some packagers drop leading zeros, pad back to 128 bits
+	if len(h) < 32 {
+		h = strings.Repeat("0", 32-len(h)) + h
+	}
+	iv, err := hex.DecodeString(h)
+	if err != nil || len(iv) != 16 {
+		return nil, fmt.Errorf("invalid IV %s: must be 128 bits of hex", s)
+	}
+	return iv, nil
 }
 
-// fetchKey requests and reads the decryption key from the specified URL
-func fetchKey(keyURL string) (string, error) {
-	body, err := tools.Get(keyURL)
-	if err != nil {
-		return "", fmt.Errorf("request key URL failed: %v", err)
+func parseLineParameters(line string) map[string]string {
+	// Drop the tag name so it never leaks into the first attribute
+	if idx := strings.Index(line, ":"); idx >= 0 {
+		line = line[idx+1:]
 	}
-	defer body.Close()
-
-	keyData, err := io.ReadAll(body)
-	if err != nil {
-		return "", fmt.Errorf("read key data failed: %v", err)
+	matches := linePattern.FindAllStringSubmatch(line, -1)
+	params := make(map[string]string)
+	for _, match := range matches {
+		params[match[1]] = strings.Trim(match[2], "\"")
 	}
-
-	return string(keyData), nil
+	return params
 }
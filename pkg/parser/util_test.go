@@ -0,0 +1,430 @@
+package parser
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLineParameters(t *testing.T) {
+	params := parseLineParameters(`#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=240000,RESOLUTION=416x234,CODECS="avc1.42e00a,mp4a.40.2"`)
+
+	expected := map[string]string{
+		"PROGRAM-ID": "1",
+		"BANDWIDTH":  "240000",
+		"RESOLUTION": "416x234",
+		"CODECS":     "avc1.42e00a,mp4a.40.2",
+	}
+	for k, v := range expected {
+		if params[k] != v {
+			t.Errorf("Expected %s=%q, got %q", k, v, params[k])
+		}
+	}
+}
+
+func TestParseMasterPlaylistAttributes(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"#EXTM3U",
+		`#EXT-X-STREAM-INF:BANDWIDTH=2500000,AVERAGE-BANDWIDTH=2100000,RESOLUTION=1920x1080,FRAME-RATE=29.970,` +
+			`CODECS="avc1.640028,mp4a.40.2",HDCP-LEVEL=TYPE-0,VIDEO-RANGE=SDR,AUDIO="aac",SUBTITLES="subs",` +
+			`CLOSED-CAPTIONS=NONE,STABLE-VARIANT-ID="v1080",X-CUSTOM="yes"`,
+		"1080/index.m3u8",
+	}, "\n")
+
+	// Act
+	m3u8, err := parse(strings.NewReader(content), false)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(m3u8.MasterPlaylist) != 1 {
+		t.Fatalf("Expected 1 variant, got %d", len(m3u8.MasterPlaylist))
+	}
+	mp := m3u8.MasterPlaylist[0]
+	if mp.URI != "1080/index.m3u8" || mp.BandWidth != 2500000 || mp.AverageBandwidth != 2100000 {
+		t.Errorf("Unexpected URI or bandwidth: %+v", mp)
+	}
+	if mp.Resolution != (Resolution{Width: 1920, Height: 1080}) {
+		t.Errorf("Expected resolution 1920x1080, got %s", mp.Resolution)
+	}
+	if mp.FrameRate != 29.97 {
+		t.Errorf("Expected frame rate 29.97, got %v", mp.FrameRate)
+	}
+	if mp.HDCPLevel != "TYPE-0" || mp.VideoRange != "SDR" || mp.Audio != "aac" || mp.Subtitles != "subs" ||
+		mp.ClosedCaptions != "NONE" || mp.StableVariantID != "v1080" {
+		t.Errorf("Unexpected attributes: %+v", mp)
+	}
+	if mp.Unknown["X-CUSTOM"] != "yes" {
+		t.Errorf("Expected unknown attribute X-CUSTOM to be kept, got %v", mp.Unknown)
+	}
+}
+
+func TestParseMediaAndSelectRenditions(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"#EXTM3U",
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="en",NAME="English",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="audio/en.m3u8"`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="fr-CA",NAME="Français",AUTOSELECT=YES,CHANNELS="6",URI="audio/fr.m3u8"`,
+		`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",LANGUAGE="fr",NAME="Français",URI="subs/fr.m3u8"`,
+		`#EXT-X-STREAM-INF:BANDWIDTH=1000000,AUDIO="aac",SUBTITLES="subs"`,
+		"video.m3u8",
+	}, "\n")
+
+	// Act
+	m3u8, err := parse(strings.NewReader(content), false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defaults := selectRenditions(m3u8, m3u8.MasterPlaylist[0], nil)
+	french := selectRenditions(m3u8, m3u8.MasterPlaylist[0], []string{"fr"})
+
+	// Assert
+	if len(m3u8.Media) != 3 {
+		t.Fatalf("Expected 3 media, got %d", len(m3u8.Media))
+	}
+	en := m3u8.Media[0]
+	if en.Type != MediaTypeAudio || en.GroupID != "aac" || en.Language != "en" || !en.Default || !en.AutoSelect ||
+		en.Channels != "2" || en.URI != "audio/en.m3u8" {
+		t.Errorf("Unexpected media: %+v", en)
+	}
+	if len(defaults) != 1 || defaults[0] != en {
+		t.Errorf("Expected only the default audio rendition, got %v", defaults)
+	}
+	if len(french) != 2 || french[0].URI != "audio/fr.m3u8" || french[1].URI != "subs/fr.m3u8" {
+		t.Errorf("Expected french audio and subtitles, got %v", french)
+	}
+}
+
+func TestSelectRenditionsFallsBackWithoutMatchingLanguage(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"#EXTM3U",
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="en",NAME="English",DEFAULT=YES,AUTOSELECT=YES,URI="audio/en.m3u8"`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="fr",NAME="Français",AUTOSELECT=YES,URI="audio/fr.m3u8"`,
+		`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",LANGUAGE="fr",NAME="Français",URI="subs/fr.m3u8"`,
+		`#EXT-X-STREAM-INF:BANDWIDTH=1000000,AUDIO="aac",SUBTITLES="subs"`,
+		"video.m3u8",
+	}, "\n")
+	m3u8, err := parse(strings.NewReader(content), false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Act
+	selected := selectRenditions(m3u8, m3u8.MasterPlaylist[0], []string{"de"})
+
+	// Assert
+	if len(selected) != 1 || selected[0].URI != "audio/en.m3u8" {
+		t.Errorf("Expected the default audio rendition, got %v", selected)
+	}
+}
+
+func TestParseExtMap(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:4",
+		`#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@16"`,
+		"#EXTINF:4,",
+		"seg0.m4s",
+		`#EXT-X-MAP:URI="init2.mp4"`,
+		"#EXTINF:4,",
+		"seg1.m4s",
+	}, "\n")
+
+	// Act
+	m3u8, err := parse(strings.NewReader(content), false)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	first, second := m3u8.Segments[0].Map, m3u8.Segments[1].Map
+	if first == nil || first.URI != "init.mp4" || first.Length != 720 || first.Offset != 16 {
+		t.Errorf("Unexpected map on first segment: %+v", first)
+	}
+	if second == nil || second.URI != "init2.mp4" || second.Length != 0 {
+		t.Errorf("Unexpected map on second segment: %+v", second)
+	}
+}
+
+func TestParseLowLatency(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=24.0,PART-HOLD-BACK=1.0",
+		"#EXT-X-PART-INF:PART-TARGET=0.5",
+		"#EXT-X-MEDIA-SEQUENCE:100",
+		"#EXT-X-SKIP:SKIPPED-SEGMENTS=3",
+		`#EXT-X-PART:DURATION=0.5,URI="seg103.mp4",BYTERANGE="1000@0",INDEPENDENT=YES`,
+		`#EXT-X-PART:DURATION=0.5,URI="seg103.mp4",BYTERANGE="800"`,
+		"#EXTINF:1.0,",
+		"seg103.mp4",
+		`#EXT-X-PART:DURATION=0.5,URI="seg104.0.mp4"`,
+		`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="seg104.1.mp4"`,
+	}, "\n")
+
+	// Act
+	m3u8, err := parse(strings.NewReader(content), false)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if sc := m3u8.ServerControl; sc == nil || !sc.CanBlockReload || sc.CanSkipUntil != 24 || sc.PartHoldBack != 1 {
+		t.Errorf("Unexpected server control: %+v", sc)
+	}
+	if m3u8.PartTarget != 0.5 || m3u8.Skip == nil || m3u8.Skip.SkippedSegments != 3 {
+		t.Errorf("Unexpected part target or skip: %v %+v", m3u8.PartTarget, m3u8.Skip)
+	}
+	seg := m3u8.Segments[0]
+	if seg.Sequence != 103 || len(seg.Parts) != 2 {
+		t.Fatalf("Expected segment 103 with 2 parts, got %d with %d", seg.Sequence, len(seg.Parts))
+	}
+	if p := seg.Parts[1]; p.Offset != 1000 || p.Length != 800 {
+		t.Errorf("Expected implicit part offset 1000, got %d", p.Offset)
+	}
+	if len(m3u8.PendingParts) != 1 || len(m3u8.PreloadHints) != 1 || m3u8.PreloadHints[0].URI != "seg104.1.mp4" {
+		t.Errorf("Unexpected pending parts or hints: %v %v", m3u8.PendingParts, m3u8.PreloadHints)
+	}
+}
+
+func TestParseExtKeyIV(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXT-X-MEDIA-SEQUENCE:7",
+		`#EXT-X-KEY:METHOD=AES-128,URI="key.bin"`,
+		"#EXTINF:4,",
+		"seg7.ts",
+		`#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x000102030405060708090A0B0C0D0E0F`,
+		"#EXTINF:4,",
+		"seg8.ts",
+	}, "\n")
+
+	// Act
+	m3u8, err := parse(strings.NewReader(content), false)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	derived := (&KeyMaterial{IV: m3u8.Keys[1].IV}).IVFor(m3u8.Segments[0].Sequence)
+	expected := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 7}
+	if string(derived) != string(expected) {
+		t.Errorf("Expected IV %x derived from the media sequence, got %x", expected, derived)
+	}
+	explicit := (&KeyMaterial{IV: m3u8.Keys[2].IV}).IVFor(m3u8.Segments[1].Sequence)
+	if len(explicit) != 16 || explicit[1] != 1 || explicit[15] != 15 {
+		t.Errorf("Expected decoded IV, got %x", explicit)
+	}
+}
+
+func TestParseImplicitByteRangeOffset(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXTINF:4,",
+		"#EXT-X-BYTERANGE:1000@500",
+		"main.ts",
+		"#EXTINF:4,",
+		"#EXT-X-BYTERANGE:2000",
+		"main.ts",
+		"#EXTINF:4,",
+		"#EXT-X-BYTERANGE:300",
+		"main.ts",
+	}, "\n")
+
+	// Act
+	m3u8, err := parse(strings.NewReader(content), false)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []uint64{500, 1500, 3500}
+	for i, seg := range m3u8.Segments {
+		if seg.Offset != expected[i] {
+			t.Errorf("Expected segment %d at offset %d, got %d", i, expected[i], seg.Offset)
+		}
+	}
+}
+
+func TestParseDiscontinuity(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXT-X-DISCONTINUITY-SEQUENCE:3",
+		"#EXTINF:4,",
+		"a0.ts",
+		"#EXT-X-DISCONTINUITY",
+		"#EXTINF:4,",
+		"ad0.ts",
+		"#EXTINF:4,",
+		"ad1.ts",
+		"#EXT-X-DISCONTINUITY",
+		"#EXTINF:4,",
+		"a1.ts",
+	}, "\n")
+
+	// Act
+	m3u8, err := parse(strings.NewReader(content), false)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []struct {
+		discontinuity bool
+		sequence      uint64
+	}{{false, 3}, {true, 4}, {false, 4}, {true, 5}}
+	for i, seg := range m3u8.Segments {
+		if seg.Discontinuity != expected[i].discontinuity || seg.DiscontinuitySequence != expected[i].sequence {
+			t.Errorf("Segment %d: expected %v/%d, got %v/%d", i, expected[i].discontinuity, expected[i].sequence,
+				seg.Discontinuity, seg.DiscontinuitySequence)
+		}
+	}
+}
+
+func TestParseProgramDateTime(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:6",
+		"#EXTINF:6,",
+		"s0.ts",
+		"#EXT-X-PROGRAM-DATE-TIME:2024-05-01T10:00:00.500+0200",
+		"#EXTINF:6,",
+		"s1.ts",
+		"#EXTINF:4.5,",
+		"s2.ts",
+		"#EXTINF:6,",
+		"s3.ts",
+	}, "\n")
+
+	// Act
+	m3u8, err := parse(strings.NewReader(content), false)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !m3u8.Segments[0].ProgramDateTime.IsZero() {
+		t.Errorf("Expected no date before the first tag, got %v", m3u8.Segments[0].ProgramDateTime)
+	}
+	expected := time.Date(2024, 5, 1, 8, 0, 11, 0, time.UTC)
+	if got := m3u8.Segments[3].ProgramDateTime; !got.Equal(expected) {
+		t.Errorf("Expected carried forward date %v, got %v", expected, got)
+	}
+}
+
+func TestParseAdBreaks(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:10",
+		"#EXT-X-PROGRAM-DATE-TIME:2024-05-01T10:00:00Z",
+		"#EXTINF:10,", "s0.ts",
+		"#EXT-OATCLS-SCTE35:/DAlAAAAAAAAAP/wFAUAAAABf+/+ANgNkv4AFI7gAAEBAQAAF3P3/A==",
+		"#EXT-X-CUE-OUT:15",
+		"#EXTINF:10,", "s1.ts",
+		"#EXT-X-CUE-OUT-CONT:ElapsedTime=10,Duration=15",
+		"#EXTINF:5,", "s2.ts",
+		"#EXT-X-CUE-IN",
+		"#EXTINF:10,", "s3.ts",
+		`#EXT-X-DATERANGE:ID="ad2",START-DATE="2024-05-01T10:00:35Z",SCTE35-OUT=0xFC302000000000000000FFF00F05000000017FFFFE002932E000010000000000000000`,
+		"#EXTINF:10,", "s4.ts",
+		"#EXTINF:10,", "s5.ts",
+		"#EXTINF:10,", "s6.ts",
+		"#EXTINF:10,", "s7.ts",
+		"#EXT-X-ENDLIST",
+	}, "\n")
+
+	// Act
+	m3u8, err := parse(strings.NewReader(content), false)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(m3u8.AdBreaks) != 2 {
+		t.Fatalf("Expected 2 ad breaks, got %d", len(m3u8.AdBreaks))
+	}
+	cue, dr := m3u8.AdBreaks[0], m3u8.AdBreaks[1]
+	if cue.Source != "EXT-X-CUE-OUT" || cue.Duration != 15 || cue.Out == nil || !cue.Out.Out || cue.Out.EventID != 1 {
+		t.Errorf("Unexpected cue break %+v", cue)
+	}
+	if dr.ID != "ad2" || dr.Duration != 30 || dr.Out == nil || dr.Out.Duration != 30 {
+		t.Errorf("Unexpected date range break %+v", dr)
+	}
+
+	expected := []*AdBreak{nil, cue, cue, nil, dr, dr, dr, nil}
+	for i, seg := range m3u8.Segments {
+		if seg.AdBreak != expected[i] {
+			t.Errorf("Expected segment %d in break %v, got %v", i, expected[i], seg.AdBreak)
+		}
+	}
+}
+
+func TestParseErrorLine(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:10",
+		`#EXT-X-KEY:METHOD=AES-128,URI="k1.bin"`,
+		"#EXTINF:10,", "s0.ts",
+		"#EXT-X-KEY:METHOD=ROT13",
+		"#EXTINF:10,", "s1.ts",
+	}, "\n")
+
+	// Act
+	_, err := parse(strings.NewReader(content), false)
+
+	// Assert
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected a ParseError, got %v", err)
+	}
+	if perr.Line != 6 || perr.Tag != "#EXT-X-KEY" {
+		t.Errorf("Expected line 6 and tag #EXT-X-KEY, got line %d and tag %q", perr.Line, perr.Tag)
+	}
+}
+
+func TestParseLenient(t *testing.T) {
+	// Arrange
+	content := strings.Join([]string{
+		"\ufeff#EXTM3U",
+		"#EXT-X-TARGETDURATION:10",
+		"#EXTINF:10,", "s0.ts",
+		"stray.ts",
+		"#EXTINF:ten,", "s1.ts",
+		"#EXTINF:10,", "s2.ts",
+	}, "\n")
+
+	// Act
+	m3u8, err := parse(strings.NewReader(content), true)
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(m3u8.Segments) != 2 || m3u8.Segments[1].URI != "s2.ts" {
+		t.Errorf("Expected segments s0.ts and s2.ts, got %d segments", len(m3u8.Segments))
+	}
+	if len(m3u8.Warnings) != 3 {
+		t.Fatalf("Expected 3 warnings, got %v", m3u8.Warnings)
+	}
+	lines := []int{5, 6, 7}
+	for i, w := range m3u8.Warnings {
+		if w.Line != lines[i] {
+			t.Errorf("Expected warning on line %d, got %s", lines[i], w)
+		}
+	}
+}
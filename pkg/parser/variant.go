@@ -0,0 +1,175 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Select picks one variant according to the selector and returns the rejected ones with a reason
+func (s *VariantSelector) Select(variants []*MasterPlaylist) (*MasterPlaylist, []*Rejection, error) {
+	if len(variants) == 0 {
+		return nil, nil, fmt.Errorf("no variant found in master playlist")
+	}
+
+	var rejected []*Rejection
+	reject := func(v *MasterPlaylist, format string, args ...any) {
+		rejected = append(rejected, &Rejection{Variant: v, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	candidates := variants
+	if s.MaxBandwidth > 0 {
+		var kept []*MasterPlaylist
+		for _, v := range candidates {
+			if v.BandWidth > s.MaxBandwidth {
+				reject(v, "bandwidth %d exceeds cap %d", v.BandWidth, s.MaxBandwidth)
+				continue
+			}
+			kept = append(kept, v)
+		}
+		if len(kept) == 0 {
+			return nil, rejected, fmt.Errorf("no variant within bandwidth cap %d", s.MaxBandwidth)
+		}
+		candidates = kept
+	}
+
+	if len(s.Codecs) > 0 {
+		best := len(s.Codecs)
+		for _, v := range candidates {
+			if rank := s.codecRank(v); rank < best {
+				best = rank
+			}
+		}
+		// Only narrow the list when at least one variant matches a preferred codec
+		if best < len(s.Codecs) {
+			var kept []*MasterPlaylist
+			for _, v := range candidates {
+				if s.codecRank(v) > best {
+					reject(v, "codecs %q not preferred over %s", v.Codecs, s.Codecs[best])
+					continue
+				}
+				kept = append(kept, v)
+			}
+			candidates = kept
+		}
+	}
+
+	policy := s.Policy
+	if policy == "" {
+		policy = VariantPolicyHighest
+		if s.Resolution != "" {
+			policy = VariantPolicyResolution
+		}
+	}
+
+	chosen := candidates[0]
+	switch policy {
+	case VariantPolicyFirst:
+	case VariantPolicyHighest:
+		for _, v := range candidates[1:] {
+			if v.BandWidth > chosen.BandWidth {
+				chosen = v
+			}
+		}
+	case VariantPolicyLowest:
+		for _, v := range candidates[1:] {
+			if v.BandWidth < chosen.BandWidth {
+				chosen = v
+			}
+		}
+	case VariantPolicyResolution:
+		target, ok := parseResolution(s.Resolution)
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid target resolution: %s", s.Resolution)
+		}
+		distance := func(v *MasterPlaylist) int {
+			if v.Resolution.IsZero() {
+				return int(^uint(0) >> 1)
+			}
+			d := v.Resolution.Pixels() - target.Pixels()
+			if d < 0 {
+				d = -d
+			}
+			return d
+		}
+		for _, v := range candidates[1:] {
+			dv, dc := distance(v), distance(chosen)
+			if dv < dc || (dv == dc && v.BandWidth > chosen.BandWidth) {
+				chosen = v
+			}
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown variant policy: %s", policy)
+	}
+
+	for _, v := range candidates {
+		if v == chosen {
+			continue
+		}
+		switch policy {
+		case VariantPolicyFirst:
+			reject(v, "listed after the chosen variant")
+		case VariantPolicyHighest:
+			reject(v, "bandwidth %d lower than %d", v.BandWidth, chosen.BandWidth)
+		case VariantPolicyLowest:
+			reject(v, "bandwidth %d higher than %d", v.BandWidth, chosen.BandWidth)
+		case VariantPolicyResolution:
+			reject(v, "resolution %s further from target %s than %s", v.Resolution, s.Resolution, chosen.Resolution)
+		}
+	}
+
+	return chosen, rejected, nil
+}
+
+// codecRank returns the index of the first preferred codec the variant carries, or len(s.Codecs)
+func (s *VariantSelector) codecRank(v *MasterPlaylist) int {
+	for rank, pref := range s.Codecs {
+		for _, codec := range strings.Split(v.Codecs, ",") {
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(codec)), strings.ToLower(pref)) {
+				return rank
+			}
+		}
+	}
+	return len(s.Codecs)
+}
+
+// String returns a short description of the variant
+func (mp *MasterPlaylist) String() string {
+	s := fmt.Sprintf("BANDWIDTH=%d", mp.BandWidth)
+	if !mp.Resolution.IsZero() {
+		s += ",RESOLUTION=" + mp.Resolution.String()
+	}
+	if mp.Codecs != "" {
+		s += fmt.Sprintf(",CODECS=%q", mp.Codecs)
+	}
+	return s + " " + mp.URI
+}
+
+// String returns the resolution as WIDTHxHEIGHT
+func (r Resolution) String() string {
+	return fmt.Sprintf("%dx%d", r.Width, r.Height)
+}
+
+// IsZero reports whether the resolution is unset
+func (r Resolution) IsZero() bool {
+	return r.Width == 0 && r.Height == 0
+}
+
+// Pixels returns the number of pixels in a frame
+func (r Resolution) Pixels() int {
+	return r.Width * r.Height
+}
+
+// parseResolution splits a WIDTHxHEIGHT string
+func parseResolution(s string) (Resolution, bool) {
+	w, h, found := strings.Cut(strings.ToLower(s), "x")
+	if !found {
+		return Resolution{}, false
+	}
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if errW != nil || errH != nil || width <= 0 || height <= 0 {
+		return Resolution{}, false
+	}
+	return Resolution{Width: width, Height: height}, true
+}
@@ -0,0 +1,114 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func testVariants() []*MasterPlaylist {
+	return []*MasterPlaylist{
+		{URI: "low.m3u8", BandWidth: 400000, Resolution: Resolution{640, 360}, Codecs: "avc1.42e00a,mp4a.40.2"},
+		{URI: "hevc.m3u8", BandWidth: 3000000, Resolution: Resolution{1920, 1080}, Codecs: "hvc1.1.6.L120.90,mp4a.40.2"},
+		{URI: "mid.m3u8", BandWidth: 1500000, Resolution: Resolution{1280, 720}, Codecs: "avc1.4d401f,mp4a.40.2"},
+		{URI: "high.m3u8", BandWidth: 2500000, Resolution: Resolution{1920, 1080}, Codecs: "avc1.640028,mp4a.40.2"},
+	}
+}
+
+func TestSelectDefaultsToHighestBandwidth(t *testing.T) {
+	// Arrange
+	s := &VariantSelector{}
+
+	// Act
+	chosen, rejected, err := s.Select(testVariants())
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if chosen.URI != "hevc.m3u8" {
+		t.Errorf("Expected hevc.m3u8, got %s", chosen.URI)
+	}
+	if len(rejected) != 3 {
+		t.Errorf("Expected 3 rejected variants, got %d", len(rejected))
+	}
+}
+
+func TestSelectCodecPreferenceAndCap(t *testing.T) {
+	// Arrange
+	s := &VariantSelector{MaxBandwidth: 2000000, Codecs: []string{"avc1", "hvc1"}}
+
+	// Act
+	chosen, rejected, err := s.Select(testVariants())
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if chosen.URI != "mid.m3u8" {
+		t.Errorf("Expected mid.m3u8, got %s", chosen.URI)
+	}
+	if len(rejected) != 3 {
+		t.Errorf("Expected 3 rejected variants, got %d", len(rejected))
+	}
+}
+
+func TestSelectClosestResolution(t *testing.T) {
+	// Arrange
+	s := &VariantSelector{Resolution: "1280x700", Codecs: []string{"avc1"}}
+
+	// Act
+	chosen, _, err := s.Select(testVariants())
+
+	// Assert
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if chosen.URI != "mid.m3u8" {
+		t.Errorf("Expected mid.m3u8, got %s", chosen.URI)
+	}
+}
+
+func TestSelectNothingUnderCap(t *testing.T) {
+	s := &VariantSelector{MaxBandwidth: 1000}
+
+	if _, _, err := s.Select(testVariants()); err == nil {
+		t.Error("Expected error, but got nil")
+	}
+}
+
+func TestGroupRedundantByPathway(t *testing.T) {
+	// Arrange
+	playlist := `#EXTM3U
+#EXT-X-CONTENT-STEERING:SERVER-URI="/steering",PATHWAY-ID="CDN-B"
+#EXT-X-STREAM-INF:BANDWIDTH=1500000,RESOLUTION=1280x720,PATHWAY-ID="CDN-A"
+https://a.example.com/720.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1500000,RESOLUTION=1280x720,PATHWAY-ID="CDN-B"
+https://b.example.com/720.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=400000,RESOLUTION=640x360,PATHWAY-ID="CDN-A"
+https://a.example.com/360.m3u8
+`
+	m3u8, err := parse(strings.NewReader(playlist), false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Act
+	primaries, copies := GroupRedundant(m3u8.MasterPlaylist, []string{m3u8.ContentSteering.PathwayID, "CDN-A"})
+
+	// Assert
+	if m3u8.ContentSteering.ServerURI != "/steering" {
+		t.Errorf("Expected SERVER-URI /steering, got %s", m3u8.ContentSteering.ServerURI)
+	}
+	if len(primaries) != 2 {
+		t.Fatalf("Expected 2 variants, got %d", len(primaries))
+	}
+	if primaries[0].URI != "https://b.example.com/720.m3u8" {
+		t.Errorf("Expected the CDN-B copy first, got %s", primaries[0].URI)
+	}
+	if backups := copies[primaries[0]]; len(backups) != 1 || backups[0].PathwayID != "CDN-A" {
+		t.Errorf("Expected the CDN-A copy as backup, got %v", backups)
+	}
+	if len(copies[primaries[1]]) != 0 {
+		t.Errorf("Expected no backup for 640x360, got %v", copies[primaries[1]])
+	}
+}
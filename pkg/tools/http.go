@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,21 +11,81 @@ import (
 	"time"
 )
 
-// Get returns the response body from a GET request to the provided URL
-func Get(url string) (io.ReadCloser, error) {
+// HTTPError is a response with a status code other than 200 OK and 206 Partial Content
+type HTTPError struct {
+	StatusCode int
+}
+
+// Error implements error
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("http error: status code %d", e.StatusCode)
+}
+
+// Get returns the response body from a GET request to the provided URL, the request is aborted when ctx is done
+func Get(ctx context.Context, url string) (io.ReadCloser, error) {
+	return GetWithHeader(ctx, url, nil)
+}
+
+// GetWithHeader is Get with extra request headers, e.g. the credentials of a key server
+func GetWithHeader(ctx context.Context, url string, header http.Header) (io.ReadCloser, error) {
+	resp, err := do(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// GetRange returns length bytes of the resource starting at offset using a Range request.
+// A server that ignores the Range header answers 200 with the whole resource, which is cut to the range.
+func GetRange(ctx context.Context, url string, offset, length uint64) (io.ReadCloser, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := do(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		return resp.Body, nil
+	}
+
+	if _, err := io.CopyN(io.Discard, resp.Body, int64(offset)); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("skip to byte range offset %d: %w", offset, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, int64(length)), resp.Body}, nil
+}
+
+// do sends a GET request and accepts 200 OK and 206 Partial Content
+func do(ctx context.Context, url string, header http.Header) (*http.Response, error) {
 	c := http.Client{
 		Timeout: time.Duration(60) * time.Second,
 	}
-	resp, err := c.Get(url)
-	if err != nil || resp == nil {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
 		return nil, err
 	}
+	for k, values := range header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("http error: no response")
+	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("http error: status code %d", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, &HTTPError{StatusCode: resp.StatusCode}
 	}
 
-	return resp.Body, nil
+	return resp, nil
 }
 
 // ResolveURL resolves the provided path to a full URL using the base URL
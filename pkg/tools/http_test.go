@@ -1,10 +1,13 @@
 package tools
 
 import (
+	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestGetSuccess(t *testing.T) {
@@ -16,7 +19,7 @@ func TestGetSuccess(t *testing.T) {
 	defer server.Close()
 
 	// Call the Get function with the test server URL
-	body, err := Get(server.URL)
+	body, err := Get(context.Background(), server.URL)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -31,3 +34,30 @@ func TestGetSuccess(t *testing.T) {
 		t.Errorf("Expected body %q, got %q", expectedBody, string(actualBody))
 	}
 }
+
+func TestGetRange(t *testing.T) {
+	content := []byte("0123456789")
+	servers := map[string]http.HandlerFunc{
+		"partial": func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(content))
+		},
+		"ignored": func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(content)
+		},
+	}
+
+	for name, handler := range servers {
+		server := httptest.NewServer(handler)
+
+		body, err := GetRange(context.Background(), server.URL, 3, 4)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", name, err)
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		if string(data) != "3456" {
+			t.Errorf("%s: expected %q, got %q", name, "3456", data)
+		}
+		server.Close()
+	}
+}
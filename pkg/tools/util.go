@@ -1,7 +1,10 @@
 package tools
 
 import (
+	"bytes"
 	"fmt"
+	"net/url"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -12,6 +15,11 @@ var (
 	tsExt = ".ts"
 )
 
+const (
+	tsSyncByte   = 0x47 // MPEG-TS Sync Byte
+	tsPacketSize = 188
+)
+
 // StartQueue returns a slice of integers from 0 to len-1
 func StartQueue(len int) []int {
 	q := make([]int, 0)
@@ -62,3 +70,44 @@ func IsExistedExt(filePath string) bool {
 	ext := filepath.Ext(filePath)
 	return ext != ""
 }
+
+// URLExt returns the extension of the path part of a URL, ignoring any query string
+func URLExt(rawURL string) string {
+	p := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		p = u.Path
+	}
+	return strings.ToLower(path.Ext(p))
+}
+
+// StripWebVTTHeader removes the WEBVTT header block so segments can be appended to a single file
+func StripWebVTTHeader(data []byte) []byte {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !bytes.HasPrefix(data, []byte("WEBVTT")) {
+		return data
+	}
+	normalized := bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	idx := bytes.Index(normalized, []byte("\n\n"))
+	if idx < 0 {
+		return nil
+	}
+	return append([]byte("\n"), normalized[idx+2:]...)
+}
+
+// TrimToSyncByte drops any leading bytes before the first MPEG-TS packet. Data that starts with a sync
+// byte is returned as is, otherwise a sync byte only counts when the next packet also starts with one,
+// so payload bytes of 0x47 are skipped. Data without such a packet boundary is not TS and is left alone.
+func TrimToSyncByte(data []byte) []byte {
+	if len(data) > 0 && data[0] == tsSyncByte {
+		return data
+	}
+	for i, b := range data {
+		if b != tsSyncByte {
+			continue
+		}
+		if next := i + tsPacketSize; next < len(data) && data[next] == tsSyncByte {
+			return data[i:]
+		}
+	}
+	return data
+}
@@ -0,0 +1,36 @@
+package tools
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTrimToSyncByte(t *testing.T) {
+	packet := append([]byte{0x47, 0x40, 0x11, 0x10}, make([]byte, 184)...)
+	ts := append(bytes.Clone(packet), packet...)
+	// Packed audio: an ID3 tag and ADTS frames with a stray 0x47 close to the end
+	audio := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x00"), bytes.Repeat([]byte{0xff, 0xf1, 0x50, 0x80}, 100)...)
+	audio[len(audio)-50] = 0x47
+
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{"aligned", ts, ts},
+		{"leading garbage", append([]byte{0x00, 0x47, 0x01}, ts...), ts},
+		{"packed audio", audio, audio},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Act
+			got := TrimToSyncByte(tt.data)
+
+			// Assert
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Expected %d bytes, got %d", len(tt.want), len(got))
+			}
+		})
+	}
+}